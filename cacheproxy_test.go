@@ -5,16 +5,22 @@ import (
 	"context"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	. "github.com/iostrovok/check"
 
 	"github.com/iostrovok/cacheproxy/config"
 	"github.com/iostrovok/cacheproxy/handler"
+	"github.com/iostrovok/cacheproxy/plugins"
+	psqlite "github.com/iostrovok/cacheproxy/plugins/sqlite"
 )
 
 var StandaloneServerPort = 35000
@@ -30,7 +36,7 @@ func TestService(t *testing.T) { TestingT(t) }
 
 var testHome string
 
-//Run once when the suite starts running.
+// Run once when the suite starts running.
 func (s *testSuite) SetUpSuite(c *C) {
 	dir, err := ioutil.TempDir(os.TempDir(), "prefix")
 	c.Assert(err, IsNil)
@@ -38,17 +44,18 @@ func (s *testSuite) SetUpSuite(c *C) {
 	s.globalCtx, s.globalCancel = context.WithCancel(context.Background())
 }
 
-//Run before each test or benchmark starts running.
+// Run before each test or benchmark starts running.
 func (s *testSuite) SetUpTest(c *C) {}
 
-//Run after each test or benchmark runs.
+// Run after each test or benchmark runs.
 func (s *testSuite) TearDownTest(c *C) {}
 
 // Run once after all tests or benchmarks have finished running.
 func (s *testSuite) TearDownSuite(c *C) {
 	s.globalCancel()
 	tmpFiles := []string{"my_post_test.db", "my_get_test.db", "test_0.db", "test_1.db", "test_2.db",
-		"test_3.db", "test_0.db", "test_1.db", "test_2.db", "test_3.db"}
+		"test_3.db", "test_0.db", "test_1.db", "test_2.db", "test_3.db", "my_large_test.db", "my_truncated_test.db", "my_head_test.db", "my_stream_test.db", "my_ttl_test.db",
+		"my_large_stream_test.db"}
 	for _, fileName := range tmpFiles {
 		os.RemoveAll(filepath.Join(testHome, fileName))
 	}
@@ -125,3 +132,287 @@ func (s *testSuite) TestPost(c *C) {
 
 	c.Assert(counter, Equals, 1)
 }
+
+func (s *testSuite) TestLargeBody(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	large := strings.Repeat("0123456789", 1000)
+
+	counter := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		counter++
+		fmt.Fprint(w, large)
+	}))
+	defer ts.Close()
+
+	cfg := baseCfg(ts.URL, "my_large_test.db", 19202)
+	cfg.MaxInlineBodySize = 1000
+	cfg.BodyChunkSize = 3000
+	keeper := &savedKeys{IPlugin: psqlite.New(ctx, cfg), keys: map[string]bool{}}
+	cfg.Keeper = keeper
+
+	c.Assert(handler.Start(ctx, cfg), IsNil)
+
+	for _, path := range []string{"/large/export", "/large/export", "/large/copy"} {
+		resp, err := http.Get("http://127.0.0.1:19202" + path)
+		c.Assert(err, IsNil)
+		body, err := ioutil.ReadAll(resp.Body)
+		c.Assert(err, IsNil)
+		c.Assert(string(body), Equals, large)
+		resp.Body.Close()
+	}
+
+	c.Assert(counter, Equals, 2)
+
+	// 2 items and 2 different parts of the same body: 3 equal parts of 3000 bytes and the last one
+	c.Assert(len(keeper.keys), Equals, 4)
+}
+
+// savedKeys remembers keys of saved records.
+type savedKeys struct {
+	plugins.IPlugin
+	mx   sync.Mutex
+	keys map[string]bool
+}
+
+func (k *savedKeys) Save(file, key string, data []byte) error {
+	k.mx.Lock()
+	k.keys[key] = true
+	k.mx.Unlock()
+	return k.IPlugin.Save(file, key, data)
+}
+
+func (s *testSuite) TestTruncatedBody(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	counter := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		counter++
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		c.Assert(err, IsNil)
+		defer conn.Close()
+
+		// promise 100 bytes and send only 5 of them
+		fmt.Fprint(buf, "HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\nHello")
+		buf.Flush()
+	}))
+	defer ts.Close()
+
+	cfg := baseCfg(ts.URL, "my_truncated_test.db", 19203)
+	c.Assert(handler.Start(ctx, cfg), IsNil)
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", "127.0.0.1:19203")
+		c.Assert(err, IsNil)
+		fmt.Fprint(conn, "GET /truncated HTTP/1.1\r\nHost: 127.0.0.1\r\nConnection: close\r\n\r\n")
+		_, err = ioutil.ReadAll(conn)
+		c.Assert(err, IsNil)
+		conn.Close()
+	}
+
+	// the broken response is not stored, so upstream is requested every time
+	c.Assert(counter, Equals, 2)
+}
+
+func (s *testSuite) TestHead(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	counter := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		counter++
+		w.Header().Set("Content-Length", "10")
+	}))
+	defer ts.Close()
+
+	cfg := baseCfg(ts.URL, "my_head_test.db", 19206)
+	c.Assert(handler.Start(ctx, cfg), IsNil)
+
+	for i := 0; i < 2; i++ {
+		resp, err := http.Head("http://127.0.0.1:19206/head")
+		c.Assert(err, IsNil)
+		resp.Body.Close()
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		c.Assert(resp.ContentLength, Equals, int64(10))
+	}
+
+	// the response without body is not truncated, so it's stored
+	c.Assert(counter, Equals, 1)
+}
+
+func (s *testSuite) TestStream(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	counter := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		counter++
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 3; i++ {
+			fmt.Fprintf(w, "data: event-%d\n\n", i)
+			w.(http.Flusher).Flush()
+			time.Sleep(50 * time.Millisecond)
+		}
+	}))
+	defer ts.Close()
+
+	cfg := baseCfg(ts.URL, "my_stream_test.db", 19204)
+	cfg.StreamTiming = config.StreamTimingOriginal
+
+	c.Assert(handler.Start(ctx, cfg), IsNil)
+
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+		resp, err := http.Get("http://127.0.0.1:19204/events")
+		c.Assert(err, IsNil)
+		body, err := ioutil.ReadAll(resp.Body)
+		c.Assert(err, IsNil)
+		c.Assert(string(body), Equals, "data: event-0\n\ndata: event-1\n\ndata: event-2\n\n")
+		c.Assert(time.Since(start) >= 100*time.Millisecond, Equals, true)
+		resp.Body.Close()
+	}
+
+	c.Assert(counter, Equals, 1)
+}
+
+func (s *testSuite) TestLargeStream(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	counter := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		counter++
+		for i := 0; i < 10; i++ {
+			fmt.Fprintf(w, "%03d%s", i, strings.Repeat("x", 97))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer ts.Close()
+
+	cfg := baseCfg(ts.URL, "my_large_stream_test.db", 19207)
+	cfg.StreamChunked = true
+	cfg.MaxInlineBodySize = 300
+	cfg.BodyChunkSize = 256
+
+	c.Assert(handler.Start(ctx, cfg), IsNil)
+
+	var first string
+	for i := 0; i < 2; i++ {
+		resp, err := http.Get("http://127.0.0.1:19207/chunked")
+		c.Assert(err, IsNil)
+		body, err := ioutil.ReadAll(resp.Body)
+		c.Assert(err, IsNil)
+		resp.Body.Close()
+		c.Assert(body, HasLen, 1000)
+		if i == 0 {
+			first = string(body)
+		}
+		c.Assert(string(body), Equals, first)
+	}
+	c.Assert(counter, Equals, 1)
+
+	// the large stream is stored as the record and parts of the body
+	records := 0
+	c.Assert(cfg.Keeper.(plugins.IExporter).Export(func(file, key string, data []byte) error {
+		if file == cfg.FileName {
+			records++
+		}
+		return nil
+	}), IsNil)
+	c.Assert(records, Equals, 5)
+}
+
+func (s *testSuite) TestTTL(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mx sync.Mutex
+	counter, fail := 0, false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mx.Lock()
+		defer mx.Unlock()
+		counter++
+		if fail {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		fmt.Fprintf(w, "response-%d", counter)
+	}))
+	defer ts.Close()
+
+	// the clock of the proxy is moved by the test
+	now := time.Now()
+	cfg := baseCfg(ts.URL, "my_ttl_test.db", 19205)
+	cfg.Now = func() time.Time {
+		mx.Lock()
+		defer mx.Unlock()
+		return now
+	}
+	cfg.Rules = []config.Rule{
+		{PathPrefix: "/stale", TTL: time.Minute, StaleIfError: true},
+		{PathPrefix: "/background", TTL: time.Minute, StaleWhileRevalidate: true},
+		{TTL: time.Minute},
+	}
+	c.Assert(handler.Start(ctx, cfg), IsNil)
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get("http://127.0.0.1:19205" + path)
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		c.Assert(err, IsNil)
+		return resp.StatusCode, string(body)
+	}
+
+	setFail := func(v bool) {
+		mx.Lock()
+		fail = v
+		mx.Unlock()
+	}
+
+	expire := func() {
+		mx.Lock()
+		now = now.Add(2 * time.Minute)
+		mx.Unlock()
+	}
+
+	// the fresh response is replayed, the stale one is loaded again
+	_, body := get("/ttl")
+	c.Assert(body, Equals, "response-1")
+	_, body = get("/ttl")
+	c.Assert(body, Equals, "response-1")
+	expire()
+	_, body = get("/ttl")
+	c.Assert(body, Equals, "response-2")
+
+	// stale-if-error
+	_, body = get("/stale")
+	c.Assert(body, Equals, "response-3")
+	expire()
+	setFail(true)
+	status, body := get("/stale")
+	c.Assert(status, Equals, http.StatusOK)
+	c.Assert(body, Equals, "response-3")
+
+	// without stale-if-error the error of upstream is passed to the client
+	status, _ = get("/ttl")
+	c.Assert(status, Equals, http.StatusBadGateway)
+	setFail(false)
+
+	// stale-while-revalidate
+	_, body = get("/background")
+	c.Assert(body, Equals, "response-6")
+	expire()
+	_, body = get("/background")
+	c.Assert(body, Equals, "response-6")
+
+	// the response is loaded in background, the stale one is replayed until it's stored
+	deadline := time.Now().Add(5 * time.Second)
+	for body == "response-6" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		_, body = get("/background")
+	}
+	c.Assert(body, Equals, "response-7")
+}
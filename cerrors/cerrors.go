@@ -1,8 +1,62 @@
 package cerrors
 
-import "github.com/pkg/errors"
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
 
 var (
 	EmptyVersion       = errors.New("need to set up version. [use SetVersion(version string) function with non-empty version value]")
 	PluginHasNoVersion = errors.New("plugin is not support version")
+	ReadOnlyKeeper     = errors.New("keeper has no writable layer")
+	NotSupported       = errors.New("operation is not supported by the keeper")
+)
+
+// Misconfigurations found by config.Validate, they're wrapped by ConfigError.
+var (
+	EmptyHost      = errors.New("host is empty")
+	BadHost        = errors.New("host is not the URL of upstream")
+	BadScheme      = errors.New("scheme is not http or https")
+	MissingTLSFile = errors.New("TLS file is not found")
+	BadPort        = errors.New("port is out of range")
+	BadMode        = errors.New("unknown mode")
+	UnknownKeeper  = errors.New("unknown keeper type")
+	BadValue       = errors.New("bad value")
 )
+
+// ConfigError is the misconfiguration of the setting, errors.Is(err, cerrors.EmptyHost) and so on check its kind.
+type ConfigError struct {
+	// Setting is the name of the setting in config files, like "host" or "routes[0].config.port".
+	Setting string
+
+	// Err wraps one of misconfigurations with details.
+	Err error
+}
+
+func (e *ConfigError) Error() string {
+	return e.Setting + ": " + e.Err.Error()
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// ConfigErrors are all misconfigurations of the config, errors.Is and errors.As check every one of them.
+type ConfigErrors []*ConfigError
+
+func (e ConfigErrors) Error() string {
+	out := make([]string, 0, len(e))
+	for _, err := range e {
+		out = append(out, err.Error())
+	}
+	return strings.Join(out, "; ")
+}
+
+func (e ConfigErrors) Unwrap() []error {
+	out := make([]error, 0, len(e))
+	for _, err := range e {
+		out = append(out, err)
+	}
+	return out
+}
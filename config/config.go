@@ -1,45 +1,411 @@
 package config
 
 import (
+	"fmt"
+	"log/slog"
+	"net/http"
 	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/iostrovok/cacheproxy/cerrors"
+	"github.com/iostrovok/cacheproxy/hooks"
+	"github.com/iostrovok/cacheproxy/logger"
 	"github.com/iostrovok/cacheproxy/plugins"
+	"github.com/iostrovok/cacheproxy/signer"
+	"github.com/iostrovok/cacheproxy/store"
+	"github.com/iostrovok/cacheproxy/version"
 )
 
+const (
+	// DefaultMaxInlineBodySize is the largest response body which is kept inside the record itself.
+	DefaultMaxInlineBodySize int64 = 1 << 20
+
+	// DefaultBodyChunkSize is the size of one out-of-line part of a large response body.
+	DefaultBodyChunkSize int64 = 1 << 20
+
+	// DefaultDedupMinBodySize is the smallest response body which is stored once by content hash.
+	DefaultDedupMinBodySize int64 = 64 << 10
+
+	// DefaultAdminHistory is the number of recent interactions kept for the admin API.
+	DefaultAdminHistory = 100
+)
+
+// Mode defines how requests are served, it may be switched by the admin API at runtime.
+type Mode string
+
+const (
+	// ModeAuto replays stored responses and records missed ones.
+	ModeAuto Mode = ""
+
+	// ModeRecord always loads responses from upstream and stores them, as ForceSave does.
+	ModeRecord Mode = "record"
+
+	// ModeReplay replays stored responses only, missed requests fail.
+	ModeReplay Mode = "replay"
+
+	// ModePassthrough passes requests to upstream, nothing is read or stored.
+	ModePassthrough Mode = "passthrough"
+)
+
+// ParseMode returns the mode by its name, "auto" is ModeAuto.
+func ParseMode(name string) (Mode, error) {
+	switch m := Mode(strings.ToLower(strings.TrimSpace(name))); m {
+	case "auto":
+		return ModeAuto, nil
+	case ModeAuto, ModeRecord, ModeReplay, ModePassthrough:
+		return m, nil
+	}
+
+	return ModeAuto, fmt.Errorf("%w %q, it's one of auto, record, replay or passthrough", cerrors.BadMode, name)
+}
+
+// DefaultCompression is used if Config.Compression is nil.
+// Compressed media are stored as is, everything else is compressed by zstd.
+var DefaultCompression = map[string]string{
+	"":                   "zstd",
+	"image/":             "none",
+	"video/":             "none",
+	"audio/":             "none",
+	"font/woff":          "none",
+	"application/zip":    "none",
+	"application/gzip":   "none",
+	"application/x-xz":   "none",
+	"application/zstd":   "none",
+	"application/x-bzip": "none",
+}
+
+// StreamTiming defines how the recorded stream is replayed.
+type StreamTiming string
+
+const (
+	// StreamTimingNone replays all chunks of the stream without delays.
+	StreamTimingNone StreamTiming = ""
+
+	// StreamTimingOriginal replays chunks with the recorded delays.
+	StreamTimingOriginal StreamTiming = "original"
+
+	// StreamTimingScaled replays chunks with the recorded delays multiplied by StreamTimingScale.
+	StreamTimingScaled StreamTiming = "scaled"
+)
+
+// DefaultStreamContentTypes is used if Config.StreamContentTypes is empty.
+var DefaultStreamContentTypes = []string{
+	"text/event-stream",
+	"application/x-ndjson",
+	"application/ndjson",
+	"application/stream+json",
+	"application/jsonl",
+}
+
+// Config is settings of the proxy. Tags are names of settings in config files, see Load.
 type Config struct {
-	Host             string
-	Scheme           string
-	Port             int
-	PemPath, KeyPath string
-	StorePath        string
-	FileName         string
-	Verbose          bool
-	ForceSave        bool
-	DynamoFileName   bool
-	URL              *url.URL
+	// Name of the proxy in config files, it's used in errors and in names of environment variables.
+	Name string `json:"name"`
+
+	// Host is the URL of upstream, Scheme is used if it has no scheme, like "localhost:9200".
+	Host string `json:"host"`
+
+	// Scheme of the proxy itself: "http" (by default) or "https" with PemPath and KeyPath.
+	Scheme string `json:"scheme"`
+
+	Port           int      `json:"port"`
+	PemPath        string   `json:"pem_path"`
+	KeyPath        string   `json:"key_path"`
+	FileName       string   `json:"file_name"`
+	Verbose        bool     `json:"verbose"` // Deprecated: Verbose means LogLevel slog.LevelDebug.
+	ForceSave      bool     `json:"force_save"`
+	DynamoFileName bool     `json:"dynamo_file_name"`
+	URL            *url.URL `json:"-"`
+
+	// StorePath is the directory of stored data, the current directory is used if it's empty.
+	StorePath string `json:"store_path"`
 
 	// This option provides deleting records which weren't requested during tests.
-	SessionMode bool
+	SessionMode bool `json:"session_mode"`
 
 	//If NoUseDomain is true proxy don't use domain name and port for storing data.
 	//So you may use it for test with different servers.
-	NoUseDomain bool
+	NoUseDomain bool `json:"no_use_domain"`
 
 	// If NoUseUserData is true proxy don't use user's name for storing data.
 	// So you may use it for test with different user.
-	NoUseUserData bool
+	NoUseUserData bool `json:"no_use_user_data"`
+
+	// MaxInlineBodySize is the largest response body (in bytes) stored inside the record.
+	// Larger bodies are stored by the keeper as separated parts of BodyChunkSize bytes.
+	// Zero means DefaultMaxInlineBodySize.
+	MaxInlineBodySize int64 `json:"max_inline_body_size"`
+
+	// BodyChunkSize is the size of one part of a large response body. Zero means DefaultBodyChunkSize.
+	BodyChunkSize int64 `json:"body_chunk_size"`
+
+	// DedupMinBodySize is the smallest response body (in bytes) which is stored once by content hash
+	// outside of the record, so the same body of many records is stored once.
+	// Zero means DefaultDedupMinBodySize, negative value switches deduplication off.
+	DedupMinBodySize int64 `json:"dedup_min_body_size"`
+
+	// Compression maps Content-Type of responses to codecs of stored records: "none", "zlib" or "zstd".
+	// The key is the prefix of the media type, the longest matched prefix wins, "" matches everything.
+	// Responses with Content-Encoding are stored as is. DefaultCompression is used if it's nil.
+	Compression map[string]string `json:"compression"`
+
+	// SpoolDir is the directory for temporary files with response bodies.
+	// The default directory for temporary files is used if it's empty.
+	SpoolDir string `json:"spool_dir"`
+
+	// StreamContentTypes is the list of content types of responses which are recorded as streams:
+	// chunk by chunk with the time of every chunk. DefaultStreamContentTypes is used if it's empty.
+	// Streams larger than MaxInlineBodySize are stored as ordinary bodies without timing.
+	StreamContentTypes []string `json:"stream_content_types"`
+
+	// If StreamChunked is true every response without Content-Length is recorded as stream.
+	StreamChunked bool `json:"stream_chunked"`
+
+	// StreamTiming defines delays between chunks when the stream is replayed.
+	StreamTiming StreamTiming `json:"stream_timing"`
+
+	// StreamTimingScale is the multiplier of the recorded delays for StreamTimingScaled.
+	// For example 0.5 replays the stream twice as fast.
+	StreamTimingScale float64 `json:"stream_timing_scale"`
+
+	// Version of the stored data, the git branch name is the first candidate.
+	// It's found by version.Resolve if it's empty: CACHEPROXY_VERSION variable,
+	// CI variables or .git/HEAD of the repository which contains VersionDir.
+	// The version is passed to the keeper by Setup. Keeper set by the user keeps its own version
+	// if Version is empty, the resolved version is passed to keepers made by KeeperConfig only.
+	Version string `json:"version"`
+
+	// versionResolved is true if Version is found by version.Resolve, not set by the user
+	versionResolved bool
+
+	// proxy is the name of the proxy for metrics, see ProxyName
+	proxy string
+
+	// VersionDir is the directory inside the git repository, the current directory is used if it's empty.
+	VersionDir string `json:"version_dir"`
+
+	// FallbackVersions are parent versions which are read if data is not found for Version.
+	// It's passed to the keeper if the keeper supports it and it's not set by the user or the list is not empty.
+	FallbackVersions []string `json:"fallback_versions"`
+
+	// If HTTPCaching is true the proxy works as the HTTP cache (RFC 9111) instead of replaying forever:
+	// Cache-Control, Expires, ETag, Last-Modified and Vary headers of responses are respected,
+	// stale responses are revalidated by upstream. Rules are not used in this mode.
+	HTTPCaching bool `json:"http_caching"`
+
+	// Now returns the current time for the freshness of stored responses, time.Now is used if it's nil.
+	// Tests set it to move the time forward without waiting.
+	Now func() time.Time `json:"-"`
+
+	// Rules define the freshness of stored responses, the first matched rule is used.
+	// Stored responses of requests without the rule are replayed forever.
+	Rules []Rule `json:"rules"`
+
+	// Routes send matched requests to other upstreams with other settings, the first matched route is used.
+	// Requests without the route are sent to Host, they fail if Host is empty.
+	Routes []Route `json:"routes"`
+
+	// Mode is the initial mode of the proxy, ForceSave means ModeRecord if it's empty.
+	Mode Mode `json:"mode"`
+
+	// AdminPort is the port of the admin API, the admin API is served on the separated port if it's not 0.
+	AdminPort int `json:"admin_port"`
+
+	// AdminPrefix is the path prefix of the admin API on the proxy port, for example "/_cacheproxy".
+	// Requests with this prefix are not passed to upstream. The admin API is off if AdminPort and AdminPrefix are empty.
+	AdminPrefix string `json:"admin_prefix"`
+
+	// AdminHistory is the number of recent interactions kept for the admin API. Zero means DefaultAdminHistory.
+	AdminHistory int `json:"admin_history"`
+
+	// Hooks intercept processing of requests in order, see hooks.Hook.
+	Hooks hooks.Chain `json:"-"`
+
+	// Signer signs requests to upstream again, signature headers of clients are removed
+	// before the cache key is made. See signer.SigV4 and signer.HMAC.
+	Signer signer.Signer `json:"-"`
 
 	// Saver and reader
-	Keeper plugins.IPlugin
+	Keeper plugins.IPlugin `json:"-"`
+
+	// KeeperConfig describes the keeper which is made by Setup if Keeper is nil.
+	// The sqlite keeper is used if both of them are nil.
+	KeeperConfig *KeeperConfig `json:"keeper"`
 
 	// SetLogger switches the plugin to debug mode and the plugin should print the filename and key.
 	// Returns error if this mode is not supported.
-	Logger plugins.ILogger
+	// Deprecated: use LogHandler, Init passes debug lines of Logger to it by default.
+	Logger plugins.ILogger `json:"-"`
+
+	// LogHandler receives structured logs of the proxy and of keepers which implement plugins.ISlog.
+	// The text handler writing to stderr with LogLevel is used if it's nil.
+	LogHandler slog.Handler `json:"-"`
+
+	// LogLevel is the minimal level of the default LogHandler, slog.LevelWarn if it's nil.
+	// Every request is logged with slog.LevelInfo, details of processing with slog.LevelDebug.
+	LogLevel slog.Leveler `json:"-"`
+
+	log *slog.Logger
+}
+
+// Init sets defaults of empty settings and prepares rules and routes.
+// It returns cerrors.ConfigErrors if some values can't be used, Validate checks the whole config.
+func (cfg *Config) Init() error {
+	cfg.setDefaults()
+
+	errs := cfg.checkValues()
+	for i := range cfg.Rules {
+		cfg.Rules[i].init()
+	}
+
+	for i := range cfg.Routes {
+		if err := cfg.Routes[i].init(cfg); err != nil {
+			errs = append(errs, prefixErrors(fmt.Sprintf("routes[%d].config.", i), err)...)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// setDefaults is the only place where empty settings get their defaults.
+func (cfg *Config) setDefaults() {
+	if cfg.MaxInlineBodySize <= 0 {
+		cfg.MaxInlineBodySize = DefaultMaxInlineBodySize
+	}
+
+	if cfg.BodyChunkSize <= 0 {
+		cfg.BodyChunkSize = DefaultBodyChunkSize
+	}
+
+	if cfg.DedupMinBodySize == 0 {
+		cfg.DedupMinBodySize = DefaultDedupMinBodySize
+	}
+
+	if cfg.Compression == nil {
+		cfg.Compression = DefaultCompression
+	}
+
+	if mode, err := ParseMode(string(cfg.Mode)); err == nil {
+		cfg.Mode = mode
+	}
+	if cfg.Mode == ModeAuto && cfg.ForceSave {
+		cfg.Mode = ModeRecord
+	}
+
+	if cfg.Scheme == "" {
+		cfg.Scheme = "http"
+	}
+	if u, err := upstreamURL(cfg.Host, cfg.Scheme); err == nil {
+		cfg.URL = u
+	} else {
+		cfg.URL = &url.URL{}
+	}
+
+	if cfg.StorePath == "" {
+		if dir, err := os.Getwd(); err == nil {
+			cfg.StorePath = dir
+		}
+	}
+
+	if cfg.LogHandler == nil {
+		level := cfg.LogLevel
+		if level == nil {
+			level = slog.LevelWarn
+			if cfg.Verbose {
+				level = slog.LevelDebug
+			}
+		}
+		cfg.LogHandler = slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})
+	}
+	cfg.log = slog.New(cfg.LogHandler)
+
+	// lines of the old logger are passed to the structured one
+	if cfg.Logger == nil {
+		cfg.Logger = logger.FromSlog(cfg.log)
+	}
+
+	if cfg.Now == nil {
+		cfg.Now = time.Now
+	}
+
+	cfg.proxy = cfg.Name
+	if cfg.proxy == "" {
+		cfg.proxy = strconv.Itoa(cfg.Port)
+	}
+
+	if cfg.AdminHistory <= 0 {
+		cfg.AdminHistory = DefaultAdminHistory
+	}
+	cfg.AdminPrefix = strings.TrimRight(cfg.AdminPrefix, "/")
+
+	if cfg.Version == "" {
+		cfg.Version = version.Resolve(cfg.VersionDir)
+		cfg.versionResolved = true
+	}
+
+	if len(cfg.StreamContentTypes) == 0 {
+		cfg.StreamContentTypes = DefaultStreamContentTypes
+	}
+}
+
+// StreamDelay returns the delay before the chunk of the replayed stream.
+// The delay is the difference of recorded offsets of the chunk and the previous one.
+func (cfg *Config) StreamDelay(delay time.Duration) time.Duration {
+	switch cfg.StreamTiming {
+	case StreamTimingOriginal:
+		return delay
+	case StreamTimingScaled:
+		return time.Duration(float64(delay) * cfg.StreamTimingScale)
+	}
+
+	return 0
+}
+
+// Codec returns the codec of the stored record by headers of the response.
+func (cfg *Config) Codec(header http.Header) store.Codec {
+	if header.Get("Content-Encoding") != "" {
+		return store.CodecNone
+	}
+
+	mediaType := strings.ToLower(header.Get("Content-Type"))
+	if i := strings.Index(mediaType, ";"); i >= 0 {
+		mediaType = mediaType[:i]
+	}
+	mediaType = strings.TrimSpace(mediaType)
+
+	name, found := "zlib", ""
+	matched := false
+	for prefix, codec := range cfg.Compression {
+		if strings.HasPrefix(mediaType, prefix) && (!matched || len(prefix) > len(found)) {
+			name, found, matched = codec, prefix, true
+		}
+	}
+
+	codec, err := store.ParseCodec(name)
+	if err != nil {
+		return store.CodecZlib
+	}
+	return codec
+}
+
+// ProxyName returns Name of the proxy or its port if the name is empty, routes have names of their proxies.
+// It's the "proxy" label of metrics.
+func (cfg *Config) ProxyName() string {
+	return cfg.proxy
 }
 
-func (cfg *Config) Init() (err error) {
-	cfg.URL, err = url.Parse(cfg.Host)
-	return
+// Log returns the logger of the proxy, slog.Default() is returned before Init.
+func (cfg *Config) Log() *slog.Logger {
+	if cfg.log == nil {
+		return slog.Default()
+	}
+	return cfg.log
 }
 
 func (cfg *Config) SetKeeper(keeper plugins.IPlugin) {
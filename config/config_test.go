@@ -1,9 +1,15 @@
 package config
 
 import (
+	"context"
+	"log/slog"
+	"net/http"
 	"testing"
+	"time"
 
 	. "github.com/iostrovok/check"
+
+	"github.com/iostrovok/cacheproxy/store"
 )
 
 type testSuite struct{}
@@ -16,3 +22,58 @@ func TestService(t *testing.T) { TestingT(t) }
 func (s *testSuite) Test(c *C) {
 	c.Assert(true, Equals, true)
 }
+
+func (s *testSuite) TestStreamDelay(c *C) {
+	cfg := &Config{}
+	c.Assert(cfg.StreamDelay(time.Second), Equals, time.Duration(0))
+
+	cfg.StreamTiming = StreamTimingOriginal
+	c.Assert(cfg.StreamDelay(time.Second), Equals, time.Second)
+
+	cfg.StreamTiming = StreamTimingScaled
+	cfg.StreamTimingScale = 0.5
+	c.Assert(cfg.StreamDelay(time.Second), Equals, 500*time.Millisecond)
+}
+
+func (s *testSuite) TestCodec(c *C) {
+	cfg := &Config{Compression: DefaultCompression}
+
+	header := func(contentType, encoding string) http.Header {
+		h := http.Header{}
+		h.Set("Content-Type", contentType)
+		if encoding != "" {
+			h.Set("Content-Encoding", encoding)
+		}
+		return h
+	}
+
+	c.Assert(cfg.Codec(header("application/json; charset=utf-8", "")), Equals, store.CodecZstd)
+	c.Assert(cfg.Codec(header("image/png", "")), Equals, store.CodecNone)
+	c.Assert(cfg.Codec(header("application/json", "gzip")), Equals, store.CodecNone)
+	c.Assert(cfg.Codec(http.Header{}), Equals, store.CodecZstd)
+
+	cfg.Compression = map[string]string{"text/": "zlib", "text/html": "none"}
+	c.Assert(cfg.Codec(header("text/html", "")), Equals, store.CodecNone)
+	c.Assert(cfg.Codec(header("text/plain", "")), Equals, store.CodecZlib)
+	c.Assert(cfg.Codec(header("application/json", "")), Equals, store.CodecZlib)
+
+	cfg.Compression = map[string]string{"": "lz4"}
+	c.Assert(cfg.Init(), NotNil)
+}
+
+func (s *testSuite) TestLog(c *C) {
+	ctx := context.Background()
+
+	cfg := &Config{}
+	c.Assert(cfg.Init(), IsNil)
+	c.Assert(cfg.Log().Enabled(ctx, slog.LevelInfo), Equals, false)
+	c.Assert(cfg.Log().Enabled(ctx, slog.LevelWarn), Equals, true)
+
+	cfg = &Config{Verbose: true}
+	c.Assert(cfg.Init(), IsNil)
+	c.Assert(cfg.Log().Enabled(ctx, slog.LevelDebug), Equals, true)
+
+	cfg = &Config{Verbose: true, LogLevel: slog.LevelError}
+	c.Assert(cfg.Init(), IsNil)
+	c.Assert(cfg.Log().Enabled(ctx, slog.LevelWarn), Equals, false)
+}
@@ -0,0 +1,278 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix is the prefix of environment variables which override settings of config files.
+const EnvPrefix = "CACHEPROXY_"
+
+// proxyEnvPrefix returns the prefix of environment variables which override settings of the named proxy,
+// like CACHEPROXY_PROXY_AUTH_API__ for "auth-api". The double underscore separates the name from settings,
+// so names never collide with global settings.
+func proxyEnvPrefix(name string) string {
+	return EnvPrefix + "PROXY_" + strings.ToUpper(strings.NewReplacer("-", "_", ".", "_", " ", "_").Replace(name)) + "__"
+}
+
+// Load reads settings of proxies from the YAML (.yaml, .yml), JSON (.json) or TOML (.toml) file.
+// Names of settings are json tags of Config, like
+//
+//	store_path: ./testdata
+//	keeper:
+//	  type: pg
+//	  dsn: postgres://localhost/fixtures?sslmode=disable
+//	proxies:
+//	  - name: es
+//	    host: http://localhost:9200
+//	    port: 19200
+//	    rules:
+//	      - path_prefix: /_cluster/
+//	        ttl: 10m
+//	  - name: auth
+//	    host: https://auth.example.com
+//	    port: 19201
+//	    mode: replay
+//
+// Top level settings are shared by all proxies, settings of the proxy replace them.
+// The file without "proxies" defines the only proxy. "log_level" is debug, info, warn or error.
+//
+// Environment variables override settings: CACHEPROXY_<SETTING> of all proxies and
+// CACHEPROXY_PROXY_<NAME>__<SETTING> of the named proxy, like CACHEPROXY_KEEPER_DSN or CACHEPROXY_PROXY_ES__PORT.
+// Lists are separated by commas, maps and lists of rules and routes can't be set by variables.
+// If the path is empty the only proxy is defined by environment variables.
+//
+// Proxies are checked by Validate, so the missed host, the bad scheme or missed TLS files are reported here,
+// not by handler.Start.
+func Load(path string) ([]*Config, error) {
+	raws := []map[string]any{{}}
+	if path != "" {
+		var err error
+		if raws, err = readFile(path); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	out := make([]*Config, 0, len(raws))
+	var errs []error
+	for i, raw := range raws {
+		cfg, err := decodeProxy(raw)
+		if err == nil {
+			err = cfg.Validate()
+		}
+
+		if err != nil {
+			name := fmt.Sprintf("proxy #%d", i+1)
+			if cfg != nil && cfg.Name != "" {
+				name = fmt.Sprintf("proxy %q", cfg.Name)
+			}
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+
+		out = append(out, cfg)
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		if path != "" {
+			err = fmt.Errorf("%s: %w", path, err)
+		}
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// proxyFile is the proxy in config files, it has settings which are not a part of Config.
+type proxyFile struct {
+	*Config
+
+	LogLevel string `json:"log_level"`
+}
+
+// readFile returns settings of every proxy, the shared settings are merged to them.
+func readFile(path string) ([]map[string]any, error) {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := map[string]any{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(body, &raw)
+	case ".json":
+		err = json.Unmarshal(body, &raw)
+	case ".toml":
+		err = toml.Unmarshal(body, &raw)
+	default:
+		return nil, fmt.Errorf("unknown format %q, it's one of .yaml, .yml, .json or .toml", ext)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	list, find := raw["proxies"]
+	if !find {
+		return []map[string]any{raw}, nil
+	}
+	delete(raw, "proxies")
+
+	proxies, ok := list.([]any)
+	if !ok {
+		return nil, errors.New("proxies is not a list")
+	}
+
+	out := make([]map[string]any, 0, len(proxies))
+	for i, p := range proxies {
+		proxy, ok := p.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("proxy #%d is not a map", i+1)
+		}
+
+		merged := make(map[string]any, len(raw)+len(proxy))
+		for k, v := range raw {
+			merged[k] = v
+		}
+		for k, v := range proxy {
+			merged[k] = v
+		}
+		out = append(out, merged)
+	}
+
+	return out, nil
+}
+
+// decodeProxy makes the config by settings of the file and environment variables.
+func decodeProxy(raw map[string]any) (*Config, error) {
+	body, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	file := &proxyFile{Config: &Config{}}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(file); err != nil {
+		return file.Config, err
+	}
+
+	// the name is never shared, CACHEPROXY_NAME sets it for the only proxy of environment variables
+	name := file.Name
+	if err := setEnv(reflect.ValueOf(file).Elem(), EnvPrefix); err != nil {
+		return file.Config, err
+	}
+	if name != "" {
+		file.Name = name
+		if err := setEnv(reflect.ValueOf(file).Elem(), proxyEnvPrefix(name)); err != nil {
+			return file.Config, err
+		}
+	}
+
+	if file.LogLevel != "" {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(file.LogLevel)); err != nil {
+			return file.Config, fmt.Errorf("log_level: %w", err)
+		}
+		file.Config.LogLevel = level
+	}
+
+	return file.Config, nil
+}
+
+// setEnv sets fields of the struct by environment variables, names of variables are made by json tags.
+func setEnv(v reflect.Value, prefix string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field, value := t.Field(i), v.Field(i)
+
+		// the embedded config has settings of the same level
+		if field.Anonymous && field.Type.Kind() == reflect.Pointer {
+			if err := setEnv(value.Elem(), prefix); err != nil {
+				return err
+			}
+			continue
+		}
+
+		tag, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if tag == "" || tag == "-" {
+			continue
+		}
+		name := prefix + strings.ToUpper(tag)
+
+		// nested settings like the keeper are made if some variable is set
+		if field.Type.Kind() == reflect.Pointer && field.Type.Elem().Kind() == reflect.Struct && field.Type.Elem() != t {
+			nested := reflect.New(field.Type.Elem())
+			if !value.IsNil() {
+				nested.Elem().Set(value.Elem())
+			}
+			if err := setEnv(nested.Elem(), name+"_"); err != nil {
+				return err
+			}
+			if !value.IsNil() || !nested.Elem().IsZero() {
+				value.Set(nested)
+			}
+			continue
+		}
+
+		s, find := os.LookupEnv(name)
+		if !find {
+			continue
+		}
+		if err := setString(value, s); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// setString sets the value of the scalar or of the list of strings, other types are skipped.
+func setString(v reflect.Value, s string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return nil
+		}
+		list := reflect.MakeSlice(v.Type(), 0, 0)
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = reflect.Append(list, reflect.ValueOf(item).Convert(v.Type().Elem()))
+			}
+		}
+		v.Set(list)
+	}
+
+	return nil
+}
@@ -0,0 +1,245 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/iostrovok/check"
+
+	"github.com/iostrovok/cacheproxy/cerrors"
+	"github.com/iostrovok/cacheproxy/plugins"
+)
+
+func writeFile(c *C, name, body string) string {
+	path := filepath.Join(c.MkDir(), name)
+	c.Assert(os.WriteFile(path, []byte(body), 0o600), IsNil)
+	return path
+}
+
+// registerKeepers registers fake keepers, plugin packages can't be imported here.
+func registerKeepers() {
+	for _, name := range []string{"sqlite", "test-mem"} {
+		RegisterKeeper(name, func(context.Context, *Config, *KeeperConfig) (plugins.IPlugin, error) {
+			return nil, nil
+		})
+	}
+}
+
+func (s *testSuite) TestLoadYAML(c *C) {
+	registerKeepers()
+
+	path := writeFile(c, "proxy.yaml", `
+store_path: ./testdata
+keeper:
+  type: test-mem
+  dsn: postgres://localhost/fixtures
+proxies:
+  - name: es
+    host: http://localhost:9200
+    port: 19200
+    fallback_versions: [develop, main]
+    rules:
+      - path_prefix: /_cluster/
+        ttl: 10m
+        stale_if_error: true
+  - name: auth-api
+    host: https://auth.example.com
+    port: 19201
+    mode: replay
+    store_path: ./auth
+    log_level: debug
+    routes:
+      - host: token.local
+        strip_prefix: true
+        config:
+          host: http://localhost:8080
+`)
+
+	cfgs, err := Load(path)
+	c.Assert(err, IsNil)
+	c.Assert(cfgs, HasLen, 2)
+
+	es, auth := cfgs[0], cfgs[1]
+	c.Assert(es.Name, Equals, "es")
+	c.Assert(es.Port, Equals, 19200)
+	c.Assert(es.StorePath, Equals, "./testdata")
+	c.Assert(es.FallbackVersions, DeepEquals, []string{"develop", "main"})
+	c.Assert(es.KeeperConfig, DeepEquals, &KeeperConfig{Type: "test-mem", DSN: "postgres://localhost/fixtures"})
+	c.Assert(es.Rules, HasLen, 1)
+	c.Assert(es.Rules[0].PathPrefix, Equals, "/_cluster/")
+	c.Assert(es.Rules[0].TTL, Equals, 10*time.Minute)
+	c.Assert(es.Rules[0].StaleIfError, Equals, true)
+	c.Assert(es.LogLevel, IsNil)
+
+	c.Assert(auth.Mode, Equals, ModeReplay)
+	c.Assert(auth.StorePath, Equals, "./auth")
+	c.Assert(auth.LogLevel, Equals, slog.LevelDebug)
+	c.Assert(auth.Routes, HasLen, 1)
+	c.Assert(auth.Routes[0].Host, Equals, "token.local")
+	c.Assert(auth.Routes[0].StripPrefix, Equals, true)
+	c.Assert(auth.Routes[0].Config.Host, Equals, "http://localhost:8080")
+}
+
+func (s *testSuite) TestLoadFormats(c *C) {
+	json := writeFile(c, "proxy.json", `{"host": "http://localhost:9200", "port": 19200, "rules": [{"ttl": "1h"}]}`)
+	toml := writeFile(c, "proxy.toml", `
+host = "http://localhost:9200"
+port = 19200
+
+[[rules]]
+ttl = "1h"
+`)
+
+	for _, path := range []string{json, toml} {
+		cfgs, err := Load(path)
+		c.Assert(err, IsNil, Commentf("%s", path))
+		c.Assert(cfgs, HasLen, 1)
+		c.Assert(cfgs[0].Host, Equals, "http://localhost:9200")
+		c.Assert(cfgs[0].Port, Equals, 19200)
+		c.Assert(cfgs[0].Rules[0].TTL, Equals, time.Hour)
+	}
+
+	_, err := Load(writeFile(c, "proxy.ini", `host=http://localhost`))
+	c.Assert(err, ErrorMatches, `.*unknown format ".ini".*`)
+
+	_, err = Load(writeFile(c, "proxy.json", `{"host": "http://localhost", "hots": "x"}`))
+	c.Assert(err, ErrorMatches, `.*unknown field "hots".*`)
+
+	_, err = Load(writeFile(c, "proxy.json", `{"host": "http://localhost", "rules": [{"ttl": "ten"}]}`))
+	c.Assert(err, ErrorMatches, `.*rule ttl.*`)
+}
+
+func (s *testSuite) TestLoadEnv(c *C) {
+	registerKeepers()
+
+	env := map[string]string{
+		"CACHEPROXY_HOST":                 "http://localhost:9200",
+		"CACHEPROXY_PORT":                 "19200",
+		"CACHEPROXY_FORCE_SAVE":           "true",
+		"CACHEPROXY_KEEPER_DSN":           "postgres://db/fixtures",
+		"CACHEPROXY_PROXY_AUTH_API__PORT": "19201",
+		"CACHEPROXY_PROXY_AUTH_API__MODE": "passthrough",
+		"CACHEPROXY_PROXY_KEEPER__PORT":   "19202",
+		"CACHEPROXY_NAME":                 "single",
+		"CACHEPROXY_STREAM_CONTENT_TYPES": "text/event-stream, application/x-ndjson",
+	}
+	for k, v := range env {
+		c.Assert(os.Setenv(k, v), IsNil)
+	}
+	defer func() {
+		for k := range env {
+			os.Unsetenv(k)
+		}
+	}()
+
+	cfgs, err := Load("")
+	c.Assert(err, IsNil)
+	c.Assert(cfgs, HasLen, 1)
+	c.Assert(cfgs[0].Host, Equals, "http://localhost:9200")
+	c.Assert(cfgs[0].Port, Equals, 19200)
+	c.Assert(cfgs[0].ForceSave, Equals, true)
+	c.Assert(cfgs[0].KeeperConfig, DeepEquals, &KeeperConfig{DSN: "postgres://db/fixtures"})
+	c.Assert(cfgs[0].StreamContentTypes, DeepEquals, []string{"text/event-stream", "application/x-ndjson"})
+	c.Assert(cfgs[0].Name, Equals, "single")
+
+	cfgs, err = Load(writeFile(c, "proxy.yaml", `
+proxies:
+  - name: es
+    port: 1
+  - name: auth-api
+    port: 2
+    keeper:
+      type: sqlite
+      table: fixtures
+  - name: keeper
+    port: 3
+`))
+	c.Assert(err, IsNil)
+	c.Assert(cfgs, HasLen, 3)
+	c.Assert(cfgs[0].Name, Equals, "es")
+	c.Assert(cfgs[0].Port, Equals, 19200)
+	c.Assert(cfgs[0].Mode, Equals, ModeAuto)
+	c.Assert(cfgs[1].Name, Equals, "auth-api")
+	c.Assert(cfgs[1].Port, Equals, 19201)
+	c.Assert(cfgs[1].Mode, Equals, ModePassthrough)
+	c.Assert(cfgs[1].KeeperConfig, DeepEquals, &KeeperConfig{Type: "sqlite", Table: "fixtures", DSN: "postgres://db/fixtures"})
+
+	// the global keeper setting isn't taken as the setting of the proxy named "keeper"
+	c.Assert(cfgs[2].Name, Equals, "keeper")
+	c.Assert(cfgs[2].Port, Equals, 19202)
+	c.Assert(cfgs[2].KeeperConfig, DeepEquals, &KeeperConfig{DSN: "postgres://db/fixtures"})
+
+	c.Assert(os.Setenv("CACHEPROXY_PORT", "port"), IsNil)
+	_, err = Load("")
+	c.Assert(err, ErrorMatches, `.*CACHEPROXY_PORT.*invalid syntax.*`)
+}
+
+func (s *testSuite) TestLoadErrors(c *C) {
+	path := writeFile(c, "proxy.yaml", `
+proxies:
+  - name: empty
+  - name: ftp
+    host: ftp://localhost
+    scheme: tcp
+  - name: tls
+    host: http://localhost
+    scheme: https
+    pem_path: /not/found.pem
+  - name: keeper
+    host: http://localhost
+    mode: sometimes
+    keeper:
+      type: tiered
+      backend:
+        type: unknown
+  - host: http://localhost
+    routes:
+      - path_prefix: /es/
+`)
+
+	_, err := Load(path)
+	c.Assert(err, NotNil)
+
+	msg := err.Error()
+	for _, part := range []string{
+		`proxy "empty": host: host is empty`,
+		`proxy "ftp": host: host is not the URL of upstream: "ftp://localhost" has no http, https, ws or wss scheme`,
+		`scheme: scheme is not http or https: "tcp"`,
+		`proxy "tls": pem_path: TLS file is not found: stat /not/found.pem: no such file or directory`,
+		`key_path: TLS file is not found: it's empty for https`,
+		`mode: unknown mode "sometimes"`,
+		`keeper.type: unknown keeper type "tiered"`,
+		`keeper.backend.type: unknown keeper type "unknown"`,
+		`proxy #5: routes[0].config: bad value: route ""/es/ has no config`,
+	} {
+		c.Assert(strings.Contains(msg, part), Equals, true, Commentf("%q is not in\n%s", part, msg))
+	}
+
+	for _, kind := range []error{
+		cerrors.EmptyHost, cerrors.BadHost, cerrors.BadScheme, cerrors.MissingTLSFile,
+		cerrors.BadMode, cerrors.UnknownKeeper, cerrors.BadValue,
+	} {
+		c.Assert(errors.Is(err, kind), Equals, true, Commentf("%v", kind))
+	}
+}
+
+func (s *testSuite) TestNewKeeper(c *C) {
+	var got *KeeperConfig
+	RegisterKeeper("test-kc", func(_ context.Context, _ *Config, kc *KeeperConfig) (plugins.IPlugin, error) {
+		got = kc
+		return nil, nil
+	})
+
+	kc := &KeeperConfig{Type: "test-kc", Table: "t"}
+	_, err := NewKeeper(context.Background(), &Config{}, kc)
+	c.Assert(err, IsNil)
+	c.Assert(got, Equals, kc)
+
+	_, err = NewKeeper(context.Background(), &Config{}, &KeeperConfig{Type: "nope"})
+	c.Assert(err, ErrorMatches, `unknown keeper type "nope".*test-kc.*`)
+}
@@ -0,0 +1,87 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/iostrovok/cacheproxy/cerrors"
+)
+
+// Route sends matched requests to its own upstream with its own settings.
+// Empty conditions match every request.
+type Route struct {
+	// Host of the request with or without port, like "es.local"
+	Host string `json:"host"`
+
+	// PathPrefix is the prefix of the request path, like "/es/"
+	PathPrefix string `json:"path_prefix"`
+
+	// If StripPrefix is true PathPrefix is removed from the path of the request to upstream.
+	StripPrefix bool `json:"strip_prefix"`
+
+	// Config is settings of the route: Host of upstream, Keeper, Rules, file naming and so on.
+	// Empty StorePath, Version, FallbackVersions, Keeper (without KeeperConfig), Logger, LogHandler, Hooks and Now
+	// are taken from the parent.
+	// Settings of the server (Port, Scheme, certificates, Mode and the admin API) and Routes are not used.
+	Config *Config `json:"config"`
+}
+
+func (r *Route) init(parent *Config) error {
+	if r.Config == nil {
+		return fmt.Errorf("%w: route %q%s has no config", cerrors.BadValue, r.Host, r.PathPrefix)
+	}
+
+	cfg := r.Config
+	if cfg.StorePath == "" {
+		cfg.StorePath = parent.StorePath
+	}
+	if cfg.Version == "" {
+		cfg.Version, cfg.versionResolved = parent.Version, parent.versionResolved
+	}
+	if cfg.FallbackVersions == nil {
+		cfg.FallbackVersions = parent.FallbackVersions
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = parent.Logger
+	}
+	if cfg.LogHandler == nil {
+		cfg.LogHandler = parent.LogHandler
+	}
+	if cfg.Hooks == nil {
+		cfg.Hooks = parent.Hooks
+	}
+	if cfg.Now == nil {
+		cfg.Now = parent.Now
+	}
+	cfg.Routes = nil
+
+	err := cfg.Init()
+	cfg.proxy = parent.proxy
+
+	return err
+}
+
+// Match returns true if the request matches all conditions of the route.
+func (r *Route) Match(req *http.Request) bool {
+	if r.Host != "" && !strings.EqualFold(r.Host, req.Host) {
+		host, _, err := net.SplitHostPort(req.Host)
+		if err != nil || !strings.EqualFold(r.Host, host) {
+			return false
+		}
+	}
+
+	return r.PathPrefix == "" || strings.HasPrefix(req.URL.Path, r.PathPrefix)
+}
+
+// MatchRoute returns the first route which matches the request or nil.
+func (cfg *Config) MatchRoute(req *http.Request) *Route {
+	for i := range cfg.Routes {
+		if cfg.Routes[i].Match(req) {
+			return &cfg.Routes[i]
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,53 @@
+package config
+
+import (
+	"net/http"
+
+	. "github.com/iostrovok/check"
+)
+
+func (s *testSuite) TestRoutes(c *C) {
+	cfg := &Config{
+		StorePath: "/tmp/store",
+		Version:   "main",
+		Routes: []Route{
+			{Host: "auth.local", Config: &Config{Host: "http://auth:8080"}},
+			{PathPrefix: "/es/", Config: &Config{Host: "http://es:9200", StorePath: "/tmp/es"}},
+			{PathPrefix: "/bad/"},
+		},
+	}
+	c.Assert(cfg.Init(), NotNil)
+
+	cfg.Routes = cfg.Routes[:2]
+	c.Assert(cfg.Init(), IsNil)
+
+	auth, es := cfg.Routes[0].Config, cfg.Routes[1].Config
+	c.Assert(auth.URL.Host, Equals, "auth:8080")
+	c.Assert(auth.StorePath, Equals, "/tmp/store")
+	c.Assert(auth.Version, Equals, "main")
+	c.Assert(es.StorePath, Equals, "/tmp/es")
+	c.Assert(es.LogHandler, Equals, cfg.LogHandler)
+
+	// routes have metrics of their proxy
+	c.Assert(cfg.ProxyName(), Equals, "0")
+	c.Assert(es.ProxyName(), Equals, "0")
+	cfg.Name, cfg.Port = "es", 19200
+	c.Assert(cfg.Init(), IsNil)
+	c.Assert(cfg.ProxyName(), Equals, "es")
+	c.Assert(es.ProxyName(), Equals, "es")
+	cfg.Name = ""
+	c.Assert(cfg.Init(), IsNil)
+	c.Assert(auth.ProxyName(), Equals, "19200")
+
+	req, err := http.NewRequest(http.MethodGet, "http://auth.local:8000/es/login", nil)
+	c.Assert(err, IsNil)
+	c.Assert(cfg.MatchRoute(req), Equals, &cfg.Routes[0])
+
+	req, err = http.NewRequest(http.MethodGet, "http://localhost:8000/es/_search", nil)
+	c.Assert(err, IsNil)
+	c.Assert(cfg.MatchRoute(req), Equals, &cfg.Routes[1])
+
+	req, err = http.NewRequest(http.MethodGet, "http://localhost:8000/other", nil)
+	c.Assert(err, IsNil)
+	c.Assert(cfg.MatchRoute(req), IsNil)
+}
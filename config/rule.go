@@ -0,0 +1,111 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Rule defines how long stored responses of matched requests are fresh.
+// Empty conditions match every request.
+type Rule struct {
+	// Method of the request, like "GET"
+	Method string `json:"method"`
+
+	// Host of the request, like "api.example.com"
+	Host string `json:"host"`
+
+	// PathPrefix is the prefix of the request path
+	PathPrefix string `json:"path_prefix"`
+
+	// PathPattern is the regular expression of the request path
+	PathPattern string `json:"path_pattern"`
+
+	// TTL is the age of the stored response after which it's loaded from upstream again.
+	// Zero means the stored response is replayed forever.
+	TTL time.Duration `json:"ttl"`
+
+	// If StaleIfError is true the stale response is replayed if upstream is not reachable
+	// or it answers with 5xx status.
+	StaleIfError bool `json:"stale_if_error"`
+
+	// If StaleWhileRevalidate is true the stale response is replayed at once
+	// and it's loaded from upstream in background.
+	StaleWhileRevalidate bool `json:"stale_while_revalidate"`
+
+	pathRe *regexp.Regexp
+}
+
+// init compiles the pattern, the bad pattern is reported by Validate and the rule matches nothing.
+func (r *Rule) init() {
+	if r.PathPattern != "" {
+		r.pathRe, _ = regexp.Compile(r.PathPattern)
+	}
+}
+
+// UnmarshalJSON reads TTL as the duration string like "1h30m".
+func (r *Rule) UnmarshalJSON(b []byte) error {
+	type plain Rule
+	aux := struct {
+		*plain
+		TTL string `json:"ttl"`
+	}{plain: (*plain)(r)}
+
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+
+	if aux.TTL != "" {
+		ttl, err := time.ParseDuration(aux.TTL)
+		if err != nil {
+			return fmt.Errorf("rule ttl: %w", err)
+		}
+		r.TTL = ttl
+	}
+
+	return nil
+}
+
+// Match returns true if the request matches all conditions of the rule.
+func (r *Rule) Match(req *http.Request) bool {
+	if r.Method != "" && !strings.EqualFold(r.Method, req.Method) {
+		return false
+	}
+
+	if r.Host != "" && !strings.EqualFold(r.Host, req.Host) {
+		return false
+	}
+
+	if r.PathPrefix != "" && !strings.HasPrefix(req.URL.Path, r.PathPrefix) {
+		return false
+	}
+
+	if r.PathPattern != "" && (r.pathRe == nil || !r.pathRe.MatchString(req.URL.Path)) {
+		return false
+	}
+
+	return true
+}
+
+// Expired returns true if the response recorded at the time is stale now.
+// The response without the time of recording is stale for any TTL.
+func (r *Rule) Expired(recordedAt, now time.Time) bool {
+	if r == nil || r.TTL <= 0 {
+		return false
+	}
+
+	return recordedAt.IsZero() || now.Sub(recordedAt) > r.TTL
+}
+
+// MatchRule returns the first rule which matches the request or nil.
+func (cfg *Config) MatchRule(req *http.Request) *Rule {
+	for i := range cfg.Rules {
+		if cfg.Rules[i].Match(req) {
+			return &cfg.Rules[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package config
+
+import (
+	"net/http"
+	"time"
+
+	. "github.com/iostrovok/check"
+)
+
+func (s *testSuite) TestRules(c *C) {
+	cfg := &Config{Rules: []Rule{
+		{Method: "post", PathPrefix: "/api/", TTL: time.Minute},
+		{PathPattern: `^/users/\d+$`, Host: "example.com", TTL: time.Hour},
+		{PathPattern: `(`},
+	}}
+	c.Assert(cfg.Init(), NotNil)
+
+	cfg.Rules = cfg.Rules[:2]
+	c.Assert(cfg.Init(), IsNil)
+
+	req, err := http.NewRequest(http.MethodPost, "http://example.com/api/search", nil)
+	c.Assert(err, IsNil)
+	c.Assert(cfg.MatchRule(req), Equals, &cfg.Rules[0])
+
+	req, err = http.NewRequest(http.MethodGet, "http://example.com/api/search", nil)
+	c.Assert(err, IsNil)
+	c.Assert(cfg.MatchRule(req), IsNil)
+
+	req, err = http.NewRequest(http.MethodGet, "http://example.com/users/12", nil)
+	c.Assert(err, IsNil)
+	c.Assert(cfg.MatchRule(req), Equals, &cfg.Rules[1])
+
+	req, err = http.NewRequest(http.MethodGet, "http://other.com/users/12", nil)
+	c.Assert(err, IsNil)
+	c.Assert(cfg.MatchRule(req), IsNil)
+}
+
+func (s *testSuite) TestExpired(c *C) {
+	now := time.Now()
+
+	var rule *Rule
+	c.Assert(rule.Expired(time.Time{}, now), Equals, false)
+
+	rule = &Rule{}
+	c.Assert(rule.Expired(time.Time{}, now), Equals, false)
+
+	rule.TTL = time.Minute
+	c.Assert(rule.Expired(time.Time{}, now), Equals, true)
+	c.Assert(rule.Expired(now.Add(-time.Second), now), Equals, false)
+	c.Assert(rule.Expired(now.Add(-time.Hour), now), Equals, true)
+}
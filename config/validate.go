@@ -0,0 +1,227 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/iostrovok/cacheproxy/cerrors"
+	"github.com/iostrovok/cacheproxy/plugins"
+	"github.com/iostrovok/cacheproxy/store"
+)
+
+// Validate returns cerrors.ConfigErrors with every misconfiguration of the proxy and of its routes or nil.
+// It may be called before or after Init.
+func (cfg *Config) Validate() error {
+	if errs := cfg.validate(true); len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Setup prepares the config of the server: Init sets defaults, Validate checks settings
+// and keepers of the proxy and of its routes are made by KeeperConfig (the sqlite keeper by default).
+// Keepers get the version of data and the structured logger. handler.Start calls it.
+func (cfg *Config) Setup(ctx context.Context) error {
+	if err := cfg.Init(); err != nil {
+		return err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	if err := cfg.initKeeper(ctx, nil); err != nil {
+		return err
+	}
+
+	for i := range cfg.Routes {
+		if err := cfg.Routes[i].Config.initKeeper(ctx, cfg); err != nil {
+			return fmt.Errorf("routes[%d]: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// validate checks the proxy, settings of the server are not checked for routes.
+func (cfg *Config) validate(server bool) cerrors.ConfigErrors {
+	errs := cfg.checkValues()
+
+	if cfg.Host == "" {
+		if len(cfg.Routes) == 0 {
+			errs = append(errs, &cerrors.ConfigError{Setting: "host", Err: cerrors.EmptyHost})
+		}
+	} else if _, err := upstreamURL(cfg.Host, cfg.Scheme); err != nil {
+		errs = append(errs, &cerrors.ConfigError{Setting: "host", Err: err})
+	}
+
+	if server {
+		switch cfg.Scheme {
+		case "", "http":
+		case "https":
+			errs = append(errs, checkTLSFile("pem_path", cfg.PemPath)...)
+			errs = append(errs, checkTLSFile("key_path", cfg.KeyPath)...)
+		default:
+			errs = append(errs, &cerrors.ConfigError{Setting: "scheme", Err: fmt.Errorf("%w: %q", cerrors.BadScheme, cfg.Scheme)})
+		}
+
+		if cfg.Port < 0 || cfg.Port > 65535 {
+			errs = append(errs, &cerrors.ConfigError{Setting: "port", Err: fmt.Errorf("%w: %d", cerrors.BadPort, cfg.Port)})
+		}
+
+		if cfg.AdminPort < 0 || cfg.AdminPort > 65535 {
+			errs = append(errs, &cerrors.ConfigError{Setting: "admin_port", Err: fmt.Errorf("%w: %d", cerrors.BadPort, cfg.AdminPort)})
+		} else if cfg.AdminPort != 0 && cfg.AdminPort == cfg.Port {
+			errs = append(errs, &cerrors.ConfigError{Setting: "admin_port", Err: fmt.Errorf("%w: %d is the port of the proxy", cerrors.BadPort, cfg.AdminPort)})
+		}
+	}
+
+	if cfg.KeeperConfig != nil {
+		errs = append(errs, cfg.KeeperConfig.check("keeper.")...)
+	}
+
+	for i := range cfg.Routes {
+		prefix := fmt.Sprintf("routes[%d].config.", i)
+		route := &cfg.Routes[i]
+		if route.Config == nil {
+			errs = append(errs, prefixErrors(prefix, fmt.Errorf("%w: route %q%s has no config", cerrors.BadValue, route.Host, route.PathPrefix))...)
+			continue
+		}
+		errs = append(errs, prefixErrors(prefix, route.Config.validate(false))...)
+	}
+
+	return errs
+}
+
+// checkValues checks settings which don't depend on the environment, they're checked by Init too.
+func (cfg *Config) checkValues() cerrors.ConfigErrors {
+	var errs cerrors.ConfigErrors
+
+	if _, err := ParseMode(string(cfg.Mode)); err != nil {
+		errs = append(errs, &cerrors.ConfigError{Setting: "mode", Err: err})
+	}
+
+	for prefix, name := range cfg.Compression {
+		if _, err := store.ParseCodec(name); err != nil {
+			errs = append(errs, &cerrors.ConfigError{Setting: fmt.Sprintf("compression[%q]", prefix), Err: fmt.Errorf("%w: %w", cerrors.BadValue, err)})
+		}
+	}
+
+	switch cfg.StreamTiming {
+	case StreamTimingNone, StreamTimingOriginal:
+	case StreamTimingScaled:
+		if cfg.StreamTimingScale <= 0 {
+			errs = append(errs, &cerrors.ConfigError{Setting: "stream_timing_scale", Err: fmt.Errorf("%w: %v is not positive", cerrors.BadValue, cfg.StreamTimingScale)})
+		}
+	default:
+		errs = append(errs, &cerrors.ConfigError{Setting: "stream_timing", Err: fmt.Errorf("%w: %q is not original or scaled", cerrors.BadValue, cfg.StreamTiming)})
+	}
+
+	for i := range cfg.Rules {
+		if pattern := cfg.Rules[i].PathPattern; pattern != "" {
+			if _, err := regexp.Compile(pattern); err != nil {
+				errs = append(errs, &cerrors.ConfigError{Setting: fmt.Sprintf("rules[%d].path_pattern", i), Err: fmt.Errorf("%w: %w", cerrors.BadValue, err)})
+			}
+		}
+	}
+
+	return errs
+}
+
+func checkTLSFile(setting, path string) cerrors.ConfigErrors {
+	if path == "" {
+		return cerrors.ConfigErrors{{Setting: setting, Err: fmt.Errorf("%w: it's empty for https", cerrors.MissingTLSFile)}}
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		return cerrors.ConfigErrors{{Setting: setting, Err: fmt.Errorf("%w: %w", cerrors.MissingTLSFile, err)}}
+	}
+
+	return nil
+}
+
+// upstreamURL returns the URL of upstream, the scheme is added to the host without it.
+func upstreamURL(host, scheme string) (*url.URL, error) {
+	if host == "" {
+		return &url.URL{}, nil
+	}
+
+	if !strings.Contains(host, "://") {
+		if scheme == "" {
+			scheme = "http"
+		}
+		host = scheme + "://" + host
+	}
+
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", cerrors.BadHost, err)
+	}
+
+	switch u.Scheme {
+	case "http", "https", "ws", "wss":
+	default:
+		return nil, fmt.Errorf("%w: %q has no http, https, ws or wss scheme", cerrors.BadHost, host)
+	}
+
+	if u.Host == "" {
+		return nil, fmt.Errorf("%w: %q has no host name", cerrors.BadHost, host)
+	}
+
+	return u, nil
+}
+
+// prefixErrors adds the prefix to names of settings, other errors are the misconfiguration of the prefix.
+func prefixErrors(prefix string, err error) cerrors.ConfigErrors {
+	var list cerrors.ConfigErrors
+	if !errors.As(err, &list) {
+		list = cerrors.ConfigErrors{{Setting: strings.TrimSuffix(prefix, "."), Err: err}}
+		return list
+	}
+
+	out := make(cerrors.ConfigErrors, 0, len(list))
+	for _, e := range list {
+		out = append(out, &cerrors.ConfigError{Setting: prefix + e.Setting, Err: e.Err})
+	}
+	return out
+}
+
+// initKeeper makes the keeper if it's necessary, routes without own keepers use the keeper of the parent.
+func (cfg *Config) initKeeper(ctx context.Context, parent *Config) (err error) {
+	if cfg.Keeper == nil && cfg.KeeperConfig == nil && parent != nil {
+		cfg.Keeper = parent.Keeper
+		return nil
+	}
+
+	// the keeper of the user keeps its own versions if they're not set explicitly
+	own := cfg.Keeper == nil
+	if own {
+		if cfg.Keeper, err = NewKeeper(ctx, cfg, cfg.KeeperConfig); err != nil {
+			return err
+		}
+	}
+
+	// the keeper writes to the same structured log
+	if keeper, ok := cfg.Keeper.(plugins.ISlog); ok {
+		keeper.SetSlog(cfg.Log())
+	}
+
+	// the keeper may not support versions
+	if own || !cfg.versionResolved {
+		err = cfg.Keeper.SetVersion(cfg.Version)
+		if err != nil && !errors.Is(err, cerrors.PluginHasNoVersion) {
+			return err
+		}
+	}
+
+	if keeper, ok := cfg.Keeper.(plugins.IFallbackVersions); ok && (own || len(cfg.FallbackVersions) > 0) {
+		keeper.SetFallbackVersions(cfg.FallbackVersions...)
+	}
+
+	return nil
+}
@@ -0,0 +1,125 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+
+	. "github.com/iostrovok/check"
+
+	"github.com/iostrovok/cacheproxy/cerrors"
+	"github.com/iostrovok/cacheproxy/plugins"
+)
+
+func (s *testSuite) TestValidate(c *C) {
+	cfg := &Config{}
+	err := cfg.Validate()
+	c.Assert(errors.Is(err, cerrors.EmptyHost), Equals, true)
+
+	var list cerrors.ConfigErrors
+	c.Assert(errors.As(err, &list), Equals, true)
+	c.Assert(list, HasLen, 1)
+	c.Assert(list[0].Setting, Equals, "host")
+
+	dir := c.MkDir()
+	pem := filepath.Join(dir, "cert.pem")
+	c.Assert(os.WriteFile(pem, []byte("-"), 0o600), IsNil)
+
+	cfg = &Config{
+		Host:         "localhost:9200",
+		Scheme:       "https",
+		PemPath:      pem,
+		KeyPath:      filepath.Join(dir, "key.pem"),
+		Port:         70000,
+		AdminPort:    19200,
+		StreamTiming: StreamTimingScaled,
+		Rules:        []Rule{{PathPattern: "("}},
+		Routes:       []Route{{PathPrefix: "/es/", Config: &Config{Host: "ftp://es"}}},
+	}
+	err = cfg.Validate()
+	c.Assert(errors.As(err, &list), Equals, true)
+
+	settings := map[string]error{}
+	for _, e := range list {
+		settings[e.Setting] = e
+	}
+	c.Assert(settings, HasLen, 5, Commentf("%v", err))
+	c.Assert(errors.Is(settings["key_path"], cerrors.MissingTLSFile), Equals, true)
+	c.Assert(errors.Is(settings["port"], cerrors.BadPort), Equals, true)
+	c.Assert(errors.Is(settings["stream_timing_scale"], cerrors.BadValue), Equals, true)
+	c.Assert(errors.Is(settings["rules[0].path_pattern"], cerrors.BadValue), Equals, true)
+	c.Assert(errors.Is(settings["routes[0].config.host"], cerrors.BadHost), Equals, true)
+
+	cfg = &Config{Host: "http://localhost:9200", Port: 19200, AdminPort: 19200, Scheme: "ftp"}
+	err = cfg.Validate()
+	c.Assert(errors.Is(err, cerrors.BadScheme), Equals, true)
+	c.Assert(errors.Is(err, cerrors.BadPort), Equals, true)
+
+	c.Assert((&Config{Host: "http://localhost:9200", Port: 19200}).Validate(), IsNil)
+}
+
+func (s *testSuite) TestInitDefaults(c *C) {
+	cfg := &Config{Host: "localhost:9200"}
+	c.Assert(cfg.Init(), IsNil)
+
+	dir, err := os.Getwd()
+	c.Assert(err, IsNil)
+	c.Assert(cfg.StorePath, Equals, dir)
+	c.Assert(cfg.Scheme, Equals, "http")
+	c.Assert(cfg.URL.String(), Equals, "http://localhost:9200")
+	c.Assert(cfg.Logger, NotNil)
+
+	cfg = &Config{Host: "es.local", Scheme: "https"}
+	c.Assert(cfg.Init(), IsNil)
+	c.Assert(cfg.URL.String(), Equals, "https://es.local")
+}
+
+type versionKeeper struct {
+	plugins.IPlugin
+	version string
+}
+
+func (k *versionKeeper) SetVersion(version string) error {
+	k.version = version
+	return nil
+}
+
+func (s *testSuite) TestSetup(c *C) {
+	RegisterKeeper("test-version", func(context.Context, *Config, *KeeperConfig) (plugins.IPlugin, error) {
+		return &versionKeeper{}, nil
+	})
+
+	shared := &Config{Host: "http://shared"}
+	own := &Config{Host: "http://own", Version: "feature", KeeperConfig: &KeeperConfig{Type: "test-version"}}
+	cfg := &Config{
+		Host:         "http://localhost:9200",
+		Version:      "main",
+		KeeperConfig: &KeeperConfig{Type: "test-version"},
+		Routes:       []Route{{PathPrefix: "/shared/", Config: shared}, {PathPrefix: "/own/", Config: own}},
+	}
+	c.Assert(cfg.Setup(context.Background()), IsNil)
+
+	c.Assert(cfg.Keeper.(*versionKeeper).version, Equals, "main")
+	c.Assert(shared.Keeper, Equals, cfg.Keeper)
+	c.Assert(own.Keeper, Not(Equals), cfg.Keeper)
+	c.Assert(own.Keeper.(*versionKeeper).version, Equals, "feature")
+
+	// the keeper of the user keeps its version if the version is resolved
+	keeper := &versionKeeper{version: "pinned"}
+	cfg = &Config{Host: "http://localhost:9200", Keeper: keeper}
+	c.Assert(cfg.Setup(context.Background()), IsNil)
+	c.Assert(cfg.Version, Not(Equals), "")
+	c.Assert(keeper.version, Equals, "pinned")
+
+	cfg = &Config{Host: "http://localhost:9200", Version: "main", Keeper: keeper}
+	c.Assert(cfg.Setup(context.Background()), IsNil)
+	c.Assert(keeper.version, Equals, "main")
+
+	// the keeper is not made for the bad config
+	cfg = &Config{Scheme: "https", KeeperConfig: &KeeperConfig{Type: "test-version"}}
+	err := cfg.Setup(context.Background())
+	c.Assert(errors.Is(err, cerrors.EmptyHost), Equals, true)
+	c.Assert(errors.Is(err, cerrors.MissingTLSFile), Equals, true)
+	c.Assert(cfg.Keeper, IsNil)
+}
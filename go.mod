@@ -1,16 +1,21 @@
 module github.com/iostrovok/cacheproxy
 
-go 1.17
+go 1.22
 
 require (
+	github.com/BurntSushi/toml v1.6.0
 	github.com/iostrovok/check v0.0.14
+	github.com/klauspost/compress v1.18.0
 	github.com/lib/pq v1.10.6
 	github.com/mattn/go-sqlite3 v1.14.15
 	github.com/pkg/errors v0.9.1
+	golang.org/x/net v0.35.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/iostrovok/go-convert v0.1.9 // indirect
 	github.com/kr/text v0.1.0 // indirect
 	github.com/niemeyer/pretty v0.0.0-20200227124842-a10e7caefd8e // indirect
+	golang.org/x/text v0.22.0 // indirect
 )
@@ -0,0 +1,263 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/iostrovok/cacheproxy/cerrors"
+	"github.com/iostrovok/cacheproxy/config"
+	"github.com/iostrovok/cacheproxy/plugins"
+	"github.com/iostrovok/cacheproxy/store"
+)
+
+/*
+	The admin API of the running proxy, all responses except /metrics are JSON.
+
+		GET    /interactions?limit=N   recent interactions, the newest one is the first
+		GET    /mode                   the current mode
+		PUT    /mode                   switches the mode: {"mode": "auto|record|replay|passthrough"}
+		DELETE /keys?file=F&key=K...   deletes records of the current version and parts of their bodies
+		POST   /clear                  deletes all records of the current version
+		GET    /unused                 records of the current version which are not used since the start
+		GET    /metrics                metrics in the Prometheus text format, see Metrics
+
+	The keeper should implement plugins.IDeleter, plugins.IVersionManager and plugins.IExporter
+	for /keys, /clear and /unused, 501 Not Implemented is returned otherwise.
+	/keys and /clear change keepers of the proxy and of all its routes.
+*/
+
+// Entry is the stored record.
+type Entry struct {
+	File string `json:"file"`
+	Key  string `json:"key"`
+}
+
+func adminHandler(cfg *config.Config, s *session) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /interactions", func(w http.ResponseWriter, r *http.Request) {
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		writeJSON(w, http.StatusOK, map[string]any{"interactions": s.recent(limit)})
+	})
+
+	mux.HandleFunc("GET /mode", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"mode": modeName(s.Mode())})
+	})
+
+	mux.HandleFunc("PUT /mode", func(w http.ResponseWriter, r *http.Request) {
+		var in struct {
+			Mode string `json:"mode"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		mode, err := config.ParseMode(in.Mode)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		s.SetMode(mode)
+		cfg.Log().Info("mode is switched", "mode", modeName(mode))
+		writeJSON(w, http.StatusOK, map[string]string{"mode": modeName(mode)})
+	})
+
+	mux.HandleFunc("DELETE /keys", func(w http.ResponseWriter, r *http.Request) {
+		file, keys := r.URL.Query().Get("file"), r.URL.Query()["key"]
+		if len(keys) == 0 {
+			writeError(w, http.StatusBadRequest, errors.New("no keys"))
+			return
+		}
+
+		// the record may be stored by the keeper of any route
+		supported, total := false, int64(0)
+		for _, c := range keeperConfigs(cfg) {
+			deleted, err := deleteItems(c.Keeper, file, keys)
+			if errors.Is(err, cerrors.NotSupported) {
+				continue
+			}
+			if err != nil {
+				writeError(w, keeperStatus(err), err)
+				return
+			}
+			supported, total = true, total+deleted
+		}
+
+		if !supported {
+			writeError(w, http.StatusNotImplemented, errors.New("keeper doesn't support deleting"))
+			return
+		}
+
+		for _, key := range keys {
+			s.forget(file, key)
+		}
+		writeJSON(w, http.StatusOK, map[string]int64{"deleted": total})
+	})
+
+	mux.HandleFunc("POST /clear", func(w http.ResponseWriter, r *http.Request) {
+		supported, total := false, int64(0)
+		for _, c := range keeperConfigs(cfg) {
+			keeper, ok := c.Keeper.(plugins.IVersionManager)
+			if !ok {
+				continue
+			}
+
+			// the keeper may not scope data by the version of the proxy
+			version := c.Version
+			if v, ok := c.Keeper.(plugins.IVersion); ok && v.Version() != "" {
+				version = v.Version()
+			}
+
+			// parts of bodies have the version of their records, so they're deleted too
+			deleted, err := keeper.DeleteVersions(version)
+			if errors.Is(err, cerrors.NotSupported) {
+				continue
+			}
+			if err != nil {
+				writeError(w, keeperStatus(err), err)
+				return
+			}
+			supported, total = true, total+deleted
+		}
+
+		if !supported {
+			writeError(w, http.StatusNotImplemented, errors.New("keeper doesn't support deleting versions"))
+			return
+		}
+
+		s.used.Range(func(key, _ any) bool {
+			s.used.Delete(key)
+			return true
+		})
+		writeJSON(w, http.StatusOK, map[string]int64{"deleted": total})
+	})
+
+	mux.HandleFunc("GET /unused", func(w http.ResponseWriter, r *http.Request) {
+		keeper, ok := cfg.Keeper.(plugins.IExporter)
+		if !ok {
+			writeError(w, http.StatusNotImplemented, errors.New("keeper doesn't support exporting"))
+			return
+		}
+
+		out := make([]Entry, 0)
+		err := keeper.Export(func(file, key string, _ []byte) error {
+			// parts of bodies are used by their records
+			if !store.IsBodyKey(key) && !s.isUsed(file, key) {
+				out = append(out, Entry{File: file, Key: key})
+			}
+			return nil
+		})
+		if err != nil {
+			writeError(w, keeperStatus(err), err)
+			return
+		}
+
+		sort.Slice(out, func(i, j int) bool {
+			if out[i].File != out[j].File {
+				return out[i].File < out[j].File
+			}
+			return out[i].Key < out[j].Key
+		})
+		writeJSON(w, http.StatusOK, map[string]any{"unused": out})
+	})
+
+	mux.Handle("GET /metrics", registry)
+
+	return mux
+}
+
+// deleteItems deletes items of the file with parts of their bodies. Parts which are used by other items
+// of the file are kept, all parts are kept if the keeper can't list items. It returns the number of deleted records.
+func deleteItems(keeper plugins.IPlugin, file string, keys []string) (int64, error) {
+	deleter, ok := keeper.(plugins.IDeleter)
+	if !ok {
+		return 0, cerrors.NotSupported
+	}
+
+	parts := map[string]bool{}
+	for _, key := range keys {
+		data, err := keeper.Read(file, key)
+		if err != nil {
+			return 0, err
+		}
+		if len(data) == 0 {
+			continue
+		}
+
+		// the broken record is deleted anyway
+		if item, err := store.FromZip(data); err == nil {
+			for _, part := range item.BodyChunks {
+				parts[part] = true
+			}
+		}
+	}
+
+	if len(parts) > 0 {
+		deleted := map[string]bool{}
+		for _, key := range keys {
+			deleted[key] = true
+		}
+
+		exporter, ok := keeper.(plugins.IExporter)
+		if ok {
+			err := exporter.Export(func(f, key string, data []byte) error {
+				if f != file || deleted[key] || store.IsBodyKey(key) {
+					return nil
+				}
+				if item, err := store.FromZip(data); err == nil {
+					for _, part := range item.BodyChunks {
+						delete(parts, part)
+					}
+				}
+				return nil
+			})
+			if errors.Is(err, cerrors.NotSupported) {
+				ok = false
+			} else if err != nil {
+				return 0, err
+			}
+		}
+
+		if !ok {
+			parts = nil
+		}
+	}
+
+	all := append([]string{}, keys...)
+	for part := range parts {
+		all = append(all, part)
+	}
+	sort.Strings(all[len(keys):])
+
+	return deleter.Delete(file, all...)
+}
+
+func modeName(mode config.Mode) string {
+	if mode == config.ModeAuto {
+		return "auto"
+	}
+	return string(mode)
+}
+
+// keeperStatus returns 501 Not Implemented if the backend of the wrapping keeper doesn't support the request.
+func keeperStatus(err error) int {
+	if errors.Is(err, cerrors.NotSupported) {
+		return http.StatusNotImplemented
+	}
+	return http.StatusInternalServerError
+}
+
+func writeJSON(w http.ResponseWriter, status int, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(data)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,414 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	. "github.com/iostrovok/check"
+
+	"github.com/iostrovok/cacheproxy/config"
+	"github.com/iostrovok/cacheproxy/plugins"
+	_ "github.com/iostrovok/cacheproxy/plugins/crypt"
+	_ "github.com/iostrovok/cacheproxy/plugins/pg"
+	"github.com/iostrovok/cacheproxy/store"
+)
+
+func (s *testSuite) Test_SessionHistory(c *C) {
+	ses := newSession(&config.Config{AdminHistory: 3, Mode: config.ModeReplay})
+	c.Assert(ses.Mode(), Equals, config.ModeReplay)
+	c.Assert(ses.recent(0), HasLen, 0)
+
+	for i := 1; i <= 5; i++ {
+		ses.add(Interaction{Status: i})
+	}
+
+	statuses := func(list []Interaction) []int {
+		out := make([]int, 0, len(list))
+		for _, it := range list {
+			out = append(out, it.Status)
+		}
+		return out
+	}
+
+	c.Assert(statuses(ses.recent(0)), DeepEquals, []int{5, 4, 3})
+	c.Assert(statuses(ses.recent(2)), DeepEquals, []int{5, 4})
+
+	ses.use("file", "key")
+	c.Assert(ses.isUsed("file", "key"), Equals, true)
+	ses.forget("file", "key")
+	c.Assert(ses.isUsed("file", "key"), Equals, false)
+}
+
+func (s *testSuite) TestAdmin(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var counter int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s-%d", r.URL.Path, atomic.AddInt64(&counter, 1))
+	}))
+	defer ts.Close()
+
+	dir, err := os.MkdirTemp(os.TempDir(), "admin")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	cfg := &config.Config{
+		Host:        ts.URL,
+		Scheme:      "http",
+		Port:        19214,
+		StorePath:   dir,
+		FileName:    "admin",
+		AdminPort:   19215,
+		AdminPrefix: "/_cacheproxy",
+	}
+	c.Assert(Start(ctx, cfg), IsNil)
+
+	call := func(method, url string, in any, out any) int {
+		var body io.Reader
+		if in != nil {
+			b, err := json.Marshal(in)
+			c.Assert(err, IsNil)
+			body = bytes.NewReader(b)
+		}
+
+		req, err := http.NewRequest(method, url, body)
+		c.Assert(err, IsNil)
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+
+		if out != nil {
+			c.Assert(json.NewDecoder(resp.Body).Decode(out), IsNil)
+		} else {
+			_, err = io.Copy(io.Discard, resp.Body)
+			c.Assert(err, IsNil)
+		}
+		return resp.StatusCode
+	}
+
+	_, body := getURL(c, "http://127.0.0.1:19214/a")
+	c.Assert(body, Equals, "/a-1")
+	_, body = getURL(c, "http://127.0.0.1:19214/a")
+	c.Assert(body, Equals, "/a-1")
+	_, body = getURL(c, "http://127.0.0.1:19214/b")
+	c.Assert(body, Equals, "/b-2")
+
+	var interactions struct {
+		Interactions []Interaction `json:"interactions"`
+	}
+	c.Assert(call(http.MethodGet, "http://127.0.0.1:19215/interactions?limit=2", nil, &interactions), Equals, http.StatusOK)
+	c.Assert(interactions.Interactions, HasLen, 2)
+	c.Assert(interactions.Interactions[0].Result, Equals, ResultMiss)
+	c.Assert(interactions.Interactions[0].Status, Equals, http.StatusOK)
+	c.Assert(interactions.Interactions[1].Result, Equals, ResultHit)
+	keyA := interactions.Interactions[1].Key
+
+	// the prefix on the proxy port is the same API
+	var mode map[string]string
+	c.Assert(call(http.MethodGet, "http://127.0.0.1:19214/_cacheproxy/mode", nil, &mode), Equals, http.StatusOK)
+	c.Assert(mode, DeepEquals, map[string]string{"mode": "auto"})
+
+	status, body := getURL(c, "http://127.0.0.1:19215/metrics")
+	c.Assert(status, Equals, http.StatusOK)
+	c.Assert(strings.Contains(body, `cacheproxy_requests_total{proxy="19214",result="hit"} 1`), Equals, true)
+	c.Assert(strings.Contains(body, `cacheproxy_upstream_duration_seconds_count{proxy="19214",status="200"}`), Equals, true)
+	c.Assert(strings.Contains(body, `cacheproxy_keeper_duration_seconds_count{proxy="19214",op="save"}`), Equals, true)
+	c.Assert(strings.Contains(body, `file=`), Equals, false)
+
+	// the new proxy uses /a only, so /b is unused
+	cancel()
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	next := *cfg
+	next.Port, next.AdminPort = 19216, 19217
+	c.Assert(Start(ctx, &next), IsNil)
+
+	_, body = getURL(c, "http://127.0.0.1:19216/a")
+	c.Assert(body, Equals, "/a-1")
+
+	var unused struct {
+		Unused []Entry `json:"unused"`
+	}
+	c.Assert(call(http.MethodGet, "http://127.0.0.1:19217/unused", nil, &unused), Equals, http.StatusOK)
+	c.Assert(unused.Unused, HasLen, 1)
+	c.Assert(unused.Unused[0].File, Equals, "admin")
+
+	// replay mode fails for not recorded requests
+	c.Assert(call(http.MethodPut, "http://127.0.0.1:19217/mode", map[string]string{"mode": "replay"}, &mode), Equals, http.StatusOK)
+	c.Assert(mode, DeepEquals, map[string]string{"mode": "replay"})
+	status, _ = getURL(c, "http://127.0.0.1:19216/c")
+	c.Assert(status, Equals, http.StatusNotFound)
+
+	c.Assert(call(http.MethodPut, "http://127.0.0.1:19217/mode", map[string]string{"mode": "bad"}, nil), Equals, http.StatusBadRequest)
+
+	// passthrough mode neither reads nor stores
+	c.Assert(call(http.MethodPut, "http://127.0.0.1:19217/mode", map[string]string{"mode": "passthrough"}, nil), Equals, http.StatusOK)
+	_, body = getURL(c, "http://127.0.0.1:19216/a")
+	c.Assert(body, Equals, "/a-3")
+
+	// the deleted record is loaded again
+	c.Assert(call(http.MethodPut, "http://127.0.0.1:19217/mode", map[string]string{"mode": "auto"}, nil), Equals, http.StatusOK)
+	var deleted map[string]int64
+	c.Assert(call(http.MethodDelete, "http://127.0.0.1:19217/keys?file=admin&key="+keyA, nil, &deleted), Equals, http.StatusOK)
+	c.Assert(deleted, DeepEquals, map[string]int64{"deleted": 1})
+	_, body = getURL(c, "http://127.0.0.1:19216/a")
+	c.Assert(body, Equals, "/a-4")
+
+	c.Assert(call(http.MethodPost, "http://127.0.0.1:19217/clear", nil, &deleted), Equals, http.StatusOK)
+	c.Assert(deleted, DeepEquals, map[string]int64{"deleted": 2})
+	_, body = getURL(c, "http://127.0.0.1:19216/b")
+	c.Assert(body, Equals, "/b-5")
+}
+
+// TestAdminPG runs the admin API over the Postgres keeper which keeps MD5 of file names,
+// set CACHEPROXY_TEST_PG_DSN to run it.
+func (s *testSuite) TestAdminPG(c *C) {
+	dsn := os.Getenv("CACHEPROXY_TEST_PG_DSN")
+	if dsn == "" {
+		c.Skip("CACHEPROXY_TEST_PG_DSN is not set")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var counter int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s-%d", r.URL.Path, atomic.AddInt64(&counter, 1))
+	}))
+	defer ts.Close()
+
+	cfg := &config.Config{
+		Host:         ts.URL,
+		Port:         19229,
+		AdminPort:    19230,
+		FileName:     "admin",
+		Version:      fmt.Sprintf("admin-test-%d", time.Now().UnixNano()),
+		KeeperConfig: &config.KeeperConfig{Type: "pg", DSN: dsn, Table: "public.cacheproxy_admin_test", AutoMigrate: true},
+	}
+	c.Assert(Start(ctx, cfg), IsNil)
+
+	call := func(method, url string, out any) int {
+		req, err := http.NewRequest(method, url, nil)
+		c.Assert(err, IsNil)
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+		c.Assert(json.NewDecoder(resp.Body).Decode(out), IsNil)
+		return resp.StatusCode
+	}
+
+	_, body := getURL(c, "http://127.0.0.1:19229/a")
+	c.Assert(body, Equals, "/a-1")
+	_, body = getURL(c, "http://127.0.0.1:19229/b")
+	c.Assert(body, Equals, "/b-2")
+
+	var interactions struct {
+		Interactions []Interaction `json:"interactions"`
+	}
+	c.Assert(call(http.MethodGet, "http://127.0.0.1:19230/interactions", &interactions), Equals, http.StatusOK)
+	c.Assert(interactions.Interactions, HasLen, 2)
+	keyA := interactions.Interactions[1].Key
+
+	// the recorded key is deleted by the original file name
+	var deleted map[string]int64
+	c.Assert(call(http.MethodDelete, "http://127.0.0.1:19230/keys?file=admin&key="+keyA, &deleted), Equals, http.StatusOK)
+	c.Assert(deleted, DeepEquals, map[string]int64{"deleted": 1})
+	_, body = getURL(c, "http://127.0.0.1:19229/a")
+	c.Assert(body, Equals, "/a-3")
+
+	// the new proxy uses /a only, /b is unused and it's reported by the original file name
+	cancel()
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	next := *cfg
+	next.Port, next.AdminPort, next.Keeper = 19231, 19232, nil
+	c.Assert(Start(ctx, &next), IsNil)
+
+	_, body = getURL(c, "http://127.0.0.1:19231/a")
+	c.Assert(body, Equals, "/a-3")
+
+	var unused struct {
+		Unused []Entry `json:"unused"`
+	}
+	c.Assert(call(http.MethodGet, "http://127.0.0.1:19232/unused", &unused), Equals, http.StatusOK)
+	c.Assert(unused.Unused, HasLen, 1)
+	c.Assert(unused.Unused[0].File, Equals, "admin")
+
+	c.Assert(call(http.MethodPost, "http://127.0.0.1:19232/clear", &deleted), Equals, http.StatusOK)
+	c.Assert(deleted, DeepEquals, map[string]int64{"deleted": 2})
+}
+
+func (s *testSuite) TestAdminCrypt(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, strings.Repeat(r.URL.Path, 50))
+	}))
+	defer ts.Close()
+
+	os.Setenv("CACHEPROXY_TEST_ADMIN_KEYS", "k1:"+base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32)))
+	defer os.Unsetenv("CACHEPROXY_TEST_ADMIN_KEYS")
+
+	cfg := &config.Config{
+		Host:              ts.URL,
+		Port:              19234,
+		AdminPrefix:       "/_cacheproxy",
+		StorePath:         c.MkDir(),
+		FileName:          "admin",
+		MaxInlineBodySize: 10,
+		KeeperConfig: &config.KeeperConfig{Type: "crypt", KeyEnv: "CACHEPROXY_TEST_ADMIN_KEYS",
+			Backend: &config.KeeperConfig{Type: "sqlite"}},
+	}
+	c.Assert(Start(ctx, cfg), IsNil)
+
+	_, body := getURL(c, "http://127.0.0.1:19234/a")
+	c.Assert(body, Equals, strings.Repeat("/a", 50))
+	_, body = getURL(c, "http://127.0.0.1:19234/a")
+	c.Assert(body, Equals, strings.Repeat("/a", 50))
+
+	// the part of the body is stored by the keyed hash
+	keys := []string{}
+	c.Assert(cfg.Keeper.(plugins.IExporter).Export(func(_, key string, _ []byte) error {
+		keys = append(keys, key)
+		return nil
+	}), IsNil)
+	c.Assert(keys, HasLen, 2)
+	sort.Strings(keys)
+	c.Assert(strings.HasPrefix(keys[1], "body-hmac-sha256-"), Equals, true, Commentf("%v", keys))
+	c.Assert(keys[1], Not(Equals), store.BodyKey([]byte(strings.Repeat("/a", 50))))
+
+	// versions of the encrypted keeper are managed by its backend
+	resp, err := http.Post("http://127.0.0.1:19234/_cacheproxy/clear", "application/json", nil)
+	c.Assert(err, IsNil)
+	var deleted map[string]int64
+	c.Assert(json.NewDecoder(resp.Body).Decode(&deleted), IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	c.Assert(deleted, DeepEquals, map[string]int64{"deleted": 2})
+}
+
+func (s *testSuite) TestAdminParts(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// /a and /b have the same body, so it's stored once
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/c") {
+			fmt.Fprint(w, strings.Repeat("c", 50))
+			return
+		}
+		fmt.Fprint(w, strings.Repeat("x", 50))
+	}))
+	defer ts.Close()
+
+	cfg := &config.Config{
+		Host:              ts.URL,
+		Port:              19235,
+		AdminPort:         19236,
+		StorePath:         c.MkDir(),
+		FileName:          "admin",
+		MaxInlineBodySize: 10,
+		Routes: []config.Route{{
+			PathPrefix:  "/r/",
+			StripPrefix: true,
+			Config: &config.Config{
+				Host:              ts.URL,
+				StorePath:         c.MkDir(),
+				FileName:          "admin",
+				MaxInlineBodySize: 10,
+				KeeperConfig:      &config.KeeperConfig{Type: "sqlite"},
+			},
+		}},
+	}
+	c.Assert(Start(ctx, cfg), IsNil)
+
+	call := func(method, url string, out any) int {
+		req, err := http.NewRequest(method, url, nil)
+		c.Assert(err, IsNil)
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+		c.Assert(json.NewDecoder(resp.Body).Decode(out), IsNil)
+		return resp.StatusCode
+	}
+
+	parts := func(keeper plugins.IPlugin) int {
+		count := 0
+		c.Assert(keeper.(plugins.IExporter).Export(func(_, key string, _ []byte) error {
+			if store.IsBodyKey(key) {
+				count++
+			}
+			return nil
+		}), IsNil)
+		return count
+	}
+
+	for _, path := range []string{"/a", "/b", "/c", "/r/c"} {
+		status, _ := getURL(c, "http://127.0.0.1:19235"+path)
+		c.Assert(status, Equals, http.StatusOK)
+	}
+
+	var interactions struct {
+		Interactions []Interaction `json:"interactions"`
+	}
+	c.Assert(call(http.MethodGet, "http://127.0.0.1:19236/interactions", &interactions), Equals, http.StatusOK)
+	c.Assert(interactions.Interactions, HasLen, 4)
+	keyR, keyC := interactions.Interactions[0].Key, interactions.Interactions[1].Key
+	keyB, keyA := interactions.Interactions[2].Key, interactions.Interactions[3].Key
+
+	routeKeeper := cfg.Routes[0].Config.Keeper
+	c.Assert(routeKeeper, Not(Equals), cfg.Keeper)
+	c.Assert(parts(cfg.Keeper), Equals, 2)
+	c.Assert(parts(routeKeeper), Equals, 1)
+
+	// the part is used by /b, so it's kept
+	var deleted map[string]int64
+	c.Assert(call(http.MethodDelete, "http://127.0.0.1:19236/keys?file=admin&key="+keyA, &deleted), Equals, http.StatusOK)
+	c.Assert(deleted, DeepEquals, map[string]int64{"deleted": 1})
+	c.Assert(parts(cfg.Keeper), Equals, 2)
+	status, body := getURL(c, "http://127.0.0.1:19235/b")
+	c.Assert(status, Equals, http.StatusOK)
+	c.Assert(body, Equals, strings.Repeat("x", 50))
+
+	c.Assert(call(http.MethodDelete, "http://127.0.0.1:19236/keys?file=admin&key="+keyB, &deleted), Equals, http.StatusOK)
+	c.Assert(deleted, DeepEquals, map[string]int64{"deleted": 2})
+	c.Assert(parts(cfg.Keeper), Equals, 1)
+
+	// records of the route are deleted by its keeper
+	c.Assert(call(http.MethodDelete, "http://127.0.0.1:19236/keys?file=admin&key="+keyC+"&key="+keyR, &deleted), Equals, http.StatusOK)
+	c.Assert(deleted, DeepEquals, map[string]int64{"deleted": 4})
+	c.Assert(parts(cfg.Keeper), Equals, 0)
+	c.Assert(parts(routeKeeper), Equals, 0)
+
+	// keepers of routes are cleared too
+	for _, path := range []string{"/a", "/r/c"} {
+		status, _ := getURL(c, "http://127.0.0.1:19235"+path)
+		c.Assert(status, Equals, http.StatusOK)
+	}
+	c.Assert(call(http.MethodPost, "http://127.0.0.1:19236/clear", &deleted), Equals, http.StatusOK)
+	c.Assert(deleted, DeepEquals, map[string]int64{"deleted": 4})
+	c.Assert(parts(cfg.Keeper), Equals, 0)
+	c.Assert(parts(routeKeeper), Equals, 0)
+}
+
+func getURL(c *C, url string) (int, string) {
+	resp, err := http.Get(url)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	return resp.StatusCode, string(body)
+}
@@ -5,9 +5,8 @@ import (
 )
 
 type PortBlocker struct {
-	muLock   sync.RWMutex
-	muUnlock sync.RWMutex
-	Ports    map[int]*sync.RWMutex
+	mu    sync.RWMutex
+	Ports map[int]*sync.RWMutex
 }
 
 var portBlocker *PortBlocker
@@ -18,24 +17,25 @@ func init() {
 	}
 }
 
+// Lock waits until the port is released, the map is not locked while waiting.
 func (b *PortBlocker) Lock(port int) {
-	b.muLock.Lock()
-	defer b.muLock.Unlock()
-
-	if _, find := b.Ports[port]; !find {
-		b.Ports[port] = &sync.RWMutex{}
+	b.mu.Lock()
+	mu, find := b.Ports[port]
+	if !find {
+		mu = &sync.RWMutex{}
+		b.Ports[port] = mu
 	}
+	b.mu.Unlock()
 
-	b.Ports[port].Lock()
+	mu.Lock()
 }
 
 func (b *PortBlocker) Unlock(port int) {
-	b.muUnlock.Lock()
-	defer b.muUnlock.Unlock()
+	b.mu.RLock()
+	mu, find := b.Ports[port]
+	b.mu.RUnlock()
 
-	if _, find := b.Ports[port]; !find {
-		return
+	if find {
+		mu.Unlock()
 	}
-
-	b.Ports[port].Unlock()
 }
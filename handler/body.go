@@ -0,0 +1,222 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/iostrovok/cacheproxy/config"
+	"github.com/iostrovok/cacheproxy/plugins"
+	"github.com/iostrovok/cacheproxy/store"
+)
+
+// responseWriter remembers whether and which response status is already sent to the client
+// and counts bytes of the body.
+type responseWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+	status      int
+	written     int64
+}
+
+func (w *responseWriter) WriteHeader(statusCode int) {
+	// informational responses are followed by the final one
+	if !w.wroteHeader || w.status < http.StatusOK {
+		w.status = statusCode
+	}
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.status = http.StatusOK
+	}
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *responseWriter) Flush() {
+	if !w.wroteHeader {
+		w.status = http.StatusOK
+	}
+	w.wroteHeader = true
+	flush(w.ResponseWriter)
+}
+
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errNoHijacker
+	}
+
+	conn, rw, err := hj.Hijack()
+	if err == nil {
+		w.wroteHeader = true
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+// clientWriter passes data to the client and keeps the first error.
+// The client may go away, but the response is still loaded and stored.
+type clientWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (c *clientWriter) Write(b []byte) (int, error) {
+	if c.err == nil {
+		_, c.err = c.w.Write(b)
+	}
+	return len(b), nil
+}
+
+// spool is a temporary file which keeps the response body.
+type spool struct {
+	file *os.File
+	size int64
+}
+
+func newSpool(cfg *config.Config) (*spool, error) {
+	file, err := os.CreateTemp(cfg.SpoolDir, "cacheproxy-*")
+	if err != nil {
+		return nil, err
+	}
+
+	return &spool{file: file}, nil
+}
+
+func (s *spool) Write(b []byte) (int, error) {
+	n, err := s.file.Write(b)
+	s.size += int64(n)
+	return n, err
+}
+
+// Close closes and removes the temporary file.
+func (s *spool) Close() error {
+	err := s.file.Close()
+	if errRm := os.Remove(s.file.Name()); err == nil {
+		err = errRm
+	}
+	return err
+}
+
+// pipeBody sends the response body to the client and to the spool at the same time.
+// Any error of reading from upstream is returned, so the broken response is never stored.
+func pipeBody(w io.Writer, sp *spool, req *http.Request, resp *http.Response) error {
+	client := &clientWriter{w: w}
+	n, err := io.Copy(io.MultiWriter(sp, client), resp.Body)
+	if err != nil {
+		return err
+	}
+
+	// Content-Length of responses without body is the length of the body of GET
+	if resp.ContentLength >= 0 && n != resp.ContentLength && hasBody(req, resp) {
+		return fmt.Errorf("response body is truncated: %d bytes of %d: %w", n, resp.ContentLength, io.ErrUnexpectedEOF)
+	}
+
+	return nil
+}
+
+// hasBody returns false for responses which never have body: HEAD, 1xx, 204 and 304.
+func hasBody(req *http.Request, resp *http.Response) bool {
+	if req.Method == http.MethodHead {
+		return false
+	}
+
+	switch {
+	case resp.StatusCode >= 100 && resp.StatusCode < 200,
+		resp.StatusCode == http.StatusNoContent,
+		resp.StatusCode == http.StatusNotModified:
+		return false
+	}
+
+	return true
+}
+
+// storeBody puts the spooled body into the item. The small body is kept inside the item,
+// the large one is saved by the keeper as separated parts by content hash,
+// so the same body of many items is stored once.
+func storeBody(cfg *config.Config, item *store.Item, sp *spool, fileName string) error {
+	item.BodySize = sp.size
+	if _, err := sp.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	dedup := cfg.DedupMinBodySize > 0 && sp.size >= cfg.DedupMinBodySize
+	if sp.size <= cfg.MaxInlineBodySize && !dedup {
+		body, err := io.ReadAll(sp.file)
+		item.ResponseBody = body
+		return err
+	}
+
+	codec := cfg.Codec(item.ResponseHeader)
+	buf := make([]byte, cfg.BodyChunkSize)
+	for {
+		n, err := io.ReadFull(sp.file, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		// Encode returns the new slice, so the keeper may hold it
+		chunk, err := store.Encode(codec, buf[:n])
+		if err != nil {
+			return err
+		}
+
+		chunkKey := bodyKey(cfg, buf[:n])
+		if err := keeperSave(cfg, fileName, chunkKey, chunk); err != nil {
+			return err
+		}
+		item.BodyChunks = append(item.BodyChunks, chunkKey)
+	}
+
+	return nil
+}
+
+// bodyKey returns the key of the part of the response body, keepers which hide data make their own keys.
+func bodyKey(cfg *config.Config, data []byte) string {
+	if keeper, ok := cfg.Keeper.(plugins.IBodyKey); ok {
+		if key := keeper.BodyKey(data); key != "" {
+			return key
+		}
+	}
+
+	return store.BodyKey(data)
+}
+
+// writeBody sends the stored response body to the client.
+func writeBody(cfg *config.Config, w io.Writer, item *store.Item, fileName string) error {
+	if len(item.BodyChunks) == 0 {
+		_, err := io.Copy(w, bytes.NewReader(item.ResponseBody))
+		return err
+	}
+
+	for _, chunkKey := range item.BodyChunks {
+		chunk, err := keeperRead(cfg, fileName, chunkKey)
+		if err != nil {
+			return err
+		}
+		if chunk == nil {
+			return fmt.Errorf("part of response body is not found: file: %s, key: %s", fileName, chunkKey)
+		}
+		if chunk, err = store.DecodeBody(chunk); err != nil {
+			return err
+		}
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -2,29 +2,46 @@ package handler
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"slices"
+	"strings"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 
 	"github.com/iostrovok/cacheproxy/config"
-	"github.com/iostrovok/cacheproxy/logger"
-	"github.com/iostrovok/cacheproxy/plugins/sqlite"
+	"github.com/iostrovok/cacheproxy/plugins"
+
+	// the sqlite keeper is the default one
+	_ "github.com/iostrovok/cacheproxy/plugins/sqlite"
 )
 
+// Start runs the proxy until the context is done. The config is checked and the keeper is made
+// by config.Setup, so misconfigurations are returned here. Use Serve to wait until keepers are closed.
 func Start(ctx context.Context, cfg *config.Config) error {
-	err := cfg.Init()
-	if err != nil {
-		return err
-	}
+	_, err := start(ctx, cfg)
+	return err
+}
 
-	// it sets default keeper if that is necessary
-	if cfg.Keeper == nil {
-		cfg.Keeper = sqlite.New(ctx, cfg)
+// start runs the proxy until the context is done or stop is called.
+// Stop returns when the server is closed and keepers have written data which they keep in memory.
+func start(ctx context.Context, cfg *config.Config) (stop func(), err error) {
+	if err := cfg.Setup(ctx); err != nil {
+		return nil, err
 	}
 
-	// it sets default empty logger
-	if cfg.Logger == nil {
-		cfg.Logger = logger.New()
+	// certificates are loaded before the server starts, so bad files are reported at once
+	var tlsConfig *tls.Config
+	if cfg.Scheme == "https" {
+		cert, err := tls.LoadX509KeyPair(cfg.PemPath, cfg.KeyPath)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
 	}
 
 	// server wants to serve itself port
@@ -32,39 +49,198 @@ func Start(ctx context.Context, cfg *config.Config) error {
 
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.Port))
 	if err != nil {
-		return err
+		portBlocker.Unlock(cfg.Port)
+		return nil, err
+	}
+
+	// servers are closed when the context is done, it's canceled when the proxy stops too
+	ctx, cancel := context.WithCancel(ctx)
+
+	s := newSession(cfg)
+	admin := adminHandler(cfg, s)
+	if cfg.AdminPort != 0 {
+		if err := startAdmin(ctx, cfg, admin); err != nil {
+			cancel()
+			cfg.Log().Debug("close listener", "port", cfg.Port, "error", listener.Close())
+			portBlocker.Unlock(cfg.Port)
+			return nil, err
+		}
 	}
 
 	server := &http.Server{
+		TLSConfig: tlsConfig,
 		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			handler(cfg, w, r)
+			if isAdmin(cfg, r) {
+				http.StripPrefix(cfg.AdminPrefix, admin).ServeHTTP(w, r)
+				return
+			}
+
+			target := routeConfig(cfg, r)
+			if target == nil {
+				http.Error(w, "no route for "+r.Host+r.URL.Path, http.StatusNotFound)
+				return
+			}
+			handler(target, s, w, r)
 		}),
 	}
 
-	go func(cfg *config.Config, server *http.Server, listener net.Listener) {
-		ch := make(chan error, 1)
+	// HTTP/2 is used with TLS by default, plain server accepts HTTP/2 cleartext (h2c) too
+	if cfg.Scheme != "https" {
+		server.Handler = h2c.NewHandler(server.Handler, &http2.Server{})
+	}
+
+	done := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		cfg.Log().Debug("close server", "port", cfg.Port, "error", server.Close())
+		closeKeepers(cfg)
+		close(done)
+	}()
 
+	go func() {
+		var err error
 		if cfg.Scheme == "https" {
-			select {
-			case <-ctx.Done():
-				// nothing
-				logPrintf(cfg, "Done! %d", cfg.Port)
-			case ch <- server.ServeTLS(listener, cfg.PemPath, cfg.KeyPath):
-				// nothing
-			}
+			err = server.ServeTLS(listener, "", "")
 		} else {
-			select {
-			case <-ctx.Done():
-				logPrintf(cfg, "Done! %d", cfg.Port)
-			case ch <- server.Serve(listener):
-				// nothing
-			}
+			err = server.Serve(listener)
 		}
 
-		logError(cfg, <-ch)
-		logPrintf(cfg, "Force close server. Port: %d, error: %v", cfg.Port, server.Close())
+		if !errors.Is(err, http.ErrServerClosed) {
+			cfg.Log().Error("server is stopped", "port", cfg.Port, "error", err)
+		}
+		cancel()
 		portBlocker.Unlock(cfg.Port)
-	}(cfg, server, listener)
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}, nil
+}
+
+// StartAll starts every proxy, for example proxies of config.Load, and runs them until the context is done.
+// Configs are validated before any proxy is started, started proxies are stopped if some proxy fails to start.
+func StartAll(ctx context.Context, cfgs ...*config.Config) error {
+	_, err := startAll(ctx, cfgs)
+	return err
+}
+
+// Serve starts every proxy like StartAll and returns when the context is done and all proxies are stopped,
+// so data which keepers keep in memory (see plugins.ICloser) is written before the program exits.
+func Serve(ctx context.Context, cfgs ...*config.Config) error {
+	stops, err := startAll(ctx, cfgs)
+	if err != nil {
+		return err
+	}
+
+	<-ctx.Done()
+	for _, stop := range stops {
+		stop()
+	}
+
+	return nil
+}
+
+func startAll(ctx context.Context, cfgs []*config.Config) ([]func(), error) {
+	for _, cfg := range cfgs {
+		if err := cfg.Validate(); err != nil {
+			return nil, proxyError(cfg, err)
+		}
+	}
+
+	stops := make([]func(), 0, len(cfgs))
+	for _, cfg := range cfgs {
+		stop, err := start(ctx, cfg)
+		if err != nil {
+			for _, stop := range stops {
+				stop()
+			}
+			return nil, proxyError(cfg, err)
+		}
+		stops = append(stops, stop)
+	}
+
+	return stops, nil
+}
+
+// proxyError adds the name of the proxy to the error.
+func proxyError(cfg *config.Config, err error) error {
+	if cfg.Name != "" {
+		return fmt.Errorf("proxy %q: %w", cfg.Name, err)
+	}
+	return err
+}
+
+// keeperConfigs returns configs of the proxy and of its routes which have distinct keepers,
+// the proxy is the first one.
+func keeperConfigs(cfg *config.Config) []*config.Config {
+	out := []*config.Config{cfg}
+	seen := []plugins.IPlugin{cfg.Keeper}
+	for _, route := range cfg.Routes {
+		if route.Config != nil && route.Config.Keeper != nil && !slices.Contains(seen, route.Config.Keeper) {
+			out = append(out, route.Config)
+			seen = append(seen, route.Config.Keeper)
+		}
+	}
+
+	return out
+}
+
+// closeKeepers closes keepers which keep data in memory, errors are logged.
+func closeKeepers(cfg *config.Config) {
+	for _, c := range keeperConfigs(cfg) {
+		if closer, ok := c.Keeper.(plugins.ICloser); ok {
+			if err := closer.Close(); err != nil {
+				cfg.Log().Error("keeper is not closed", "port", cfg.Port, "error", err)
+			}
+		}
+	}
+}
+
+// isAdmin returns true if the request is sent to the admin API on the proxy port.
+func isAdmin(cfg *config.Config, r *http.Request) bool {
+	return cfg.AdminPrefix != "" &&
+		(r.URL.Path == cfg.AdminPrefix || strings.HasPrefix(r.URL.Path, cfg.AdminPrefix+"/"))
+}
+
+// startAdmin serves the admin API on the separated port until the context is done.
+func startAdmin(ctx context.Context, cfg *config.Config, admin http.Handler) error {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.AdminPort))
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{Handler: admin}
+	go func() {
+		<-ctx.Done()
+		cfg.Log().Debug("close admin server", "port", cfg.AdminPort, "error", server.Close())
+	}()
+
+	go func() {
+		if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			cfg.Log().Error("admin server is stopped", "port", cfg.AdminPort, "error", err)
+		}
+	}()
 
 	return nil
 }
+
+// routeConfig returns the config of the matched route or the config of the server.
+// The prefix of the route is removed from the request path if it's necessary.
+// Nil is returned if no route matches and the server has no upstream.
+func routeConfig(cfg *config.Config, r *http.Request) *config.Config {
+	route := cfg.MatchRoute(r)
+	if route == nil {
+		if cfg.Host == "" {
+			return nil
+		}
+		return cfg
+	}
+
+	if route.StripPrefix && route.PathPrefix != "" {
+		r.URL.Path = "/" + strings.TrimLeft(strings.TrimPrefix(r.URL.Path, route.PathPrefix), "/")
+		r.URL.RawPath = ""
+	}
+
+	return route.Config
+}
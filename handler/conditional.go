@@ -0,0 +1,86 @@
+package handler
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/iostrovok/cacheproxy/config"
+	"github.com/iostrovok/cacheproxy/store"
+)
+
+// conditionalHeaders are removed from GET and HEAD requests to upstream, so the full response is stored.
+// The stored response is checked against them on replay, see serveContent.
+var conditionalHeaders = []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "If-Range", "Range"}
+
+// stripConditional removes conditional and Range headers from the request to upstream,
+// they are returned to the request before replaying, see replayItem.
+func stripConditional(ex *exchange) {
+	if ex.req.Method != http.MethodGet && ex.req.Method != http.MethodHead {
+		return
+	}
+
+	ex.conditional = http.Header{}
+	for _, name := range conditionalHeaders {
+		if vv := ex.req.Header.Values(name); len(vv) > 0 {
+			ex.conditional[name] = vv
+			ex.req.Header.Del(name)
+		}
+	}
+}
+
+// conditional returns true if the replayed response depends on conditional or Range headers of the request.
+// Only full successful responses of GET and HEAD requests are answered by 304 or 206.
+func conditional(req *http.Request, item *store.Item) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+
+	if item.StatusCode != http.StatusOK || len(item.Chunks) > 0 {
+		return false
+	}
+
+	for _, name := range conditionalHeaders {
+		if req.Header.Get(name) != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// serveContent replays the stored response for the conditional or Range request.
+// The stored ETag and Last-Modified are compared with the request headers, byte ranges are cut from the body.
+// Headers of the stored response are already copied to w.
+func serveContent(cfg *config.Config, w http.ResponseWriter, req *http.Request, item *store.Item, fileName string) error {
+	var modTime time.Time
+	if lastModified := item.ResponseHeader.Get("Last-Modified"); lastModified != "" {
+		modTime, _ = http.ParseTime(lastModified)
+	}
+
+	// the body is served and measured by http.ServeContent
+	w.Header().Del("Content-Length")
+
+	if len(item.BodyChunks) == 0 {
+		http.ServeContent(w, req, "", modTime, bytes.NewReader(item.ResponseBody))
+		return nil
+	}
+
+	// the large body is collected in the temporary file to seek it
+	sp, err := newSpool(cfg)
+	if err != nil {
+		return err
+	}
+	defer sp.Close()
+
+	if err := writeBody(cfg, sp, item, fileName); err != nil {
+		return err
+	}
+	if _, err := sp.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	http.ServeContent(w, req, "", modTime, sp.file)
+	return nil
+}
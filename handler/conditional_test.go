@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+
+	. "github.com/iostrovok/check"
+
+	"github.com/iostrovok/cacheproxy/config"
+)
+
+func (s *testSuite) TestConditional(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	large := strings.Repeat("0123456789", 10)
+
+	counter := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		counter++
+		c.Assert(r.Header.Get("Range"), Equals, "")
+		c.Assert(r.Header.Get("If-None-Match"), Equals, "")
+
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		if r.URL.Path == "/large" {
+			io.WriteString(w, large)
+			return
+		}
+		io.WriteString(w, "small")
+	}))
+	defer ts.Close()
+
+	dir, err := os.MkdirTemp(os.TempDir(), "conditional")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	cfg := &config.Config{
+		Host:              ts.URL,
+		Scheme:            "http",
+		Port:              19213,
+		StorePath:         dir,
+		FileName:          "conditional",
+		MaxInlineBodySize: 10,
+		BodyChunkSize:     7,
+	}
+	c.Assert(Start(ctx, cfg), IsNil)
+
+	get := func(path string, header map[string]string) (int, string) {
+		req, err := http.NewRequest(http.MethodGet, "http://127.0.0.1:19213"+path, nil)
+		c.Assert(err, IsNil)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		c.Assert(err, IsNil)
+		return resp.StatusCode, string(body)
+	}
+
+	// the first request is recorded, the full response is returned
+	status, body := get("/small", map[string]string{"Range": "bytes=1-2"})
+	c.Assert(status, Equals, http.StatusOK)
+	c.Assert(body, Equals, "small")
+
+	status, body = get("/small", map[string]string{"Range": "bytes=1-2"})
+	c.Assert(status, Equals, http.StatusPartialContent)
+	c.Assert(body, Equals, "ma")
+
+	status, _ = get("/small", map[string]string{"If-None-Match": `"v1"`})
+	c.Assert(status, Equals, http.StatusNotModified)
+
+	status, _ = get("/small", map[string]string{"If-Modified-Since": "Mon, 02 Jan 2006 15:04:05 GMT"})
+	c.Assert(status, Equals, http.StatusNotModified)
+
+	status, body = get("/small", map[string]string{"If-None-Match": `"v2"`})
+	c.Assert(status, Equals, http.StatusOK)
+	c.Assert(body, Equals, "small")
+
+	status, body = get("/small", map[string]string{"Range": "bytes=1-2", "If-Range": `"v2"`})
+	c.Assert(status, Equals, http.StatusOK)
+	c.Assert(body, Equals, "small")
+
+	// the large body is stored by parts
+	status, body = get("/large", nil)
+	c.Assert(status, Equals, http.StatusOK)
+	c.Assert(body, Equals, large)
+
+	status, body = get("/large", map[string]string{"Range": "bytes=5-24"})
+	c.Assert(status, Equals, http.StatusPartialContent)
+	c.Assert(body, Equals, large[5:25])
+
+	c.Assert(counter, Equals, 2)
+}
@@ -0,0 +1,69 @@
+package handler
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/http2"
+
+	"github.com/iostrovok/cacheproxy/config"
+)
+
+// h2cTransport sends requests to upstream by HTTP/2 without TLS.
+var h2cTransport http.RoundTripper = &http2.Transport{
+	AllowHTTP: true,
+	DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	},
+}
+
+// isGRPC reports whether the request is a gRPC call.
+func isGRPC(req *http.Request) bool {
+	return strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc")
+}
+
+// transport returns the transport for the request. gRPC works over HTTP/2 only,
+// so plain HTTP upstream is requested by HTTP/2 cleartext (h2c).
+func transport(cfg *config.Config, req *http.Request) http.RoundTripper {
+	if isGRPC(req) && cfg.URL.Scheme == "http" {
+		return h2cTransport
+	}
+
+	return http.DefaultTransport
+}
+
+// grpcMessages returns protobuf messages of the gRPC request body without the framing.
+// Every message is prefixed by 1 byte of compression flag and 4 bytes of the message length.
+func grpcMessages(body []byte) []byte {
+	out := make([]byte, 0, len(body))
+	for len(body) >= 5 {
+		size := binary.BigEndian.Uint32(body[1:5])
+		if uint64(size) > uint64(len(body)-5) {
+			break
+		}
+
+		out = append(out, body[5:5+size]...)
+		body = body[5+size:]
+	}
+
+	return out
+}
+
+// grpcCacheKeySource returns the data for the key of the gRPC call: service/method plus messages.
+func grpcCacheKeySource(req *http.Request, body []byte) []byte {
+	return append([]byte(req.URL.Path), grpcMessages(body)...)
+}
+
+// writeTrailer sends trailers to the client after the response body.
+func writeTrailer(w http.ResponseWriter, trailer http.Header) {
+	for k, vv := range trailer {
+		for _, v := range vv {
+			w.Header().Add(http.TrailerPrefix+k, v)
+		}
+	}
+}
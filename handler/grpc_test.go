@@ -0,0 +1,102 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+
+	. "github.com/iostrovok/check"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"github.com/iostrovok/cacheproxy/config"
+	"github.com/iostrovok/cacheproxy/store"
+)
+
+func grpcFrame(msg string) []byte {
+	return append([]byte{0, 0, 0, 0, byte(len(msg))}, msg...)
+}
+
+func (s *testSuite) Test_GRPCCacheKey(c *C) {
+	cfg := &config.Config{}
+
+	req1, err := http.NewRequest(http.MethodPost, "http://first:8080/pkg.Service/Method", nil)
+	c.Assert(err, IsNil)
+	req1.Header.Set("Content-Type", "application/grpc")
+
+	req2, err := http.NewRequest(http.MethodPost, "http://second:9090/pkg.Service/Method", nil)
+	c.Assert(err, IsNil)
+	req2.Header.Set("Content-Type", "application/grpc+proto")
+
+	dump := append([]byte("POST /pkg.Service/Method HTTP/2.0\r\n\r\n"), grpcFrame("message")...)
+	key1, inputs, err := cacheKey(cfg, req1, dump)
+	c.Assert(err, IsNil)
+	c.Assert(inputs, DeepEquals, store.KeyInputs{
+		URL: "/pkg.Service/Method", BodyMD5: fmt.Sprintf("%x", md5.Sum([]byte("message"))), GRPC: true})
+
+	key2, _, err := cacheKey(cfg, req2, dump)
+	c.Assert(err, IsNil)
+	c.Assert(key1, Equals, key2)
+
+	other := append([]byte("POST /pkg.Service/Method HTTP/2.0\r\n\r\n"), grpcFrame("other")...)
+	key3, _, err := cacheKey(cfg, req1, other)
+	c.Assert(err, IsNil)
+	c.Assert(key1, Not(Equals), key3)
+
+	c.Assert(grpcMessages(append(grpcFrame("one"), grpcFrame("two")...)), DeepEquals, []byte("onetwo"))
+}
+
+func (s *testSuite) TestGRPC(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	counter := 0
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		counter++
+		c.Assert(r.ProtoMajor, Equals, 2)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Write(grpcFrame("reply"))
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+	}))
+	ts.Config.Handler = h2c.NewHandler(ts.Config.Handler, &http2.Server{})
+	ts.Start()
+	defer ts.Close()
+
+	dir, err := os.MkdirTemp(os.TempDir(), "grpc")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	cfg := &config.Config{
+		Host:      ts.URL,
+		Scheme:    "http",
+		Port:      19211,
+		StorePath: dir,
+		FileName:  "grpc",
+	}
+	c.Assert(Start(ctx, cfg), IsNil)
+
+	client := &http.Client{Transport: h2cTransport}
+	for i := 0; i < 3; i++ {
+		req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:19211/pkg.Service/Method", bytes.NewReader(grpcFrame("ask")))
+		c.Assert(err, IsNil)
+		req.Header.Set("Content-Type", "application/grpc")
+
+		resp, err := client.Do(req)
+		c.Assert(err, IsNil)
+		c.Assert(resp.ProtoMajor, Equals, 2)
+
+		body, err := io.ReadAll(resp.Body)
+		c.Assert(err, IsNil)
+		resp.Body.Close()
+
+		c.Assert(body, DeepEquals, grpcFrame("reply"))
+		c.Assert(resp.Trailer.Get("Grpc-Status"), Equals, "0")
+	}
+
+	c.Assert(counter, Equals, 1)
+}
@@ -3,36 +3,100 @@ package handler
 import (
 	"bytes"
 	"crypto/md5"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/iostrovok/cacheproxy/config"
+	"github.com/iostrovok/cacheproxy/hooks"
+	"github.com/iostrovok/cacheproxy/signer"
 	"github.com/iostrovok/cacheproxy/store"
 )
 
 var re = regexp.MustCompile(`[^-_a-zA-Z0-9]+`)
 
-func handler(cfg *config.Config, w http.ResponseWriter, req *http.Request) {
-	err := finger(cfg, w, req)
+// errNotRecorded means that the request is not found in ModeReplay.
+var errNotRecorded = errors.New("response is not recorded")
+
+func handler(cfg *config.Config, s *session, w http.ResponseWriter, req *http.Request) {
+	log := cfg.Log().With("request_id", requestID(req), "method", req.Method, "url", req.URL.String())
+	req = withLog(req, log)
+
+	rw := &responseWriter{ResponseWriter: w}
+	ex := &exchange{req: req, session: s}
+	it := Interaction{Time: time.Now(), Method: req.Method}
+
+	err := finger(cfg, rw, ex)
+	if err != nil {
+		it.Error = err.Error()
+		// the client has already got the status, it's too late to report the error
+		if !rw.wroteHeader {
+			status := http.StatusServiceUnavailable
+			if errors.Is(err, errNotRecorded) {
+				status = http.StatusNotFound
+			}
+			http.Error(rw, err.Error(), status)
+		}
+	}
+
+	it.URL, it.FileName, it.Key, it.Result = req.URL.String(), ex.fileName, ex.key, ex.result
+	it.Status, it.Duration = rw.status, time.Since(it.Time)
+	s.add(it)
+
+	result := ex.result
+	if err != nil {
+		result = "error"
+	}
+	requestsTotal.Inc(cfg.ProxyName(), result)
+	servedBytes.Add(float64(rw.written), cfg.ProxyName(), result)
+
+	attrs := []any{"file", ex.fileName, "key", ex.key, "result", result, "status", it.Status,
+		"duration", it.Duration, "bytes", rw.written}
 	if err != nil {
-		logError(cfg, err)
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		log.Error("request failed", append(attrs, "error", err)...)
+	} else {
+		log.Info("request", attrs...)
 	}
 }
 
-func finger(cfg *config.Config, w http.ResponseWriter, req *http.Request) error {
+// exchange is the request which is replayed or recorded.
+type exchange struct {
+	req           *http.Request
+	dump          []byte
+	fileName, key string
+	inputs        store.KeyInputs
+
+	// conditional headers of the client which are not sent to upstream
+	conditional http.Header
+
+	session *session
+	result  string
+}
+
+func finger(cfg *config.Config, w http.ResponseWriter, ex *exchange) error {
+	req := ex.req
+	if cfg.Signer != nil {
+		// the signature is made for the proxy host, it's made again for upstream
+		signer.Strip(cfg.Signer, req)
+	}
+
+	if err := cfg.Hooks.BeforeKey(req); err != nil {
+		return err
+	}
+
 	requestDump, err := httputil.DumpRequest(req, true)
 	if err != nil {
 		return err
 	}
 
-	key, err := cacheKey(cfg, req, requestDump)
+	key, inputs, err := cacheKey(cfg, req, requestDump)
 	if err != nil {
 		return err
 	}
@@ -41,74 +105,412 @@ func finger(cfg *config.Config, w http.ResponseWriter, req *http.Request) error
 	req.URL.Scheme = cfg.URL.Scheme
 	urlStr := req.URL.String()
 
-	logPrintf(cfg, "[ForceSave: %t] Try to get %s", cfg.ForceSave, urlStr)
+	mode := ex.session.Mode()
+
+	ex.dump = requestDump
+	ex.fileName = fileKey(cfg, urlAsString(req.URL, cfg.NoUseDomain, cfg.NoUseUserData))
+	ex.key = key
+	ex.inputs = inputs
 
-	fileName := fileKey(cfg, urlAsString(req.URL, cfg.NoUseDomain, cfg.NoUseUserData))
-	if !cfg.ForceSave {
-		cfg.Logger.Printf("read file: %s, key: %s", fileName, key)
-		body, err := cfg.Keeper.Read(fileName, key)
+	// the URL of upstream, the file and the cache key are known now
+	log := reqLog(cfg, req).With("file", ex.fileName, "key", key)
+	ex.req = withLog(req, log)
+	log.Debug("try to get", "mode", modeName(mode), "upstream", urlStr)
+
+	if mode == config.ModePassthrough {
+		return passthrough(cfg, w, ex)
+	}
+
+	if !isWebSocket(req) {
+		stripConditional(ex)
+	}
+
+	switch mode {
+	case config.ModeRecord:
+		return fetch(cfg, w, ex, nil)
+	case config.ModeReplay:
+		item, err := load(cfg, ex)
 		if err != nil {
 			return err
 		}
-
-		// it means value is found in cache
-		if body != nil && len(body) > 0 {
-			item := &store.Item{}
-			if item, err = store.FromZip(body); err == nil {
-				logPrintf(cfg, "Found at cache key: %s for %s", key, urlStr)
-				copyHeader(w.Header(), item.ResponseHeader)
-				w.WriteHeader(item.StatusCode)
-				if _, err = io.Copy(w, bytes.NewReader(item.ResponseBody)); err != nil {
-					if !cfg.Verbose { // always save errors
-						log.Print(err)
-					}
-				}
+		if item == nil {
+			if err := cfg.Hooks.OnMiss(ex.req); err != nil {
+				return err
 			}
+			return fmt.Errorf("%w: cache key: %s for %s", errNotRecorded, key, urlStr)
+		}
+		return replayItem(cfg, w, ex, item)
+	}
+
+	if cfg.HTTPCaching && !isWebSocket(req) {
+		return serveHTTPCache(cfg, w, ex)
+	}
+
+	item, err := load(cfg, ex)
+	if err != nil {
+		return err
+	}
 
+	if item == nil {
+		log.Debug("not found")
+		if err := cfg.Hooks.OnMiss(ex.req); err != nil {
 			return err
 		}
+		return fetch(cfg, w, ex, nil)
+	}
+
+	// the websocket conversation can't be loaded in background or replaced by the stale one
+	rule := cfg.MatchRule(req)
+	if isWebSocket(req) || !rule.Expired(item.RecordedAt(), cfg.Now()) {
+		log.Debug("found")
+		return replayItem(cfg, w, ex, item)
+	}
+
+	log.Debug("stale", "recorded_at", item.RecordedAt())
+
+	if rule.StaleWhileRevalidate {
+		refresh(cfg, ex)
+		ex.result = ResultStale
+		return replayItem(cfg, w, ex, item)
+	}
+
+	var stale *store.Item
+	if rule.StaleIfError {
+		stale = item
+	}
 
-		logPrintf(cfg, "NOT Found at cache key: %s for %s", key, urlStr)
+	return fetch(cfg, w, ex, stale)
+}
+
+// load returns the stored item or nil if it's not found.
+func load(cfg *config.Config, ex *exchange) (*store.Item, error) {
+	item, err := read(cfg, ex.fileName, ex.key)
+	if err != nil || item == nil {
+		return item, err
+	}
+
+	ex.session.use(ex.fileName, ex.key)
+	if item.Type != store.TypeVary {
+		return item, nil
+	}
+
+	// the response depends on the request headers from Vary
+	key, _ := varyKey(ex.key, varyNames(item.ResponseHeader), ex.req.Header)
+	if item, err = read(cfg, ex.fileName, key); item != nil {
+		ex.session.use(ex.fileName, key)
+	}
+	return item, err
+}
+
+func read(cfg *config.Config, fileName, key string) (*store.Item, error) {
+	body, err := keeperRead(cfg, fileName, key)
+	if err != nil || len(body) == 0 {
+		return nil, err
+	}
+
+	return store.FromZip(body)
+}
+
+func replayItem(cfg *config.Config, w http.ResponseWriter, ex *exchange, item *store.Item) error {
+	if ex.result == "" {
+		ex.result = ResultHit
+	}
+
+	for k, vv := range ex.conditional {
+		ex.req.Header[k] = vv
+	}
+
+	if err := cfg.Hooks.BeforeReplay(item, ex.req); err != nil {
+		return err
+	}
+
+	return replay(cfg, w, ex.req, item, ex.fileName)
+}
+
+// fetch loads the response from upstream and stores it.
+// The stale item is replayed if it's not nil and upstream fails.
+func fetch(cfg *config.Config, w http.ResponseWriter, ex *exchange, stale *store.Item) error {
+	reqLog(cfg, ex.req).Debug("loading from upstream")
+
+	ex.result = ResultMiss
+	meta := newMeta(cfg, ex)
+	storeData, err := record(cfg, w, ex.req, ex.dump, ex.fileName, stale != nil)
+	var upstreamErr *upstreamError
+	if stale != nil && errors.As(err, &upstreamErr) {
+		reqLog(cfg, ex.req).Warn("stale response is replayed", "error", err)
+		ex.result = ResultStale
+		return replayItem(cfg, w, ex, stale)
 	}
+	if err != nil || storeData == nil {
+		return err
+	}
+
+	return save(cfg, ex, storeData, meta)
+}
 
-	logPrintf(cfg, "Loading from remote server.... %s", urlStr)
+// passthrough passes the request to upstream and the response to the client, nothing is read or stored.
+func passthrough(cfg *config.Config, w http.ResponseWriter, ex *exchange) error {
+	reqLog(cfg, ex.req).Debug("passing to upstream")
 
-	resp, err := http.DefaultTransport.RoundTrip(req)
+	ex.result = ResultPassthrough
+	if isWebSocket(ex.req) {
+		_, err := recordWebSocket(cfg, w, ex.req, ex.dump)
+		return err
+	}
+
+	resp, err := roundTrip(cfg, ex.req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
-	// >>>>>>>>> store for next using
-	storeData := &store.Item{
-		Request:        requestDump,
-		ResponseBody:   streamToByte(resp.Body),
-		ResponseHeader: resp.Header,
-		StatusCode:     resp.StatusCode,
+	copyHeader(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
+	if isStream(cfg, resp) {
+		_, err = pipeStream(w, resp, nil)
+	} else {
+		_, err = io.Copy(w, resp.Body)
+	}
+
+	if err == nil {
+		writeTrailer(w, resp.Trailer)
+	}
+
+	return err
+}
+
+// roundTrip sends the request to upstream and measures the time to response headers.
+// Hooks may replace the upstream response or change it.
+func roundTrip(cfg *config.Config, req *http.Request) (*http.Response, error) {
+	if resp, err := cfg.Hooks.BeforeUpstream(req); err != nil {
+		return nil, err
+	} else if resp != nil {
+		// the response made by the hook may be incomplete
+		if resp.StatusCode == 0 {
+			resp.StatusCode = http.StatusOK
+		}
+		if resp.Header == nil {
+			resp.Header = http.Header{}
+		}
+		if resp.Body == nil {
+			resp.Body = http.NoBody
+		} else if resp.ContentLength == 0 {
+			resp.ContentLength = -1
+		}
+		return resp, nil
+	}
+
+	if err := sign(cfg, req); err != nil {
+		return nil, err
 	}
 
-	body, err := storeData.ToZip()
+	start := time.Now()
+	resp, err := transport(cfg, req).RoundTrip(req)
+
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(resp.StatusCode)
+	}
+	upstreamDuration.Observe(time.Since(start).Seconds(), cfg.ProxyName(), status)
+
 	if err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Hooks.AfterUpstream(resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// sign signs the request for upstream by cfg.Signer if it's set.
+func sign(cfg *config.Config, req *http.Request) error {
+	if cfg.Signer == nil {
+		return nil
+	}
+
+	// the Host header of the client is the proxy host
+	req.Host = ""
+
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	return cfg.Signer.Sign(req, body)
+}
+
+func newMeta(cfg *config.Config, ex *exchange) *store.Meta {
+	return &store.Meta{
+		RecordedAt:    cfg.Now(),
+		URL:           ex.req.URL.String(),
+		Method:        ex.req.Method,
+		RemoteAddr:    ex.req.RemoteAddr,
+		ContentLength: -1,
+		Key:           ex.key,
+		KeyInputs:     ex.inputs,
+	}
+}
+
+// save stores the recorded item with the meta information.
+func save(cfg *config.Config, ex *exchange, storeData *store.Item, meta *store.Meta) error {
+	// >>>>>>>>> store for next using
+	meta.Duration = cfg.Now().Sub(meta.RecordedAt)
+	if storeData.Meta != nil {
+		meta.Proto, meta.ContentLength = storeData.Meta.Proto, storeData.Meta.ContentLength
+	}
+	storeData.Meta = meta
+
+	if err := cfg.Hooks.BeforeSave(storeData); err != nil {
+		if errors.Is(err, hooks.ErrSkip) {
+			reqLog(cfg, ex.req).Debug("response is not stored by the hook")
+			return nil
+		}
 		return err
 	}
 
-	cfg.Logger.Printf("save file: %s, key: %s", fileName, key)
-	if err := cfg.Keeper.Save(fileName, key, body); err != nil {
+	key := ex.key
+	if cfg.HTTPCaching {
+		var err error
+		if key, err = saveVary(cfg, ex, storeData); err != nil {
+			return err
+		}
+	}
+
+	if err := put(cfg, ex.fileName, key, storeData); err != nil {
 		return err
 	}
+	ex.session.use(ex.fileName, key)
 	// <<<<<<<<<< store for next using
 
-	logPrintf(cfg, "Result of loading: StatusCode: %d, Response Length: %d",
-		storeData.StatusCode, len(storeData.ResponseBody))
-
-	// return result
-	copyHeader(w.Header(), storeData.ResponseHeader)
-	w.WriteHeader(storeData.StatusCode)
-	w.Write(storeData.ResponseBody)
+	reqLog(cfg, ex.req).Debug("stored", "status", storeData.StatusCode, "body_size", storeData.BodySize)
 
 	return nil
 }
 
+func put(cfg *config.Config, fileName, key string, item *store.Item) error {
+	body, err := item.Encode(cfg.Codec(item.ResponseHeader))
+	if err != nil {
+		return err
+	}
+
+	return keeperSave(cfg, fileName, key, body)
+}
+
+// replay sends the stored item to the client.
+func replay(cfg *config.Config, w http.ResponseWriter, req *http.Request, item *store.Item, fileName string) error {
+	if item.Type == store.TypeWebSocket {
+		return replayWebSocket(cfg, w, req, item)
+	}
+
+	copyHeader(w.Header(), item.ResponseHeader)
+	if cfg.HTTPCaching {
+		if a, known := age(item, cfg.Now()); known {
+			w.Header().Set("Age", strconv.FormatInt(int64(a/time.Second), 10))
+		}
+	}
+
+	if conditional(req, item) {
+		return serveContent(cfg, w, req, item, fileName)
+	}
+
+	w.WriteHeader(item.StatusCode)
+	var err error
+	if len(item.Chunks) > 0 {
+		err = writeStream(req.Context(), cfg, w, item)
+	} else {
+		err = writeBody(cfg, w, item, fileName)
+	}
+
+	if err == nil {
+		writeTrailer(w, item.ResponseTrailer)
+	}
+
+	return err
+}
+
+// record loads the response from upstream, sends it to the client and returns it as the item.
+// The nil item means that the response should not be stored.
+// If staleIfError is true the response with 5xx status is not sent to the client, upstreamError is returned.
+func record(cfg *config.Config, w http.ResponseWriter, req *http.Request, requestDump []byte, fileName string, staleIfError bool) (*store.Item, error) {
+	if isWebSocket(req) {
+		return recordWebSocket(cfg, w, req, requestDump)
+	}
+
+	resp, err := roundTrip(cfg, req)
+	if err != nil {
+		return nil, &upstreamError{err: err}
+	}
+	defer resp.Body.Close()
+
+	if staleIfError && resp.StatusCode >= http.StatusInternalServerError {
+		return nil, &upstreamError{err: fmt.Errorf("upstream status: %s", resp.Status)}
+	}
+
+	return recordResponse(cfg, w, req, resp, requestDump, fileName)
+}
+
+// recordResponse sends the upstream response to the client and returns it as the item.
+func recordResponse(cfg *config.Config, w http.ResponseWriter, req *http.Request, resp *http.Response,
+	requestDump []byte, fileName string) (*store.Item, error) {
+	// responses which must not be stored are passed to the client only
+	noStore := cfg.HTTPCaching && !storable(req, resp.Header)
+
+	item := &store.Item{
+		Meta:           &store.Meta{Proto: resp.Proto, ContentLength: resp.ContentLength},
+		Request:        requestDump,
+		ResponseHeader: resp.Header,
+		StatusCode:     resp.StatusCode,
+	}
+
+	sp, err := newSpool(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer sp.Close()
+
+	// return result and keep it at the same time
+	copyHeader(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
+
+	var marks []streamMark
+	stream := isStream(cfg, resp)
+	if stream {
+		marks, err = pipeStream(w, resp, sp)
+	} else {
+		err = pipeBody(w, sp, req, resp)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// trailers are known after the whole body is read
+	item.ResponseTrailer = resp.Trailer
+	writeTrailer(w, resp.Trailer)
+
+	if noStore {
+		reqLog(cfg, req).Debug("response is not stored by Cache-Control")
+		return nil, nil
+	}
+
+	if stream {
+		err = storeStream(cfg, item, sp, marks, fileName)
+	} else {
+		err = storeBody(cfg, item, sp, fileName)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return item, nil
+}
+
 func cloneUrl(in *url.URL) *url.URL {
 	var user *url.Userinfo
 	if in.User != nil {
@@ -147,34 +549,29 @@ func urlAsString(in *url.URL, noUseDomain, noUseUserData bool) string {
 	return strings.TrimLeft(u.String(), "/")
 }
 
-func cacheKey(cfg *config.Config, req *http.Request, dump []byte) (string, error) {
-	b := []byte(urlAsString(req.URL, cfg.NoUseDomain, cfg.NoUseUserData))
-
+// cacheKey returns the key of the request and the data which the key is made from.
+func cacheKey(cfg *config.Config, req *http.Request, dump []byte) (string, store.KeyInputs, error) {
+	var body []byte
 	bodyParts := bytes.SplitN(dump, []byte("\r\n\r\n"), 2)
 	if len(bodyParts) == 2 {
-		b = append(b, bodyParts[1]...)
+		body = bodyParts[1]
 	}
 
-	// convert key to human-readable value
-	return fmt.Sprintf("%x", md5.Sum(b)), nil
-}
-
-func logError(cfg *config.Config, err error) {
-	if cfg.Verbose && err != nil {
-		log.Print(err)
+	if isGRPC(req) {
+		messages := grpcMessages(body)
+		inputs := store.KeyInputs{URL: req.URL.Path, BodyMD5: md5String(messages), GRPC: true}
+		return md5String(grpcCacheKeySource(req, body)), inputs, nil
 	}
-}
 
-func logPrintf(cfg *config.Config, tmpl string, data ...interface{}) {
-	if cfg.Verbose {
-		log.Printf(tmpl, data...)
-	}
+	urlStr := urlAsString(req.URL, cfg.NoUseDomain, cfg.NoUseUserData)
+	b := append([]byte(urlStr), body...)
+
+	// convert key to human-readable value
+	return md5String(b), store.KeyInputs{URL: urlStr, BodyMD5: md5String(body)}, nil
 }
 
-func streamToByte(stream io.Reader) []byte {
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(stream)
-	return buf.Bytes()
+func md5String(b []byte) string {
+	return fmt.Sprintf("%x", md5.Sum(b))
 }
 
 func copyHeader(dst, src http.Header) {
@@ -0,0 +1,133 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+
+	. "github.com/iostrovok/check"
+
+	"github.com/iostrovok/cacheproxy/config"
+	"github.com/iostrovok/cacheproxy/hooks"
+	"github.com/iostrovok/cacheproxy/store"
+)
+
+type testHook struct {
+	hooks.Base
+
+	mx     sync.Mutex
+	misses []string
+}
+
+func (h *testHook) BeforeKey(req *http.Request) error {
+	req.Header.Del("X-Trace")
+	return nil
+}
+
+func (h *testHook) OnMiss(req *http.Request) error {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	h.misses = append(h.misses, req.URL.Path)
+	return nil
+}
+
+func (h *testHook) BeforeUpstream(req *http.Request) (*http.Response, error) {
+	if req.URL.Path != "/fake" {
+		return nil, nil
+	}
+	return &http.Response{Body: io.NopCloser(strings.NewReader("fake"))}, nil
+}
+
+func (h *testHook) AfterUpstream(resp *http.Response) error {
+	resp.Header.Set("X-Patched", "yes")
+	return nil
+}
+
+func (h *testHook) BeforeSave(item *store.Item) error {
+	if strings.HasSuffix(item.Meta.URL, "/no-store") {
+		return hooks.ErrSkip
+	}
+	return nil
+}
+
+func (h *testHook) BeforeReplay(item *store.Item, _ *http.Request) error {
+	item.ResponseHeader.Set("X-Replayed", "yes")
+	return nil
+}
+
+func (s *testSuite) TestHooks(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mx sync.Mutex
+	counters := map[string]int{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mx.Lock()
+		counters[r.URL.Path]++
+		n := counters[r.URL.Path]
+		mx.Unlock()
+		fmt.Fprintf(w, "%s-%d", r.URL.Path, n)
+	}))
+	defer ts.Close()
+
+	dir, err := os.MkdirTemp(os.TempDir(), "hooks")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	hook := &testHook{}
+	cfg := &config.Config{
+		Host:      ts.URL,
+		Scheme:    "http",
+		Port:      19219,
+		StorePath: dir,
+		FileName:  "hooks",
+		Hooks:     hooks.Chain{hook},
+	}
+	c.Assert(Start(ctx, cfg), IsNil)
+
+	get := func(path, trace string) (http.Header, string) {
+		req, err := http.NewRequest(http.MethodGet, "http://127.0.0.1:19219"+path, nil)
+		c.Assert(err, IsNil)
+		req.Header.Set("X-Trace", trace)
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		c.Assert(err, IsNil)
+		return resp.Header, string(body)
+	}
+
+	header, body := get("/a", "1")
+	c.Assert(body, Equals, "/a-1")
+	c.Assert(header.Get("X-Patched"), Equals, "yes")
+	c.Assert(header.Get("X-Replayed"), Equals, "")
+
+	// the trace header is not a part of the key
+	header, body = get("/a", "2")
+	c.Assert(body, Equals, "/a-1")
+	c.Assert(header.Get("X-Patched"), Equals, "yes")
+	c.Assert(header.Get("X-Replayed"), Equals, "yes")
+
+	_, body = get("/no-store", "1")
+	c.Assert(body, Equals, "/no-store-1")
+	_, body = get("/no-store", "1")
+	c.Assert(body, Equals, "/no-store-2")
+
+	_, body = get("/fake", "1")
+	c.Assert(body, Equals, "fake")
+	_, body = get("/fake", "1")
+	c.Assert(body, Equals, "fake")
+
+	hook.mx.Lock()
+	defer hook.mx.Unlock()
+	c.Assert(hook.misses, DeepEquals, []string{"/a", "/no-store", "/no-store", "/fake"})
+
+	mx.Lock()
+	defer mx.Unlock()
+	c.Assert(counters, DeepEquals, map[string]int{"/a": 1, "/no-store": 2})
+}
@@ -0,0 +1,246 @@
+package handler
+
+import (
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iostrovok/cacheproxy/config"
+	"github.com/iostrovok/cacheproxy/store"
+)
+
+// serveHTTPCache replays the fresh stored response, revalidates the stale one or loads the new one.
+func serveHTTPCache(cfg *config.Config, w http.ResponseWriter, ex *exchange) error {
+	item, err := load(cfg, ex)
+	if err != nil {
+		return err
+	}
+
+	if item == nil {
+		reqLog(cfg, ex.req).Debug("not found")
+		if err := cfg.Hooks.OnMiss(ex.req); err != nil {
+			return err
+		}
+		return fetch(cfg, w, ex, nil)
+	}
+
+	if fresh(item, ex.req, cfg.Now()) {
+		reqLog(cfg, ex.req).Debug("found fresh")
+		return replayItem(cfg, w, ex, item)
+	}
+
+	return revalidate(cfg, w, ex, item)
+}
+
+// revalidate asks upstream whether the stale response is still valid by its ETag and Last-Modified.
+// The stored response is replayed for 304 Not Modified, otherwise the new response is stored.
+func revalidate(cfg *config.Config, w http.ResponseWriter, ex *exchange, item *store.Item) error {
+	etag, lastModified := item.ResponseHeader.Get("ETag"), item.ResponseHeader.Get("Last-Modified")
+	if etag == "" && lastModified == "" {
+		reqLog(cfg, ex.req).Debug("stale without validators")
+		return fetch(cfg, w, ex, nil)
+	}
+
+	reqLog(cfg, ex.req).Debug("revalidate", "etag", etag, "last_modified", lastModified)
+
+	meta := newMeta(cfg, ex)
+	req := ex.req.Clone(ex.req.Context())
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+
+	resp, err := roundTrip(cfg, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotModified {
+		ex.result = ResultMiss
+		storeData, err := recordResponse(cfg, w, ex.req, resp, ex.dump, ex.fileName)
+		if err != nil || storeData == nil {
+			return err
+		}
+		return save(cfg, ex, storeData, meta)
+	}
+
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		return err
+	}
+
+	// the stored response gets new headers and the new time of recording
+	item.ResponseHeader.Del("Age")
+	for k, vv := range resp.Header {
+		switch k {
+		case "Content-Length", "Transfer-Encoding", "Connection", "Keep-Alive":
+			continue
+		}
+		item.ResponseHeader[k] = vv
+	}
+
+	if err := save(cfg, ex, item, meta); err != nil {
+		return err
+	}
+
+	return replayItem(cfg, w, ex, item)
+}
+
+// cacheControl returns directives of the Cache-Control header, names are in lower case.
+func cacheControl(h http.Header) map[string]string {
+	out := map[string]string{}
+	for _, line := range h.Values("Cache-Control") {
+		for _, part := range strings.Split(line, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+			if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+				out[name] = strings.Trim(strings.TrimSpace(value), `"`)
+			}
+		}
+	}
+	return out
+}
+
+func seconds(v string) (time.Duration, bool) {
+	n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// storable returns true if the response may be stored by the shared cache.
+func storable(req *http.Request, header http.Header) bool {
+	if _, find := cacheControl(req.Header)["no-store"]; find {
+		return false
+	}
+
+	cc := cacheControl(header)
+	for _, directive := range []string{"no-store", "private"} {
+		if _, find := cc[directive]; find {
+			return false
+		}
+	}
+
+	for _, name := range varyNames(header) {
+		if name == "*" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// lifetime returns the freshness lifetime of the response, zero means that it's stale at once.
+func lifetime(header http.Header) time.Duration {
+	cc := cacheControl(header)
+	if _, find := cc["no-cache"]; find {
+		return 0
+	}
+
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if v, find := cc[directive]; find {
+			d, _ := seconds(v)
+			return d
+		}
+	}
+
+	if expires := header.Get("Expires"); expires != "" {
+		exp, err := http.ParseTime(expires)
+		if err != nil {
+			return 0
+		}
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			return 0
+		}
+		return exp.Sub(date)
+	}
+
+	return 0
+}
+
+// age returns the current age of the stored response, it's unknown for items of old formats.
+func age(item *store.Item, now time.Time) (time.Duration, bool) {
+	recordedAt := item.RecordedAt()
+	if recordedAt.IsZero() {
+		return 0, false
+	}
+
+	stored, _ := seconds(item.ResponseHeader.Get("Age"))
+	return stored + now.Sub(recordedAt), true
+}
+
+// fresh returns true if the stored response may be replayed without revalidation.
+func fresh(item *store.Item, req *http.Request, now time.Time) bool {
+	current, known := age(item, now)
+	if !known {
+		return false
+	}
+
+	cc := cacheControl(req.Header)
+	if _, find := cc["no-cache"]; find {
+		return false
+	}
+	if v, find := cc["max-age"]; find {
+		if maxAge, ok := seconds(v); !ok || current > maxAge {
+			return false
+		}
+	}
+
+	return current < lifetime(item.ResponseHeader)
+}
+
+// varyNames returns sorted canonical names of headers from the Vary header.
+func varyNames(header http.Header) []string {
+	out := make([]string, 0)
+	for _, line := range header.Values("Vary") {
+		for _, name := range strings.Split(line, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				out = append(out, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// varyKey returns the key of the response by the key of the request and values of the headers.
+func varyKey(key string, names []string, header http.Header) (string, map[string]string) {
+	values := map[string]string{}
+	b := []byte(key)
+	for _, name := range names {
+		v := strings.Join(header.Values(name), ", ")
+		values[name] = v
+		b = append(b, "\n"+name+": "+v...)
+	}
+
+	return md5String(b), values
+}
+
+// saveVary stores the Vary header of the response by the key of the request
+// and returns the key of the response itself.
+func saveVary(cfg *config.Config, ex *exchange, item *store.Item) (string, error) {
+	names := varyNames(item.ResponseHeader)
+	if len(names) == 0 {
+		return ex.key, nil
+	}
+
+	marker := &store.Item{Type: store.TypeVary, ResponseHeader: http.Header{"Vary": names}}
+	if err := put(cfg, ex.fileName, ex.key, marker); err != nil {
+		return "", err
+	}
+	ex.session.use(ex.fileName, ex.key)
+
+	key, values := varyKey(ex.key, names, ex.req.Header)
+	if item.Meta != nil {
+		item.Meta.Key = key
+		item.Meta.KeyInputs.Vary = values
+	}
+
+	return key, nil
+}
@@ -0,0 +1,161 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"time"
+
+	. "github.com/iostrovok/check"
+
+	"github.com/iostrovok/cacheproxy/config"
+	"github.com/iostrovok/cacheproxy/store"
+)
+
+func (s *testSuite) Test_CacheControl(c *C) {
+	h := http.Header{}
+	h.Add("Cache-Control", `Max-Age=60, private="Set-Cookie"`)
+	h.Add("Cache-Control", "no-transform")
+	c.Assert(cacheControl(h), DeepEquals, map[string]string{"max-age": "60", "private": "Set-Cookie", "no-transform": ""})
+
+	req, err := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	c.Assert(err, IsNil)
+	c.Assert(storable(req, http.Header{}), Equals, true)
+	c.Assert(storable(req, http.Header{"Cache-Control": {"no-store"}}), Equals, false)
+	c.Assert(storable(req, h), Equals, false)
+	c.Assert(storable(req, http.Header{"Vary": {"Accept, *"}}), Equals, false)
+
+	req.Header.Set("Cache-Control", "no-store")
+	c.Assert(storable(req, http.Header{}), Equals, false)
+
+	c.Assert(lifetime(http.Header{"Cache-Control": {"max-age=60"}}), Equals, time.Minute)
+	c.Assert(lifetime(http.Header{"Cache-Control": {"max-age=60, s-maxage=10"}}), Equals, 10*time.Second)
+	c.Assert(lifetime(http.Header{"Cache-Control": {"max-age=60, no-cache"}}), Equals, time.Duration(0))
+	c.Assert(lifetime(http.Header{
+		"Date":    {"Mon, 02 Jan 2006 15:04:05 GMT"},
+		"Expires": {"Mon, 02 Jan 2006 16:04:05 GMT"},
+	}), Equals, time.Hour)
+	c.Assert(lifetime(http.Header{}), Equals, time.Duration(0))
+
+	c.Assert(varyNames(http.Header{"Vary": {"accept-encoding, Accept", "X-User"}}),
+		DeepEquals, []string{"Accept", "Accept-Encoding", "X-User"})
+}
+
+func (s *testSuite) Test_Fresh(c *C) {
+	now := time.Now()
+	item := &store.Item{
+		Meta:           &store.Meta{RecordedAt: now.Add(-30 * time.Second)},
+		ResponseHeader: http.Header{"Cache-Control": {"max-age=60"}, "Age": {"10"}},
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	c.Assert(err, IsNil)
+
+	a, known := age(item, now)
+	c.Assert(known, Equals, true)
+	c.Assert(a, Equals, 40*time.Second)
+	c.Assert(fresh(item, req, now), Equals, true)
+	c.Assert(fresh(item, req, now.Add(time.Minute)), Equals, false)
+
+	req.Header.Set("Cache-Control", "max-age=20")
+	c.Assert(fresh(item, req, now), Equals, false)
+
+	req.Header.Set("Cache-Control", "no-cache")
+	c.Assert(fresh(item, req, now), Equals, false)
+
+	// the age of the old item is unknown
+	req.Header.Del("Cache-Control")
+	item.Meta = nil
+	c.Assert(fresh(item, req, now), Equals, false)
+}
+
+func (s *testSuite) TestHTTPCaching(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mx sync.Mutex
+	counters := map[string]int{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mx.Lock()
+		counters[r.URL.Path]++
+		n := counters[r.URL.Path]
+		mx.Unlock()
+
+		switch r.URL.Path {
+		case "/fresh":
+			w.Header().Set("Cache-Control", "max-age=60")
+			fmt.Fprintf(w, "fresh-%d", n)
+		case "/etag":
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			fmt.Fprintf(w, "etag-%d", n)
+		case "/no-store":
+			w.Header().Set("Cache-Control", "no-store")
+			fmt.Fprintf(w, "no-store-%d", n)
+		case "/vary":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Vary", "Accept-Language")
+			fmt.Fprintf(w, "vary-%s-%d", r.Header.Get("Accept-Language"), n)
+		}
+	}))
+	defer ts.Close()
+
+	dir, err := os.MkdirTemp(os.TempDir(), "httpcache")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	cfg := &config.Config{
+		Host:        ts.URL,
+		Scheme:      "http",
+		Port:        19212,
+		StorePath:   dir,
+		FileName:    "httpcache",
+		HTTPCaching: true,
+	}
+	c.Assert(Start(ctx, cfg), IsNil)
+
+	get := func(path, language string) (*http.Response, string) {
+		req, err := http.NewRequest(http.MethodGet, "http://127.0.0.1:19212"+path, nil)
+		c.Assert(err, IsNil)
+		if language != "" {
+			req.Header.Set("Accept-Language", language)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		c.Assert(err, IsNil)
+		return resp, string(body)
+	}
+
+	for i := 0; i < 3; i++ {
+		resp, body := get("/fresh", "")
+		c.Assert(body, Equals, "fresh-1")
+		if i > 0 {
+			c.Assert(resp.Header.Get("Age"), Equals, "0")
+		}
+
+		_, body = get("/etag", "")
+		c.Assert(body, Equals, "etag-1")
+
+		_, body = get("/no-store", "")
+		c.Assert(body, Equals, fmt.Sprintf("no-store-%d", i+1))
+
+		_, body = get("/vary", "en")
+		c.Assert(body, Equals, "vary-en-1")
+		_, body = get("/vary", "de")
+		c.Assert(body, Equals, "vary-de-2")
+	}
+
+	mx.Lock()
+	defer mx.Unlock()
+	c.Assert(counters, DeepEquals, map[string]int{"/fresh": 1, "/etag": 3, "/no-store": 3, "/vary": 2})
+}
@@ -0,0 +1,165 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	. "github.com/iostrovok/check"
+
+	"github.com/iostrovok/cacheproxy/cerrors"
+	"github.com/iostrovok/cacheproxy/config"
+	"github.com/iostrovok/cacheproxy/plugins/tiered"
+)
+
+func (s *testSuite) TestStartAll(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var counter int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s-%d", r.URL.Path, atomic.AddInt64(&counter, 1))
+	}))
+	defer upstream.Close()
+
+	dir := c.MkDir()
+	path := filepath.Join(dir, "proxy.yaml")
+	c.Assert(os.WriteFile(path, []byte(fmt.Sprintf(`
+host: %s
+store_path: %s
+keeper:
+  type: tiered
+  backend:
+    type: sqlite
+proxies:
+  - name: first
+    port: 19222
+    file_name: first
+  - name: second
+    port: 19223
+    file_name: second
+`, upstream.URL, dir)), 0o600), IsNil)
+
+	cfgs, err := config.Load(path)
+	c.Assert(err, IsNil)
+	c.Assert(StartAll(ctx, cfgs...), IsNil)
+
+	_, ok := cfgs[0].Keeper.(*tiered.Tiered)
+	c.Assert(ok, Equals, true)
+
+	get := func(port int, path string) string {
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://127.0.0.1:%d%s", port, path), nil)
+		c.Assert(err, IsNil)
+		status, body := doRequest(c, req)
+		c.Assert(status, Equals, http.StatusOK)
+		return body
+	}
+
+	for i := 0; i < 2; i++ {
+		c.Assert(get(19222, "/path"), Equals, "/path-1")
+		c.Assert(get(19223, "/path"), Equals, "/path-2")
+	}
+
+	// the failed proxy is reported by its name
+	bad := &config.Config{Name: "bad", Host: upstream.URL, Port: 19224, KeeperConfig: &config.KeeperConfig{Type: "none"}}
+	c.Assert(StartAll(ctx, bad), ErrorMatches, `proxy "bad": keeper.type: unknown keeper type "none".*`)
+
+	// configs are validated before any proxy is started
+	good := &config.Config{Name: "good", Host: upstream.URL, Port: 19228, StorePath: dir, FileName: "good"}
+	c.Assert(StartAll(ctx, good, bad), ErrorMatches, `proxy "bad": keeper.type: unknown keeper type "none".*`)
+	_, err = net.Dial("tcp", "127.0.0.1:19228")
+	c.Assert(err, NotNil)
+
+	// proxies are stopped with the context
+	stopCtx, stop := context.WithCancel(ctx)
+	c.Assert(StartAll(stopCtx, good), IsNil)
+	c.Assert(get(19228, "/stop"), Equals, "/stop-3")
+
+	stop()
+	again := &config.Config{Host: upstream.URL, Port: 19228, StorePath: dir, FileName: "good"}
+	c.Assert(Start(ctx, again), IsNil)
+	c.Assert(get(19228, "/stop"), Equals, "/stop-3")
+}
+
+func (s *testSuite) TestServe(c *C) {
+	var counter int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s-%d", r.URL.Path, atomic.AddInt64(&counter, 1))
+	}))
+	defer upstream.Close()
+
+	dir := c.MkDir()
+	get := func(path string) string {
+		req, err := http.NewRequest(http.MethodGet, "http://127.0.0.1:19233"+path, nil)
+		c.Assert(err, IsNil)
+		status, body := doRequest(c, req)
+		c.Assert(status, Equals, http.StatusOK)
+		return body
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cfg := &config.Config{Host: upstream.URL, Port: 19233, StorePath: dir, FileName: "serve",
+		KeeperConfig: &config.KeeperConfig{Type: "tiered", WriteBack: true, Backend: &config.KeeperConfig{Type: "sqlite"}}}
+
+	served := make(chan error)
+	go func() { served <- Serve(ctx, cfg) }()
+
+	var err error
+	for i := 0; i < 50; i++ {
+		var conn net.Conn
+		if conn, err = net.Dial("tcp", "127.0.0.1:19233"); err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(err, IsNil)
+	c.Assert(get("/path"), Equals, "/path-1")
+	c.Assert(cfg.Keeper.(*tiered.Tiered).Stats().Dirty, Equals, 1)
+
+	// data of the write-back cache is written when Serve returns
+	cancel()
+	c.Assert(<-served, IsNil)
+	c.Assert(cfg.Keeper.(*tiered.Tiered).Stats().Dirty, Equals, 0)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	c.Assert(Start(ctx, &config.Config{Host: upstream.URL, Port: 19233, StorePath: dir, FileName: "serve"}), IsNil)
+	c.Assert(get("/path"), Equals, "/path-1")
+}
+
+func (s *testSuite) TestStartErrors(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// nothing is started for the bad config
+	err := Start(ctx, &config.Config{Port: 19225})
+	c.Assert(errors.Is(err, cerrors.EmptyHost), Equals, true)
+
+	// bad certificates are reported by Start, not by the server goroutine
+	dir := c.MkDir()
+	pem, key := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	c.Assert(os.WriteFile(pem, []byte("not a certificate"), 0o600), IsNil)
+	c.Assert(os.WriteFile(key, []byte("not a key"), 0o600), IsNil)
+
+	err = Start(ctx, &config.Config{Host: "http://localhost:9200", Scheme: "https", PemPath: pem, KeyPath: key, Port: 19225})
+	c.Assert(err, ErrorMatches, ".*certificate.*")
+
+	// the busy admin port releases the port of the proxy
+	busy, err := net.Listen("tcp", ":19227")
+	c.Assert(err, IsNil)
+	defer busy.Close()
+
+	cfg := &config.Config{Host: "http://localhost:9200", Port: 19226, AdminPort: 19227, StorePath: dir, FileName: "admin"}
+	c.Assert(Start(ctx, cfg), NotNil)
+
+	cfg.AdminPort = 0
+	c.Assert(Start(ctx, cfg), IsNil)
+}
@@ -0,0 +1,37 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+
+	"github.com/iostrovok/cacheproxy/config"
+)
+
+type logKey struct{}
+
+// withLog returns the request with the logger in its context.
+func withLog(req *http.Request, log *slog.Logger) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), logKey{}, log))
+}
+
+// reqLog returns the logger of the request, every line of it has the request ID.
+func reqLog(cfg *config.Config, req *http.Request) *slog.Logger {
+	if log, ok := req.Context().Value(logKey{}).(*slog.Logger); ok {
+		return log
+	}
+	return cfg.Log()
+}
+
+// requestID returns X-Request-Id of the request or the new random ID.
+func requestID(req *http.Request) string {
+	if id := req.Header.Get("X-Request-Id"); id != "" {
+		return id
+	}
+
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,110 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+
+	. "github.com/iostrovok/check"
+
+	"github.com/iostrovok/cacheproxy/config"
+)
+
+// syncBuffer is the log output shared by goroutines of the server.
+type syncBuffer struct {
+	mx  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) lines() []map[string]any {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	out := make([]map[string]any, 0)
+	for _, line := range strings.Split(strings.TrimSpace(b.buf.String()), "\n") {
+		m := map[string]any{}
+		if json.Unmarshal([]byte(line), &m) == nil {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+func (s *testSuite) TestLog(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer ts.Close()
+
+	dir, err := os.MkdirTemp(os.TempDir(), "log")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	out := &syncBuffer{}
+	cfg := &config.Config{
+		Host:       ts.URL,
+		Scheme:     "http",
+		Port:       19218,
+		StorePath:  dir,
+		FileName:   "log",
+		LogHandler: slog.NewJSONHandler(out, &slog.HandlerOptions{Level: slog.LevelDebug}),
+	}
+	c.Assert(Start(ctx, cfg), IsNil)
+
+	for _, id := range []string{"req-1", "req-2"} {
+		req, err := http.NewRequest(http.MethodGet, "http://127.0.0.1:19218/path", nil)
+		c.Assert(err, IsNil)
+		req.Header.Set("X-Request-Id", id)
+		status, _ := doRequest(c, req)
+		c.Assert(status, Equals, http.StatusOK)
+	}
+
+	results := map[string]any{}
+	for _, line := range out.lines() {
+		if line["msg"] != "request" {
+			continue
+		}
+
+		c.Assert(line["level"], Equals, "INFO")
+		c.Assert(line["method"], Equals, http.MethodGet)
+		c.Assert(line["file"], Equals, "log")
+		c.Assert(line["key"], Not(Equals), "")
+		c.Assert(line["status"], Equals, float64(http.StatusOK))
+		results[line["request_id"].(string)] = line["result"]
+	}
+	c.Assert(results, DeepEquals, map[string]any{"req-1": ResultMiss, "req-2": ResultHit})
+
+	// the keeper writes to the same log
+	keeper := false
+	for _, line := range out.lines() {
+		keeper = keeper || strings.HasPrefix(line["msg"].(string), "sqlite plugin:")
+	}
+	c.Assert(keeper, Equals, true)
+}
+
+func doRequest(c *C, req *http.Request) (int, string) {
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+
+	buf := &bytes.Buffer{}
+	_, err = buf.ReadFrom(resp.Body)
+	c.Assert(err, IsNil)
+	return resp.StatusCode, buf.String()
+}
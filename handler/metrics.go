@@ -0,0 +1,57 @@
+package handler
+
+import (
+	"time"
+
+	"github.com/iostrovok/cacheproxy/config"
+	"github.com/iostrovok/cacheproxy/metrics"
+)
+
+var (
+	registry = metrics.NewRegistry()
+
+	requestsTotal = registry.Counter("cacheproxy_requests_total",
+		"Requests served by the proxy by result: hit, miss, stale, passthrough or error.", "proxy", "result")
+	servedBytes = registry.Counter("cacheproxy_served_bytes_total",
+		"Bytes of response bodies sent to clients by result.", "proxy", "result")
+	upstreamDuration = registry.Histogram("cacheproxy_upstream_duration_seconds",
+		"Time to response headers of upstream by status, the status is \"error\" if upstream is not reachable.", nil, "proxy", "status")
+	keeperDuration = registry.Histogram("cacheproxy_keeper_duration_seconds",
+		"Duration of keeper operations: read or save.", nil, "proxy", "op")
+	keeperErrors = registry.Counter("cacheproxy_keeper_errors_total",
+		"Failed keeper operations: read or save.", "proxy", "op")
+)
+
+// Metrics returns metrics of all proxies of the process in the Prometheus text format.
+// They're served by the admin API at /metrics too. The "proxy" label is config.Config.ProxyName,
+// files are not labels, so the number of series doesn't grow with the number of requests.
+func Metrics() *metrics.Registry {
+	return registry
+}
+
+func keeperRead(cfg *config.Config, fileName, key string) ([]byte, error) {
+	cfg.Logger.Printf("read file: %s, key: %s", fileName, key)
+
+	start := time.Now()
+	data, err := cfg.Keeper.Read(fileName, key)
+	observeKeeper(cfg, "read", start, err)
+
+	return data, err
+}
+
+func keeperSave(cfg *config.Config, fileName, key string, data []byte) error {
+	cfg.Logger.Printf("save file: %s, key: %s", fileName, key)
+
+	start := time.Now()
+	err := cfg.Keeper.Save(fileName, key, data)
+	observeKeeper(cfg, "save", start, err)
+
+	return err
+}
+
+func observeKeeper(cfg *config.Config, op string, start time.Time, err error) {
+	keeperDuration.Observe(time.Since(start).Seconds(), cfg.ProxyName(), op)
+	if err != nil {
+		keeperErrors.Inc(cfg.ProxyName(), op)
+	}
+}
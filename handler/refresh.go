@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/iostrovok/cacheproxy/config"
+)
+
+// upstreamError means that upstream is not reachable or it fails, nothing is sent to the client yet.
+type upstreamError struct {
+	err error
+}
+
+func (e *upstreamError) Error() string {
+	return e.err.Error()
+}
+
+func (e *upstreamError) Unwrap() error {
+	return e.err
+}
+
+// discardWriter is the client of the background loading.
+type discardWriter struct {
+	header http.Header
+}
+
+func (w *discardWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (w *discardWriter) WriteHeader(int) {}
+
+// refreshing keeps files and keys which are loaded in background now.
+var refreshing sync.Map
+
+// refresh loads the response from upstream and stores it in background.
+// The request is loaded once at the same time.
+func refresh(cfg *config.Config, ex *exchange) {
+	id := ex.fileName + "#--#" + ex.key
+	if _, busy := refreshing.LoadOrStore(id, true); busy {
+		return
+	}
+
+	// the body of the request is read twice: for the background loading and for the client
+	body, err := io.ReadAll(ex.req.Body)
+	if err != nil {
+		refreshing.Delete(id)
+		reqLog(cfg, ex.req).Error("background loading failed", "error", err)
+		return
+	}
+	ex.req.Body = io.NopCloser(bytes.NewReader(body))
+
+	bg := *ex
+	bg.req = ex.req.Clone(context.WithoutCancel(ex.req.Context()))
+	bg.req.Body = io.NopCloser(bytes.NewReader(body))
+
+	go func() {
+		defer refreshing.Delete(id)
+		if err := fetch(cfg, &discardWriter{header: http.Header{}}, &bg, nil); err != nil {
+			reqLog(cfg, bg.req).Error("background loading failed", "error", err)
+		}
+	}()
+}
@@ -0,0 +1,77 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+
+	. "github.com/iostrovok/check"
+
+	"github.com/iostrovok/cacheproxy/config"
+	"github.com/iostrovok/cacheproxy/plugins/sqlite"
+)
+
+func (s *testSuite) TestRoutes(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	upstream := func(name string) *httptest.Server {
+		var counter int64
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s%s-%d", name, r.URL.Path, atomic.AddInt64(&counter, 1))
+		}))
+	}
+
+	es, auth, main := upstream("es"), upstream("auth"), upstream("main")
+	defer es.Close()
+	defer auth.Close()
+	defer main.Close()
+
+	dir, err := os.MkdirTemp(os.TempDir(), "routes")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	authDir, err := os.MkdirTemp(os.TempDir(), "routes-auth")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(authDir)
+
+	authCfg := &config.Config{Host: auth.URL, FileName: "auth", StorePath: authDir}
+	authCfg.Keeper = sqlite.New(ctx, authCfg)
+
+	cfg := &config.Config{
+		Host:      main.URL,
+		Scheme:    "http",
+		Port:      19221,
+		StorePath: dir,
+		FileName:  "main",
+		Routes: []config.Route{
+			{Host: "auth.local", Config: authCfg},
+			{PathPrefix: "/es/", StripPrefix: true, Config: &config.Config{Host: es.URL, FileName: "es"}},
+		},
+	}
+	c.Assert(Start(ctx, cfg), IsNil)
+
+	get := func(host, path string) string {
+		req, err := http.NewRequest(http.MethodGet, "http://127.0.0.1:19221"+path, nil)
+		c.Assert(err, IsNil)
+		req.Host = host
+		status, body := doRequest(c, req)
+		c.Assert(status, Equals, http.StatusOK)
+		return body
+	}
+
+	for i := 0; i < 2; i++ {
+		c.Assert(get("", "/es/_search"), Equals, "es/_search-1")
+		c.Assert(get("auth.local:19221", "/es/login"), Equals, "auth/es/login-1")
+		c.Assert(get("", "/path"), Equals, "main/path-1")
+	}
+
+	// every route has its own file, the auth route has its own store path
+	for _, file := range []string{dir + "/es.db", dir + "/main.db", authDir + "/auth.db"} {
+		_, err := os.Stat(file)
+		c.Assert(err, IsNil, Commentf("%s", file))
+	}
+}
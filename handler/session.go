@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/iostrovok/cacheproxy/config"
+)
+
+// Results of interactions.
+const (
+	ResultHit         = "hit"
+	ResultMiss        = "miss"
+	ResultStale       = "stale"
+	ResultPassthrough = "passthrough"
+)
+
+// Interaction is the request served by the proxy, it's listed by the admin API.
+type Interaction struct {
+	Time     time.Time     `json:"time"`
+	Method   string        `json:"method"`
+	URL      string        `json:"url"`
+	FileName string        `json:"file_name,omitempty"`
+	Key      string        `json:"key,omitempty"`
+	Result   string        `json:"result,omitempty"`
+	Status   int           `json:"status"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// session is the runtime state of the running proxy: the current mode,
+// recent interactions and keys which are used since the start.
+type session struct {
+	mode atomic.Value // config.Mode
+
+	mx      sync.Mutex
+	history []Interaction
+	next    int
+	full    bool
+
+	used sync.Map // fileName#--#key
+}
+
+func newSession(cfg *config.Config) *session {
+	s := &session{history: make([]Interaction, cfg.AdminHistory)}
+	s.mode.Store(cfg.Mode)
+	return s
+}
+
+func (s *session) Mode() config.Mode {
+	return s.mode.Load().(config.Mode)
+}
+
+func (s *session) SetMode(mode config.Mode) {
+	s.mode.Store(mode)
+}
+
+// add keeps the interaction, the oldest one is dropped if the history is full.
+func (s *session) add(it Interaction) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.history[s.next] = it
+	s.next = (s.next + 1) % len(s.history)
+	s.full = s.full || s.next == 0
+}
+
+// recent returns up to limit last interactions, the newest one is the first.
+func (s *session) recent(limit int) []Interaction {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	size := s.next
+	if s.full {
+		size = len(s.history)
+	}
+	if limit <= 0 || limit > size {
+		limit = size
+	}
+
+	out := make([]Interaction, 0, limit)
+	for i := 1; i <= limit; i++ {
+		out = append(out, s.history[(s.next-i+len(s.history))%len(s.history)])
+	}
+
+	return out
+}
+
+func (s *session) use(fileName, key string) {
+	s.used.Store(fileName+"#--#"+key, true)
+}
+
+func (s *session) isUsed(fileName, key string) bool {
+	_, find := s.used.Load(fileName + "#--#" + key)
+	return find
+}
+
+func (s *session) forget(fileName, key string) {
+	s.used.Delete(fileName + "#--#" + key)
+}
@@ -0,0 +1,74 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	. "github.com/iostrovok/check"
+
+	"github.com/iostrovok/cacheproxy/config"
+	"github.com/iostrovok/cacheproxy/signer"
+)
+
+func (s *testSuite) TestSigner(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sig := &signer.HMAC{
+		Secret: []byte("secret"),
+		Now:    func() time.Time { return time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC) },
+	}
+
+	var counter int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		c.Check(err, IsNil)
+
+		// the request is checked as upstream does it
+		check, err := http.NewRequest(r.Method, "http://"+r.Host+r.RequestURI, nil)
+		c.Check(err, IsNil)
+		c.Check(sig.Sign(check, body), IsNil)
+
+		if r.Header.Get("Authorization") != check.Header.Get("Authorization") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprintf(w, "%s-%d", body, atomic.AddInt64(&counter, 1))
+	}))
+	defer ts.Close()
+
+	dir, err := os.MkdirTemp(os.TempDir(), "signer")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	cfg := &config.Config{
+		Host:      ts.URL,
+		Scheme:    "http",
+		Port:      19220,
+		StorePath: dir,
+		FileName:  "signer",
+		Signer:    sig,
+	}
+	c.Assert(Start(ctx, cfg), IsNil)
+
+	// the client signs every request for the proxy by its own time
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:19220/path?a=1", strings.NewReader("body"))
+		c.Assert(err, IsNil)
+		req.Header.Set("Authorization", fmt.Sprintf("client-signature-%d", i))
+		req.Header.Set("X-Timestamp", fmt.Sprintf("%d", i))
+
+		status, body := doRequest(c, req)
+		c.Assert(status, Equals, http.StatusOK)
+		c.Assert(body, Equals, "body-1")
+	}
+
+	c.Assert(atomic.LoadInt64(&counter), Equals, int64(1))
+}
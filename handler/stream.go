@@ -0,0 +1,123 @@
+package handler
+
+import (
+	"context"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/iostrovok/cacheproxy/config"
+	"github.com/iostrovok/cacheproxy/store"
+)
+
+const streamBufferSize = 32 * 1024
+
+// isStream reports whether the response should be recorded chunk by chunk.
+func isStream(cfg *config.Config, resp *http.Response) bool {
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err == nil {
+		for _, t := range cfg.StreamContentTypes {
+			if strings.EqualFold(mediaType, t) {
+				return true
+			}
+		}
+	}
+
+	return cfg.StreamChunked && resp.ContentLength < 0
+}
+
+func flush(w http.ResponseWriter) {
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// streamMark is the time offset and the size of the spooled chunk.
+type streamMark struct {
+	offset time.Duration
+	size   int
+}
+
+// pipeStream sends every chunk of the response to the client as soon as it's got,
+// chunks are written to the spool and their time offsets are returned. Nothing is recorded if the spool is nil.
+// Any error of reading from upstream is returned, so the broken stream is never stored.
+func pipeStream(w http.ResponseWriter, resp *http.Response, sp *spool) ([]streamMark, error) {
+	client := &clientWriter{w: w}
+	start := time.Now()
+	buf := make([]byte, streamBufferSize)
+
+	var marks []streamMark
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if sp != nil {
+				if _, err := sp.Write(buf[:n]); err != nil {
+					return nil, err
+				}
+				marks = append(marks, streamMark{offset: time.Since(start), size: n})
+			}
+
+			client.Write(buf[:n])
+			if client.err == nil {
+				flush(w)
+			}
+		}
+
+		if err == io.EOF {
+			return marks, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// storeStream puts the spooled stream into the item chunk by chunk with their time offsets.
+// The stream larger than MaxInlineBodySize is stored as the ordinary body without timing (see storeBody),
+// so long chunked responses are never kept in memory.
+func storeStream(cfg *config.Config, item *store.Item, sp *spool, marks []streamMark, fileName string) error {
+	if sp.size > cfg.MaxInlineBodySize {
+		return storeBody(cfg, item, sp, fileName)
+	}
+
+	item.BodySize = sp.size
+	if _, err := sp.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	for _, mark := range marks {
+		data := make([]byte, mark.size)
+		if _, err := io.ReadFull(sp.file, data); err != nil {
+			return err
+		}
+		item.Chunks = append(item.Chunks, store.Chunk{Offset: mark.offset, Data: data})
+	}
+
+	return nil
+}
+
+// writeStream replays the recorded stream chunk by chunk.
+func writeStream(ctx context.Context, cfg *config.Config, w http.ResponseWriter, item *store.Item) error {
+	last := time.Duration(0)
+	for _, chunk := range item.Chunks {
+		if delay := cfg.StreamDelay(chunk.Offset - last); delay > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			case <-timer.C:
+			}
+		}
+		last = chunk.Offset
+
+		if _, err := w.Write(chunk.Data); err != nil {
+			return err
+		}
+		flush(w)
+	}
+
+	return nil
+}
@@ -0,0 +1,326 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iostrovok/cacheproxy/config"
+	"github.com/iostrovok/cacheproxy/store"
+)
+
+var (
+	errNotWebSocket = errors.New("stored websocket conversation can't be replayed for not websocket request")
+	errNoHijacker   = errors.New("connection doesn't support hijacking")
+)
+
+// isWebSocket reports whether the request is the websocket handshake.
+func isWebSocket(req *http.Request) bool {
+	return strings.EqualFold(req.Header.Get("Upgrade"), "websocket") &&
+		headerContains(req.Header, "Connection", "upgrade")
+}
+
+func headerContains(h http.Header, name, value string) bool {
+	for _, v := range h.Values(name) {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func dialUpstream(cfg *config.Config) (net.Conn, error) {
+	host := cfg.URL.Host
+	secure := cfg.URL.Scheme == "https" || cfg.URL.Scheme == "wss"
+
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		if secure {
+			host = net.JoinHostPort(host, "443")
+		} else {
+			host = net.JoinHostPort(host, "80")
+		}
+	}
+
+	if secure {
+		return tls.Dial("tcp", host, &tls.Config{ServerName: cfg.URL.Hostname()})
+	}
+
+	return net.Dial("tcp", host)
+}
+
+// transcript collects websocket frames of both sides.
+type transcript struct {
+	sync.Mutex
+	start    time.Time
+	messages []store.Message
+}
+
+func (t *transcript) add(direction store.Direction, f *wsFrame) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.messages = append(t.messages, store.Message{
+		Direction: direction,
+		Opcode:    f.opcode,
+		Fin:       f.fin,
+		Payload:   f.payload,
+		Offset:    time.Since(t.start),
+	})
+}
+
+// pipeFrames passes frames from one side to other one and records them.
+// It works until the connection is closed, so the closing handshake is passed too.
+func pipeFrames(dst io.Writer, src io.Reader, t *transcript, direction store.Direction) error {
+	for {
+		f, err := readFrame(src)
+		if err != nil {
+			return err
+		}
+
+		t.add(direction, f)
+		if _, err := dst.Write(f.raw); err != nil {
+			return err
+		}
+	}
+}
+
+// recordWebSocket proxies the websocket conversation to upstream and returns it as the item.
+// The nil item is returned if upstream doesn't switch protocols, the response is sent to the client as is.
+func recordWebSocket(cfg *config.Config, w http.ResponseWriter, req *http.Request, requestDump []byte) (*store.Item, error) {
+	upstream, err := dialUpstream(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer upstream.Close()
+
+	out := req.Clone(req.Context())
+	out.RequestURI = ""
+	// compressed frames can't be replayed for other client, so extensions are not used
+	out.Header.Del("Sec-WebSocket-Extensions")
+	if err := sign(cfg, out); err != nil {
+		return nil, err
+	}
+
+	if err := out.Write(upstream); err != nil {
+		return nil, err
+	}
+
+	upReader := bufio.NewReader(upstream)
+	resp, err := http.ReadResponse(upReader, out)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		defer resp.Body.Close()
+		copyHeader(w.Header(), resp.Header)
+		w.WriteHeader(resp.StatusCode)
+		_, err := io.Copy(w, resp.Body)
+		return nil, err
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errNoHijacker
+	}
+
+	client, clientRW, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	if err := writeSwitchingProtocols(clientRW.Writer, resp.Header); err != nil {
+		return nil, err
+	}
+
+	t := &transcript{start: time.Now()}
+	errs := make(chan error, 2)
+	go func() {
+		errs <- pipeFrames(upstream, clientRW.Reader, t, store.FromClient)
+	}()
+	go func() {
+		errs <- pipeFrames(client, upReader, t, store.FromServer)
+	}()
+
+	// the end of one side closes the conversation
+	err = <-errs
+	client.Close()
+	upstream.Close()
+	<-errs
+
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+		return nil, err
+	}
+
+	return &store.Item{
+		Meta:           &store.Meta{Proto: resp.Proto, ContentLength: -1},
+		Type:           store.TypeWebSocket,
+		Request:        requestDump,
+		ResponseHeader: resp.Header,
+		StatusCode:     resp.StatusCode,
+		Messages:       t.messages,
+	}, nil
+}
+
+// replayWebSocket serves the handshake and sends the recorded server messages.
+// The messages which follow the client message are sent after the client sends the same message.
+func replayWebSocket(cfg *config.Config, w http.ResponseWriter, req *http.Request, item *store.Item) error {
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if !isWebSocket(req) || key == "" {
+		return errNotWebSocket
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return errNoHijacker
+	}
+
+	client, clientRW, err := hj.Hijack()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	header := item.ResponseHeader.Clone()
+	header.Set("Sec-WebSocket-Accept", wsAccept(key))
+	if err := writeSwitchingProtocols(clientRW.Writer, header); err != nil {
+		return err
+	}
+
+	// the client is read in background, so the closed connection stops waiting for delays
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	frames := readFrames(ctx, clientRW.Reader, cancel)
+
+	last := time.Duration(0)
+	for i := 0; i < len(item.Messages); {
+		m := item.Messages[i]
+
+		if m.Direction == store.FromServer {
+			if delay := cfg.StreamDelay(m.Offset - last); delay > 0 {
+				timer := time.NewTimer(delay)
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return nil
+				case <-timer.C:
+				}
+			}
+			last = m.Offset
+
+			if err := writeFrame(client, m.Fin, m.Opcode, m.Payload); err != nil {
+				return err
+			}
+			if m.Opcode == wsClose {
+				return nil
+			}
+			i++
+			continue
+		}
+
+		f, err := frames.next()
+		if err != nil {
+			return ignoreClosed(err)
+		}
+
+		switch f.opcode {
+		case wsClose:
+			return writeFrame(client, true, wsClose, f.payload)
+		case wsPing:
+			if err := writeFrame(client, true, wsPong, f.payload); err != nil {
+				return err
+			}
+			continue
+		case wsPong:
+			continue
+		}
+
+		// the server messages are sent after the matched client message
+		if next := matchClientMessage(item.Messages[i:], f); next >= 0 {
+			i += next + 1
+			last = item.Messages[i-1].Offset
+		} else {
+			reqLog(cfg, req).Warn("unexpected websocket message", "payload", string(f.payload))
+		}
+	}
+
+	// the transcript is over, wait for the client closing
+	for {
+		f, err := frames.next()
+		if err != nil {
+			return ignoreClosed(err)
+		}
+		if f.opcode == wsClose {
+			return writeFrame(client, true, wsClose, f.payload)
+		}
+	}
+}
+
+// frameReader reads frames of the client in background.
+type frameReader struct {
+	frames chan *wsFrame
+	err    error // the error of reading, it's set before frames is closed
+}
+
+// readFrames reads frames until the error or the end of the context, cancel is called on the error.
+func readFrames(ctx context.Context, r io.Reader, cancel context.CancelFunc) *frameReader {
+	fr := &frameReader{frames: make(chan *wsFrame)}
+	go func() {
+		defer close(fr.frames)
+		for {
+			f, err := readFrame(r)
+			if err != nil {
+				fr.err = err
+				cancel()
+				return
+			}
+
+			select {
+			case fr.frames <- f:
+			case <-ctx.Done():
+				fr.err = ctx.Err()
+				return
+			}
+		}
+	}()
+
+	return fr
+}
+
+// next returns the next frame of the client.
+func (fr *frameReader) next() (*wsFrame, error) {
+	f, ok := <-fr.frames
+	if !ok {
+		return nil, fr.err
+	}
+	return f, nil
+}
+
+// matchClientMessage returns the index of the first client message which is equal to the frame.
+func matchClientMessage(messages []store.Message, f *wsFrame) int {
+	for i, m := range messages {
+		if m.Direction == store.FromClient && !isControlOpcode(m.Opcode) &&
+			m.Opcode == f.opcode && bytes.Equal(m.Payload, f.payload) {
+			return i
+		}
+	}
+	return -1
+}
+
+func ignoreClosed(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,155 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"time"
+
+	. "github.com/iostrovok/check"
+
+	"github.com/iostrovok/cacheproxy/config"
+	"github.com/iostrovok/cacheproxy/store"
+)
+
+// echoWebSocket is the upstream which answers "echo: <message>" for every text message.
+func echoWebSocket(c *C, counter *int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		*counter++
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		c.Assert(err, IsNil)
+		defer conn.Close()
+
+		header := http.Header{}
+		header.Set("Upgrade", "websocket")
+		header.Set("Connection", "Upgrade")
+		header.Set("Sec-WebSocket-Accept", wsAccept(r.Header.Get("Sec-WebSocket-Key")))
+		c.Assert(writeSwitchingProtocols(rw.Writer, header), IsNil)
+
+		for {
+			f, err := readFrame(rw.Reader)
+			if err != nil {
+				return
+			}
+			if f.opcode == wsClose {
+				writeFrame(conn, true, wsClose, f.payload)
+				return
+			}
+			writeFrame(conn, true, wsText, append([]byte("echo: "), f.payload...))
+		}
+	}
+}
+
+// writeClientFrame writes the masked frame as a client does.
+func writeClientFrame(conn net.Conn, opcode byte, payload []byte) error {
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{0x80 | opcode, 0x80 | byte(len(payload))}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	_, err := conn.Write(frame)
+	return err
+}
+
+func webSocketSession(c *C, port int) []string {
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	key := "dGhlIHNhbXBsZSBub25jZQ=="
+	fmt.Fprintf(conn, "GET /ws HTTP/1.1\r\nHost: 127.0.0.1\r\nUpgrade: websocket\r\n"+
+		"Connection: Upgrade\r\nSec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n", key)
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, http.StatusSwitchingProtocols)
+	c.Assert(resp.Header.Get("Sec-WebSocket-Accept"), Equals, wsAccept(key))
+
+	out := make([]string, 0)
+	for _, msg := range []string{"hello", "world"} {
+		c.Assert(writeClientFrame(conn, wsText, []byte(msg)), IsNil)
+		f, err := readFrame(reader)
+		c.Assert(err, IsNil)
+		out = append(out, string(f.payload))
+	}
+
+	code := make([]byte, 2)
+	binary.BigEndian.PutUint16(code, 1000)
+	c.Assert(writeClientFrame(conn, wsClose, code), IsNil)
+	f, err := readFrame(reader)
+	c.Assert(err, IsNil)
+	c.Assert(f.opcode, Equals, wsClose)
+
+	return out
+}
+
+func (s *testSuite) TestWebSocket(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	counter := 0
+	ts := httptest.NewServer(echoWebSocket(c, &counter))
+	defer ts.Close()
+
+	dir, err := os.MkdirTemp(os.TempDir(), "ws")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	cfg := &config.Config{
+		Host:      ts.URL,
+		Scheme:    "http",
+		Port:      19210,
+		StorePath: dir,
+		FileName:  "websocket",
+	}
+	c.Assert(Start(ctx, cfg), IsNil)
+
+	c.Assert(webSocketSession(c, 19210), DeepEquals, []string{"echo: hello", "echo: world"})
+
+	// the transcript is saved after the connection is closed
+	time.Sleep(100 * time.Millisecond)
+
+	c.Assert(webSocketSession(c, 19210), DeepEquals, []string{"echo: hello", "echo: world"})
+	c.Assert(counter, Equals, 1)
+}
+
+func (s *testSuite) TestWebSocketReplayDisconnect(c *C) {
+	cfg := &config.Config{StreamTiming: config.StreamTimingOriginal}
+	item := &store.Item{
+		ResponseHeader: http.Header{"Upgrade": {"websocket"}, "Connection": {"Upgrade"}},
+		Messages: []store.Message{
+			{Direction: store.FromServer, Opcode: wsText, Fin: true, Payload: []byte("late"), Offset: time.Minute},
+		},
+	}
+
+	done := make(chan error, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		done <- replayWebSocket(cfg, w, r, item)
+	}))
+	defer ts.Close()
+
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	c.Assert(err, IsNil)
+	fmt.Fprint(conn, "GET /ws HTTP/1.1\r\nHost: 127.0.0.1\r\nUpgrade: websocket\r\n"+
+		"Connection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, http.StatusSwitchingProtocols)
+
+	// the client goes away, so the replay doesn't wait for the recorded delay
+	conn.Close()
+	select {
+	case err := <-done:
+		c.Assert(err, IsNil)
+	case <-time.After(5 * time.Second):
+		c.Fatal("replay waits for the closed client")
+	}
+}
@@ -0,0 +1,150 @@
+package handler
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// websocket opcodes, see RFC 6455
+const (
+	wsContinuation byte = 0x0
+	wsText         byte = 0x1
+	wsBinary       byte = 0x2
+	wsClose        byte = 0x8
+	wsPing         byte = 0x9
+	wsPong         byte = 0xA
+)
+
+const (
+	wsGUID         = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	wsMaxFrameSize = 64 << 20
+)
+
+var errWsFrameTooLarge = errors.New("websocket frame is too large")
+
+func isControlOpcode(opcode byte) bool {
+	return opcode&0x8 != 0
+}
+
+// writeSwitchingProtocols writes the successful response to the websocket handshake.
+func writeSwitchingProtocols(w *bufio.Writer, header http.Header) error {
+	fmt.Fprintf(w, "HTTP/1.1 %d %s\r\n", http.StatusSwitchingProtocols, http.StatusText(http.StatusSwitchingProtocols))
+	if err := header.Write(w); err != nil {
+		return err
+	}
+	if _, err := w.WriteString("\r\n"); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+type wsFrame struct {
+	fin     bool
+	opcode  byte
+	payload []byte // unmasked payload
+
+	// frame as is, it's passed to the other side without changes
+	raw []byte
+}
+
+// readFrame reads one websocket frame.
+func readFrame(r io.Reader) (*wsFrame, error) {
+	head := make([]byte, 2, 14)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+
+	f := &wsFrame{
+		fin:    head[0]&0x80 != 0,
+		opcode: head[0] & 0x0f,
+	}
+
+	masked := head[1]&0x80 != 0
+	size := uint64(head[1] & 0x7f)
+
+	ext := 0
+	switch size {
+	case 126:
+		ext = 2
+	case 127:
+		ext = 8
+	}
+	if masked {
+		ext += 4
+	}
+
+	head = head[:2+ext]
+	if _, err := io.ReadFull(r, head[2:]); err != nil {
+		return nil, err
+	}
+
+	switch size {
+	case 126:
+		size = uint64(binary.BigEndian.Uint16(head[2:4]))
+	case 127:
+		size = binary.BigEndian.Uint64(head[2:10])
+	}
+
+	if size > wsMaxFrameSize {
+		return nil, errWsFrameTooLarge
+	}
+
+	f.raw = make([]byte, len(head)+int(size))
+	copy(f.raw, head)
+	if _, err := io.ReadFull(r, f.raw[len(head):]); err != nil {
+		return nil, err
+	}
+
+	f.payload = make([]byte, size)
+	copy(f.payload, f.raw[len(head):])
+	if masked {
+		mask := head[len(head)-4:]
+		for i := range f.payload {
+			f.payload[i] ^= mask[i%4]
+		}
+	}
+
+	return f, nil
+}
+
+// writeFrame writes one unmasked (server) websocket frame.
+func writeFrame(w io.Writer, fin bool, opcode byte, payload []byte) error {
+	head := make([]byte, 2, 10)
+	head[0] = opcode & 0x0f
+	if fin {
+		head[0] |= 0x80
+	}
+
+	size := len(payload)
+	switch {
+	case size < 126:
+		head[1] = byte(size)
+	case size <= 0xffff:
+		head[1] = 126
+		head = head[:4]
+		binary.BigEndian.PutUint16(head[2:], uint16(size))
+	default:
+		head[1] = 127
+		head = head[:10]
+		binary.BigEndian.PutUint64(head[2:], uint64(size))
+	}
+
+	if _, err := w.Write(head); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// wsAccept returns the value of Sec-WebSocket-Accept header for the client's key.
+func wsAccept(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
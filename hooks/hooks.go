@@ -0,0 +1,105 @@
+package hooks
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/iostrovok/cacheproxy/store"
+)
+
+// ErrSkip returned by BeforeSave means that the item is not stored, the response is sent to the client anyway.
+var ErrSkip = errors.New("skip")
+
+// Hook intercepts processing of requests. Every method may change its arguments,
+// the error stops processing of the request and it's returned to the client (503).
+// Embed Base to implement some methods only.
+type Hook interface {
+	// BeforeKey is called before the cache key is made by the request of the client.
+	// For example, volatile headers or query parameters may be removed here.
+	BeforeKey(req *http.Request) error
+
+	// OnMiss is called if the stored response is not found.
+	OnMiss(req *http.Request) error
+
+	// BeforeUpstream is called before the request is sent to upstream, websocket connections are not passed here.
+	// The not nil response is used instead of the upstream one.
+	BeforeUpstream(req *http.Request) (*http.Response, error)
+
+	// AfterUpstream is called when the response headers are got from upstream,
+	// the response is sent to the client and stored after it.
+	AfterUpstream(resp *http.Response) error
+
+	// BeforeSave is called before the item is stored, ErrSkip means that the item is not stored.
+	BeforeSave(item *store.Item) error
+
+	// BeforeReplay is called before the stored item is sent to the client.
+	BeforeReplay(item *store.Item, req *http.Request) error
+}
+
+// Base is the hook which does nothing.
+type Base struct{}
+
+func (Base) BeforeKey(*http.Request) error                        { return nil }
+func (Base) OnMiss(*http.Request) error                           { return nil }
+func (Base) BeforeUpstream(*http.Request) (*http.Response, error) { return nil, nil }
+func (Base) AfterUpstream(*http.Response) error                   { return nil }
+func (Base) BeforeSave(*store.Item) error                         { return nil }
+func (Base) BeforeReplay(*store.Item, *http.Request) error        { return nil }
+
+// Chain calls hooks in order, the first error stops the chain.
+type Chain []Hook
+
+func (c Chain) BeforeKey(req *http.Request) error {
+	for _, h := range c {
+		if err := h.BeforeKey(req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c Chain) OnMiss(req *http.Request) error {
+	for _, h := range c {
+		if err := h.OnMiss(req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BeforeUpstream stops the chain on the first not nil response too.
+func (c Chain) BeforeUpstream(req *http.Request) (*http.Response, error) {
+	for _, h := range c {
+		if resp, err := h.BeforeUpstream(req); resp != nil || err != nil {
+			return resp, err
+		}
+	}
+	return nil, nil
+}
+
+func (c Chain) AfterUpstream(resp *http.Response) error {
+	for _, h := range c {
+		if err := h.AfterUpstream(resp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c Chain) BeforeSave(item *store.Item) error {
+	for _, h := range c {
+		if err := h.BeforeSave(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c Chain) BeforeReplay(item *store.Item, req *http.Request) error {
+	for _, h := range c {
+		if err := h.BeforeReplay(item, req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package hooks
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	. "github.com/iostrovok/check"
+
+	"github.com/iostrovok/cacheproxy/store"
+)
+
+type testSuite struct{}
+
+var _ = Suite(&testSuite{})
+
+func TestService(t *testing.T) { TestingT(t) }
+
+type tag struct {
+	Base
+	name  string
+	calls *[]string
+	resp  *http.Response
+	err   error
+}
+
+func (t *tag) BeforeKey(*http.Request) error {
+	*t.calls = append(*t.calls, t.name)
+	return t.err
+}
+
+func (t *tag) BeforeUpstream(*http.Request) (*http.Response, error) {
+	*t.calls = append(*t.calls, t.name)
+	return t.resp, t.err
+}
+
+func (t *tag) BeforeSave(item *store.Item) error {
+	item.StatusCode++
+	return nil
+}
+
+func (s *testSuite) TestChain(c *C) {
+	calls := make([]string, 0)
+	stop := errors.New("stop")
+	resp := &http.Response{StatusCode: http.StatusTeapot}
+
+	chain := Chain{&tag{name: "a", calls: &calls}, &tag{name: "b", calls: &calls, err: stop}, &tag{name: "c", calls: &calls}}
+	c.Assert(chain.BeforeKey(nil), Equals, stop)
+	c.Assert(calls, DeepEquals, []string{"a", "b"})
+
+	calls = calls[:0]
+	chain = Chain{&tag{name: "a", calls: &calls}, &tag{name: "b", calls: &calls, resp: resp}, &tag{name: "c", calls: &calls}}
+	out, err := chain.BeforeUpstream(nil)
+	c.Assert(err, IsNil)
+	c.Assert(out, Equals, resp)
+	c.Assert(calls, DeepEquals, []string{"a", "b"})
+
+	item := &store.Item{}
+	c.Assert(chain.BeforeSave(item), IsNil)
+	c.Assert(item.StatusCode, Equals, 3)
+
+	// the empty chain does nothing
+	c.Assert(Chain(nil).OnMiss(nil), IsNil)
+	c.Assert(Chain(nil).BeforeReplay(item, nil), IsNil)
+}
@@ -1,14 +1,28 @@
 package logger
 
 import (
+	"context"
+	"fmt"
+	"log/slog"
+
 	"github.com/iostrovok/cacheproxy/plugins"
 )
 
 type Logger struct {
+	log *slog.Logger
 }
 
 func New() plugins.ILogger {
 	return &Logger{}
 }
 
-func (p *Logger) Printf(_ string, v ...interface{}) {}
+// FromSlog returns the logger which passes lines to the structured logger with slog.LevelDebug.
+func FromSlog(log *slog.Logger) plugins.ILogger {
+	return &Logger{log: log}
+}
+
+func (p *Logger) Printf(format string, v ...interface{}) {
+	if p.log != nil && p.log.Enabled(context.Background(), slog.LevelDebug) {
+		p.log.Debug(fmt.Sprintf(format, v...))
+	}
+}
@@ -0,0 +1,261 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+	Metrics are counters and histograms with labels which are written in the Prometheus text format:
+	https://prometheus.io/docs/instrumenting/exposition_formats/
+*/
+
+// DefaultBuckets are upper bounds of histogram buckets in seconds.
+var DefaultBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// ContentType is the content type of the Prometheus text format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+// Registry keeps metrics in order of registration.
+type Registry struct {
+	mx      sync.Mutex
+	metrics []metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) add(m metric) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+// Counter adds the new counter to the registry.
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	c := &Counter{desc: desc{name: name, help: help, labels: labels}, values: map[string]*counterValue{}}
+	r.add(c)
+	return c
+}
+
+// Histogram adds the new histogram to the registry, DefaultBuckets are used if buckets are empty.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	buckets = append([]float64{}, buckets...)
+	sort.Float64s(buckets)
+
+	h := &Histogram{desc: desc{name: name, help: help, labels: labels}, buckets: buckets, values: map[string]*histogramValue{}}
+	r.add(h)
+	return h
+}
+
+// WriteText writes all metrics in the Prometheus text format.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mx.Lock()
+	list := append([]metric{}, r.metrics...)
+	r.mx.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range list {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+// ServeHTTP serves metrics for the Prometheus scraper.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	_ = r.WriteText(w)
+}
+
+type desc struct {
+	name, help string
+	labels     []string
+}
+
+func (d *desc) header(w *bufio.Writer, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, kind)
+}
+
+// id joins label values into the map key, missed values are empty.
+func (d *desc) id(values []string) (string, []string) {
+	out := make([]string, len(d.labels))
+	copy(out, values)
+	return strings.Join(out, "\xff"), out
+}
+
+// pairs returns labels as `{name="value",...}`, extra is added to the end.
+func (d *desc) pairs(values []string, extra ...string) string {
+	parts := make([]string, 0, len(d.labels)+1)
+	for i, name := range d.labels {
+		parts = append(parts, name+`="`+escape(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		parts = append(parts, extra[i]+`="`+escape(extra[i+1])+`"`)
+	}
+
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func escape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func format(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Counter is the monotonically increasing value by label values.
+type Counter struct {
+	desc
+	mx     sync.Mutex
+	values map[string]*counterValue
+}
+
+type counterValue struct {
+	labels []string
+	value  float64
+}
+
+// Inc adds 1 to the counter with the label values in order of labels.
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds v to the counter with the label values in order of labels.
+func (c *Counter) Add(v float64, values ...string) {
+	id, labels := c.id(values)
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	cv, find := c.values[id]
+	if !find {
+		cv = &counterValue{labels: labels}
+		c.values[id] = cv
+	}
+	cv.value += v
+}
+
+// Value returns the current value of the counter with the label values.
+func (c *Counter) Value(values ...string) float64 {
+	id, _ := c.id(values)
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if cv, find := c.values[id]; find {
+		return cv.value
+	}
+	return 0
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	c.header(w, "counter")
+	for _, id := range sortedKeys(c.values) {
+		cv := c.values[id]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.pairs(cv.labels), format(cv.value))
+	}
+}
+
+// Histogram counts observed values by buckets.
+type Histogram struct {
+	desc
+	buckets []float64
+	mx      sync.Mutex
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labels []string
+	counts []uint64 // not cumulative, the last one is +Inf
+	sum    float64
+	count  uint64
+}
+
+// Observe adds the value to the histogram with the label values in order of labels.
+func (h *Histogram) Observe(v float64, values ...string) {
+	id, labels := h.id(values)
+
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	hv, find := h.values[id]
+	if !find {
+		hv = &histogramValue{labels: labels, counts: make([]uint64, len(h.buckets)+1)}
+		h.values[id] = hv
+	}
+
+	hv.counts[sort.SearchFloat64s(h.buckets, v)]++
+	hv.sum += v
+	hv.count++
+}
+
+// Count returns the number of observed values with the label values.
+func (h *Histogram) Count(values ...string) uint64 {
+	id, _ := h.id(values)
+
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	if hv, find := h.values[id]; find {
+		return hv.count
+	}
+	return 0
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	h.header(w, "histogram")
+	for _, id := range sortedKeys(h.values) {
+		hv := h.values[id]
+
+		total := uint64(0)
+		for i, count := range hv.counts {
+			total += count
+			le := math.Inf(1)
+			if i < len(h.buckets) {
+				le = h.buckets[i]
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.pairs(hv.labels, "le", format(le)), total)
+		}
+
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.pairs(hv.labels), format(hv.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.pairs(hv.labels), hv.count)
+	}
+}
@@ -0,0 +1,46 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+
+	. "github.com/iostrovok/check"
+)
+
+type testSuite struct{}
+
+var _ = Suite(&testSuite{})
+
+func TestService(t *testing.T) { TestingT(t) }
+
+func (s *testSuite) TestWriteText(c *C) {
+	r := NewRegistry()
+
+	requests := r.Counter("requests_total", "Requests by result.", "file", "result")
+	requests.Inc("my\"file", "hit")
+	requests.Inc("my\"file", "hit")
+	requests.Add(3, "a", "miss")
+	c.Assert(requests.Value("my\"file", "hit"), Equals, float64(2))
+	c.Assert(requests.Value("b", "hit"), Equals, float64(0))
+
+	duration := r.Histogram("duration_seconds", "Duration.", []float64{1, 0.1})
+	duration.Observe(0.05)
+	duration.Observe(0.5)
+	duration.Observe(2)
+	c.Assert(duration.Count(), Equals, uint64(3))
+
+	buf := &bytes.Buffer{}
+	c.Assert(r.WriteText(buf), IsNil)
+	c.Assert(buf.String(), Equals, `# HELP requests_total Requests by result.
+# TYPE requests_total counter
+requests_total{file="a",result="miss"} 3
+requests_total{file="my\"file",result="hit"} 2
+# HELP duration_seconds Duration.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{le="0.1"} 1
+duration_seconds_bucket{le="1"} 2
+duration_seconds_bucket{le="+Inf"} 3
+duration_seconds_sum 2.55
+duration_seconds_count 3
+`)
+}
@@ -0,0 +1,352 @@
+package crypt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/iostrovok/cacheproxy/cerrors"
+	"github.com/iostrovok/cacheproxy/plugins"
+	"github.com/iostrovok/cacheproxy/store"
+)
+
+/*
+	Crypt encrypts data of any plugin by AES-GCM.
+
+	The stored record is
+		magic (4 bytes) | format (1 byte) | length of the key ID (1 byte) | key ID | nonce (12 bytes) | ciphertext
+
+	The key ID is stored per record, so the new key is added as the primary one and old records
+	are read by old keys until they are re-recorded. Records without the magic prefix are plain
+	(written before the encryption is switched on) and are returned as is.
+*/
+
+// DefaultEnv is the environment variable with keys, see ParseKeys.
+const DefaultEnv = "CACHEPROXY_KEYS"
+
+const format byte = 1
+
+var magic = []byte("CPXE")
+
+var (
+	ErrNoKeys     = errors.New("crypt plugin: no keys")
+	ErrUnknownKey = errors.New("crypt plugin: unknown key ID")
+	ErrBadRecord  = errors.New("crypt plugin: broken record")
+)
+
+// Key is the named AES key, its length is 16, 24 or 32 bytes.
+type Key struct {
+	ID  string
+	Key []byte
+}
+
+type Config struct {
+	// Keys are used to read data, the first key encrypts new data.
+	Keys []Key
+
+	// Env is the environment variable with keys, it's used if Keys and KeyFile are empty. DefaultEnv by default.
+	Env string
+
+	// KeyFile is the file with keys, it's used if Keys is empty.
+	KeyFile string
+}
+
+type Crypt struct {
+	backend plugins.IPlugin
+	primary string
+	ciphers map[string]cipher.AEAD
+
+	// secret of keys of body parts, it's derived from the primary key
+	bodySecret []byte
+}
+
+// New wraps the backend by the encryption.
+func New(backend plugins.IPlugin, cfg *Config) (plugins.IPlugin, error) {
+	keys, err := loadKeys(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, keys[0].Key)
+	mac.Write([]byte("cacheproxy body key"))
+
+	out := &Crypt{
+		backend:    backend,
+		primary:    keys[0].ID,
+		ciphers:    map[string]cipher.AEAD{},
+		bodySecret: mac.Sum(nil),
+	}
+
+	for _, k := range keys {
+		if k.ID == "" || len(k.ID) > 255 {
+			return nil, fmt.Errorf("crypt plugin: bad key ID %q", k.ID)
+		}
+		if _, find := out.ciphers[k.ID]; find {
+			return nil, fmt.Errorf("crypt plugin: duplicate key ID %q", k.ID)
+		}
+
+		block, err := aes.NewCipher(k.Key)
+		if err != nil {
+			return nil, errors.Wrapf(err, "crypt plugin: key %q", k.ID)
+		}
+
+		if out.ciphers[k.ID], err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+
+	return out, nil
+}
+
+func loadKeys(cfg *Config) ([]Key, error) {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+
+	keys := cfg.Keys
+	if len(keys) == 0 && cfg.KeyFile != "" {
+		body, err := os.ReadFile(cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if keys, err = ParseKeys(string(body)); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(keys) == 0 {
+		env := cfg.Env
+		if env == "" {
+			env = DefaultEnv
+		}
+
+		var err error
+		if keys, err = ParseKeys(os.Getenv(env)); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, ErrNoKeys
+	}
+
+	return keys, nil
+}
+
+// ParseKeys parses the list of "id:base64-key" separated by new lines or commas.
+// Empty lines and lines starting with # are skipped. The first key is the primary one.
+func ParseKeys(s string) ([]Key, error) {
+	out := make([]Key, 0)
+
+	scanner := bufio.NewScanner(strings.NewReader(strings.ReplaceAll(s, ",", "\n")))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		i := strings.Index(line, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("crypt plugin: bad key line %q, it's 'id:base64-key'", line)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(line[i+1:]))
+		if err != nil {
+			return nil, errors.Wrapf(err, "crypt plugin: key %q", line[:i])
+		}
+
+		out = append(out, Key{ID: strings.TrimSpace(line[:i]), Key: key})
+	}
+
+	return out, scanner.Err()
+}
+
+// additional data binds the record to its place, the record copied to another key is not read.
+func additionalData(header []byte, file, key string) []byte {
+	out := make([]byte, 0, len(header)+len(file)+len(key)+2)
+	out = append(out, header...)
+	out = append(out, file...)
+	out = append(out, 0)
+	out = append(out, key...)
+	return append(out, 0)
+}
+
+func (c *Crypt) encrypt(file, key string, data []byte) ([]byte, error) {
+	aead := c.ciphers[c.primary]
+
+	header := make([]byte, 0, len(magic)+2+len(c.primary))
+	header = append(header, magic...)
+	header = append(header, format, byte(len(c.primary)))
+	header = append(header, c.primary...)
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, len(header)+len(nonce)+len(data)+aead.Overhead())
+	out = append(out, header...)
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, data, additionalData(header, file, key)), nil
+}
+
+func (c *Crypt) decrypt(file, key string, data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, magic) {
+		// plain legacy record
+		return data, nil
+	}
+
+	if len(data) < len(magic)+2 || data[len(magic)] != format {
+		return nil, ErrBadRecord
+	}
+
+	idEnd := len(magic) + 2 + int(data[len(magic)+1])
+	if len(data) < idEnd {
+		return nil, ErrBadRecord
+	}
+
+	id := string(data[len(magic)+2 : idEnd])
+	aead, find := c.ciphers[id]
+	if !find {
+		return nil, errors.Wrapf(ErrUnknownKey, "%q", id)
+	}
+
+	if len(data) < idEnd+aead.NonceSize() {
+		return nil, ErrBadRecord
+	}
+
+	header, nonce := data[:idEnd], data[idEnd:idEnd+aead.NonceSize()]
+	out, err := aead.Open(nil, nonce, data[idEnd+aead.NonceSize():], additionalData(header, file, key))
+	if err != nil {
+		return nil, errors.Wrap(ErrBadRecord, err.Error())
+	}
+
+	return out, nil
+}
+
+func (c *Crypt) Read(file, key string) ([]byte, error) {
+	data, err := c.backend.Read(file, key)
+	if err != nil || len(data) == 0 {
+		return data, err
+	}
+
+	return c.decrypt(file, key, data)
+}
+
+func (c *Crypt) Save(file, key string, data []byte) error {
+	encrypted, err := c.encrypt(file, key, data)
+	if err != nil {
+		return err
+	}
+
+	return c.backend.Save(file, key, encrypted)
+}
+
+func (c *Crypt) SetVersion(version string) error {
+	return c.backend.SetVersion(version)
+}
+
+// SetFallbackVersions passes fallback versions to the backend if it supports them.
+func (c *Crypt) SetFallbackVersions(versions ...string) {
+	if backend, ok := c.backend.(plugins.IFallbackVersions); ok {
+		backend.SetFallbackVersions(versions...)
+	}
+}
+
+// Delete deletes records by the backend if it supports deleting.
+func (c *Crypt) Delete(file string, keys ...string) (int64, error) {
+	backend, ok := c.backend.(plugins.IDeleter)
+	if !ok {
+		return 0, errors.Wrap(cerrors.NotSupported, "crypt plugin")
+	}
+
+	return backend.Delete(file, keys...)
+}
+
+// Export exports decrypted records of the backend if it supports exporting.
+func (c *Crypt) Export(fn func(file, key string, data []byte) error) error {
+	backend, ok := c.backend.(plugins.IExporter)
+	if !ok {
+		return errors.Wrap(cerrors.NotSupported, "crypt plugin")
+	}
+
+	return backend.Export(func(file, key string, data []byte) error {
+		plain, err := c.decrypt(file, key, data)
+		if err != nil {
+			return err
+		}
+		return fn(file, key, plain)
+	})
+}
+
+// BodyKey returns the keyed hash of the part of the response body, so stored keys don't reveal its content.
+// Parts which are stored before the primary key is rotated are read by their old keys.
+func (c *Crypt) BodyKey(data []byte) string {
+	return store.KeyedBodyKey(c.bodySecret, data)
+}
+
+// Version returns the version of the backend, it's empty if the backend doesn't report it.
+func (c *Crypt) Version() string {
+	if backend, ok := c.backend.(plugins.IVersion); ok {
+		return backend.Version()
+	}
+
+	return ""
+}
+
+// Versions lists versions of the backend if it supports managing versions.
+func (c *Crypt) Versions() ([]plugins.VersionInfo, error) {
+	backend, ok := c.backend.(plugins.IVersionManager)
+	if !ok {
+		return nil, errors.Wrap(cerrors.NotSupported, "crypt plugin")
+	}
+
+	return backend.Versions()
+}
+
+// DeleteVersions deletes versions of the backend if it supports managing versions.
+func (c *Crypt) DeleteVersions(versions ...string) (int64, error) {
+	backend, ok := c.backend.(plugins.IVersionManager)
+	if !ok {
+		return 0, errors.Wrap(cerrors.NotSupported, "crypt plugin")
+	}
+
+	return backend.DeleteVersions(versions...)
+}
+
+// Close closes the backend if it keeps data in memory.
+func (c *Crypt) Close() error {
+	if backend, ok := c.backend.(plugins.ICloser); ok {
+		return backend.Close()
+	}
+
+	return nil
+}
+
+func (c *Crypt) PreloadByVersion() error {
+	return c.backend.PreloadByVersion()
+}
+
+// VerboseMode sets up "verbose" mode
+func (c *Crypt) VerboseMode(mode bool) {
+	c.backend.VerboseMode(mode)
+}
+
+// SetSlog passes the structured logger to the backend if it supports it.
+func (c *Crypt) SetSlog(logger *slog.Logger) {
+	if backend, ok := c.backend.(plugins.ISlog); ok {
+		backend.SetSlog(logger)
+	}
+}
@@ -0,0 +1,150 @@
+package crypt
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/iostrovok/check"
+
+	"github.com/iostrovok/cacheproxy/cerrors"
+	"github.com/iostrovok/cacheproxy/plugins"
+	"github.com/iostrovok/cacheproxy/plugins/internal/memkeeper"
+	"github.com/iostrovok/cacheproxy/store"
+)
+
+type testSuite struct{}
+
+var _ = Suite(&testSuite{})
+
+func TestService(t *testing.T) { TestingT(t) }
+
+var (
+	key1 = bytes.Repeat([]byte{1}, 32)
+	key2 = bytes.Repeat([]byte{2}, 16)
+)
+
+func (s *testSuite) TestParseKeys(c *C) {
+	keys, err := ParseKeys("# comment\nk1:" + base64.StdEncoding.EncodeToString(key1) +
+		"\n\n k2 : " + base64.StdEncoding.EncodeToString(key2))
+	c.Assert(err, IsNil)
+	c.Assert(keys, DeepEquals, []Key{{ID: "k1", Key: key1}, {ID: "k2", Key: key2}})
+
+	keys, err = ParseKeys("k1:" + base64.StdEncoding.EncodeToString(key1) + ",k2:" + base64.StdEncoding.EncodeToString(key2))
+	c.Assert(err, IsNil)
+	c.Assert(len(keys), Equals, 2)
+
+	_, err = ParseKeys("k1")
+	c.Assert(err, NotNil)
+
+	_, err = ParseKeys("k1:???")
+	c.Assert(err, NotNil)
+}
+
+func (s *testSuite) TestNew(c *C) {
+	_, err := New(memkeeper.New(), &Config{Env: "CACHEPROXY_TEST_NO_KEYS"})
+	c.Assert(errors.Is(err, ErrNoKeys), Equals, true)
+
+	_, err = New(memkeeper.New(), &Config{Keys: []Key{{ID: "k1", Key: []byte("short")}}})
+	c.Assert(err, NotNil)
+
+	_, err = New(memkeeper.New(), &Config{Keys: []Key{{ID: "k1", Key: key1}, {ID: "k1", Key: key2}}})
+	c.Assert(err, NotNil)
+
+	file := filepath.Join(c.MkDir(), "keys")
+	c.Assert(os.WriteFile(file, []byte("k1:"+base64.StdEncoding.EncodeToString(key1)), 0o600), IsNil)
+	_, err = New(memkeeper.New(), &Config{KeyFile: file})
+	c.Assert(err, IsNil)
+
+	os.Setenv("CACHEPROXY_TEST_KEYS", "k2:"+base64.StdEncoding.EncodeToString(key2))
+	defer os.Unsetenv("CACHEPROXY_TEST_KEYS")
+	_, err = New(memkeeper.New(), &Config{Env: "CACHEPROXY_TEST_KEYS"})
+	c.Assert(err, IsNil)
+}
+
+func (s *testSuite) TestReadSave(c *C) {
+	backend := memkeeper.New()
+	backend.Data["file/legacy"] = []byte("plain data")
+
+	old, err := New(backend, &Config{Keys: []Key{{ID: "k1", Key: key1}}})
+	c.Assert(err, IsNil)
+	c.Assert(old.Save("file", "a", []byte("secret-a")), IsNil)
+	c.Assert(bytes.Contains(backend.Data["file/a"], []byte("secret-a")), Equals, false)
+
+	// the key is rotated
+	keeper, err := New(backend, &Config{Keys: []Key{{ID: "k2", Key: key2}, {ID: "k1", Key: key1}}})
+	c.Assert(err, IsNil)
+	c.Assert(keeper.Save("file", "b", []byte("secret-b")), IsNil)
+
+	for key, expected := range map[string]string{"a": "secret-a", "b": "secret-b", "legacy": "plain data"} {
+		data, err := keeper.Read("file", key)
+		c.Assert(err, IsNil)
+		c.Assert(string(data), Equals, expected)
+	}
+
+	data, err := keeper.Read("file", "none")
+	c.Assert(err, IsNil)
+	c.Assert(data, IsNil)
+
+	// the old keeper has no new key
+	_, err = old.Read("file", "b")
+	c.Assert(errors.Is(err, ErrUnknownKey), Equals, true)
+
+	// the record is moved to another key
+	backend.Data["file/c"] = backend.Data["file/a"]
+	_, err = keeper.Read("file", "c")
+	c.Assert(errors.Is(err, ErrBadRecord), Equals, true)
+
+	// the record is changed
+	broken := append([]byte{}, backend.Data["file/b"]...)
+	broken[len(broken)-1] ^= 1
+	backend.Data["file/b"] = broken
+	_, err = keeper.Read("file", "b")
+	c.Assert(errors.Is(err, ErrBadRecord), Equals, true)
+}
+
+func (s *testSuite) TestForward(c *C) {
+	backend := memkeeper.NewManaged()
+	c.Assert(backend.SetVersion("main"), IsNil)
+
+	keeper, err := New(backend, &Config{Keys: []Key{{ID: "k1", Key: key1}}})
+	c.Assert(err, IsNil)
+	c.Assert(keeper.Save("file", "a", []byte("secret-a")), IsNil)
+
+	c.Assert(keeper.(plugins.IVersion).Version(), Equals, "main")
+	list, err := keeper.(plugins.IVersionManager).Versions()
+	c.Assert(err, IsNil)
+	c.Assert(list, DeepEquals, []plugins.VersionInfo{{Version: "main", Entries: 1}})
+
+	deleted, err := keeper.(plugins.IVersionManager).DeleteVersions("main")
+	c.Assert(err, IsNil)
+	c.Assert(deleted, Equals, int64(1))
+
+	// the backend without versions
+	keeper, err = New(memkeeper.New(), &Config{Keys: []Key{{ID: "k1", Key: key1}}})
+	c.Assert(err, IsNil)
+	c.Assert(keeper.(plugins.IVersion).Version(), Equals, "")
+	_, err = keeper.(plugins.IVersionManager).Versions()
+	c.Assert(errors.Is(err, cerrors.NotSupported), Equals, true)
+}
+
+func (s *testSuite) TestBodyKey(c *C) {
+	keeper, err := New(memkeeper.New(), &Config{Keys: []Key{{ID: "k1", Key: key1}}})
+	c.Assert(err, IsNil)
+	other, err := New(memkeeper.New(), &Config{Keys: []Key{{ID: "k2", Key: key2}, {ID: "k1", Key: key1}}})
+	c.Assert(err, IsNil)
+
+	data := []byte("body")
+	key := keeper.(plugins.IBodyKey).BodyKey(data)
+	c.Assert(key, Equals, keeper.(plugins.IBodyKey).BodyKey(data))
+	c.Assert(store.IsBodyKey(key), Equals, true)
+
+	// the key doesn't reveal the hash of the content and depends on the primary key
+	c.Assert(key, Not(Equals), store.BodyKey(data))
+	c.Assert(strings.Contains(key, strings.TrimPrefix(store.BodyKey(data), "body-sha256-")), Equals, false)
+	c.Assert(key, Not(Equals), other.(plugins.IBodyKey).BodyKey(data))
+}
@@ -0,0 +1,19 @@
+package crypt
+
+import (
+	"context"
+
+	"github.com/iostrovok/cacheproxy/config"
+	"github.com/iostrovok/cacheproxy/plugins"
+)
+
+func init() {
+	config.RegisterKeeper("crypt", func(ctx context.Context, cfg *config.Config, kc *config.KeeperConfig) (plugins.IPlugin, error) {
+		backend, err := config.NewKeeper(ctx, cfg, kc.Backend)
+		if err != nil {
+			return nil, err
+		}
+
+		return New(backend, &Config{KeyFile: kc.KeyFile, Env: kc.KeyEnv})
+	})
+}
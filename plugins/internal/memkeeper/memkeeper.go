@@ -0,0 +1,122 @@
+// Package memkeeper is the in-memory keeper for tests of plugins which wrap other keepers.
+package memkeeper
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/iostrovok/cacheproxy/plugins"
+)
+
+// Keeper keeps data in memory and counts requests. Fields are read by tests after requests are done.
+type Keeper struct {
+	mx sync.Mutex
+
+	// Data is keyed by Key(file, key).
+	Data map[string][]byte
+
+	// Version is the last version which is set by SetVersion.
+	Version string
+
+	Reads, Saves int
+}
+
+func New() *Keeper {
+	return &Keeper{Data: map[string][]byte{}}
+}
+
+// Key returns the key of Data.
+func Key(file, key string) string {
+	return file + "/" + key
+}
+
+func (k *Keeper) Read(file, key string) ([]byte, error) {
+	k.mx.Lock()
+	defer k.mx.Unlock()
+
+	k.Reads++
+	return k.Data[Key(file, key)], nil
+}
+
+func (k *Keeper) Save(file, key string, data []byte) error {
+	k.mx.Lock()
+	defer k.mx.Unlock()
+
+	k.Saves++
+	k.Data[Key(file, key)] = data
+	return nil
+}
+
+func (k *Keeper) SetVersion(version string) error {
+	k.mx.Lock()
+	defer k.mx.Unlock()
+
+	k.Version = version
+	return nil
+}
+
+func (k *Keeper) PreloadByVersion() error { return nil }
+func (k *Keeper) VerboseMode(bool)        {}
+
+// Managed is the Keeper which reports its version, manages versions and exports data.
+// All data belongs to the current version.
+type Managed struct {
+	*Keeper
+}
+
+func NewManaged() *Managed {
+	return &Managed{Keeper: New()}
+}
+
+func (m *Managed) Version() string {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	return m.Keeper.Version
+}
+
+func (m *Managed) Versions() ([]plugins.VersionInfo, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	return []plugins.VersionInfo{{Version: m.Keeper.Version, Entries: int64(len(m.Data))}}, nil
+}
+
+func (m *Managed) DeleteVersions(versions ...string) (int64, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	for _, v := range versions {
+		if v == m.Keeper.Version {
+			deleted := int64(len(m.Data))
+			m.Data = map[string][]byte{}
+			return deleted, nil
+		}
+	}
+
+	return 0, nil
+}
+
+func (m *Managed) Export(fn func(file, key string, data []byte) error) error {
+	m.mx.Lock()
+	names := make([]string, 0, len(m.Data))
+	for name := range m.Data {
+		names = append(names, name)
+	}
+	m.mx.Unlock()
+	sort.Strings(names)
+
+	for _, name := range names {
+		file, key, _ := strings.Cut(name, "/")
+		m.mx.Lock()
+		data := m.Data[name]
+		m.mx.Unlock()
+
+		if err := fn(file, key, data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
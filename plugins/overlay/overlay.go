@@ -0,0 +1,296 @@
+package overlay
+
+import (
+	"log/slog"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/iostrovok/cacheproxy/cerrors"
+	"github.com/iostrovok/cacheproxy/plugins"
+)
+
+// Overlay reads data from the list of layers in order and writes data to the writable layer only.
+// The usual case is the local store of the developer over the shared read-only fixtures.
+type Overlay struct {
+	mx sync.Mutex
+
+	writable plugins.IPlugin
+	shared   []plugins.IPlugin
+
+	// data saved during the session by file name and key, see Publish
+	written map[string]map[string]bool
+}
+
+// New returns the keeper which reads the writable layer first and the shared layers next.
+// Writable may be nil, Save returns cerrors.ReadOnlyKeeper then (CI mode).
+func New(writable plugins.IPlugin, shared ...plugins.IPlugin) plugins.IPlugin {
+	return &Overlay{
+		writable: writable,
+		shared:   shared,
+		written:  map[string]map[string]bool{},
+	}
+}
+
+// layers returns all layers in order of reading.
+func (o *Overlay) layers() []plugins.IPlugin {
+	out := make([]plugins.IPlugin, 0, len(o.shared)+1)
+	if o.writable != nil {
+		out = append(out, o.writable)
+	}
+	return append(out, o.shared...)
+}
+
+func (o *Overlay) Read(file, key string) ([]byte, error) {
+	for _, layer := range o.layers() {
+		data, err := layer.Read(file, key)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > 0 {
+			return data, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (o *Overlay) Save(file, key string, data []byte) error {
+	if o.writable == nil {
+		return errors.Wrap(cerrors.ReadOnlyKeeper, "overlay plugin")
+	}
+
+	if err := o.writable.Save(file, key, data); err != nil {
+		return err
+	}
+
+	o.mx.Lock()
+	defer o.mx.Unlock()
+
+	if _, find := o.written[file]; !find {
+		o.written[file] = map[string]bool{}
+	}
+	o.written[file][key] = true
+
+	return nil
+}
+
+// Publish pushes entries of the writable layer into the target, the first shared layer is used if target is nil.
+// All entries of the current version are pushed if the writable layer implements plugins.IExporter,
+// otherwise only entries saved during the session are pushed. It returns the number of pushed entries.
+func (o *Overlay) Publish(target plugins.IPlugin) (int, error) {
+	if o.writable == nil {
+		return 0, errors.Wrap(cerrors.ReadOnlyKeeper, "overlay plugin")
+	}
+
+	if target == nil {
+		if len(o.shared) == 0 {
+			return 0, errors.New("overlay plugin: no shared layer to publish")
+		}
+		target = o.shared[0]
+	}
+
+	count := 0
+	push := func(file, key string, data []byte) error {
+		if err := target.Save(file, key, data); err != nil {
+			return err
+		}
+		count++
+		return nil
+	}
+
+	if exporter, ok := o.writable.(plugins.IExporter); ok {
+		err := exporter.Export(push)
+		return count, err
+	}
+
+	o.mx.Lock()
+	written := o.written
+	o.written = map[string]map[string]bool{}
+	o.mx.Unlock()
+
+	for file, keys := range written {
+		for key := range keys {
+			data, err := o.writable.Read(file, key)
+			if err != nil {
+				return count, err
+			}
+			if err := push(file, key, data); err != nil {
+				return count, err
+			}
+		}
+	}
+
+	return count, nil
+}
+
+// Delete deletes records from the writable layer, shared layers are never changed.
+func (o *Overlay) Delete(file string, keys ...string) (int64, error) {
+	if o.writable == nil {
+		return 0, errors.Wrap(cerrors.ReadOnlyKeeper, "overlay plugin")
+	}
+
+	writable, ok := o.writable.(plugins.IDeleter)
+	if !ok {
+		return 0, errors.Wrap(cerrors.NotSupported, "overlay plugin")
+	}
+
+	o.mx.Lock()
+	for _, key := range keys {
+		delete(o.written[file], key)
+	}
+	o.mx.Unlock()
+
+	return writable.Delete(file, keys...)
+}
+
+// Export exports records of all layers, the record of the upper layer hides the same record of lower layers.
+// All layers should implement plugins.IExporter.
+func (o *Overlay) Export(fn func(file, key string, data []byte) error) error {
+	exporters := make([]plugins.IExporter, 0, len(o.shared)+1)
+	for _, layer := range o.layers() {
+		exporter, ok := layer.(plugins.IExporter)
+		if !ok {
+			return errors.Wrap(cerrors.NotSupported, "overlay plugin")
+		}
+		exporters = append(exporters, exporter)
+	}
+
+	exported := map[string]map[string]bool{}
+	for _, exporter := range exporters {
+		err := exporter.Export(func(file, key string, data []byte) error {
+			if exported[file][key] {
+				return nil
+			}
+			if _, find := exported[file]; !find {
+				exported[file] = map[string]bool{}
+			}
+			exported[file][key] = true
+
+			return fn(file, key, data)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Version returns the version of the writable layer (or the first shared one in the read-only mode),
+// it's empty if the layer doesn't report it.
+func (o *Overlay) Version() string {
+	layers := o.layers()
+	if len(layers) == 0 {
+		return ""
+	}
+
+	if layer, ok := layers[0].(plugins.IVersion); ok {
+		return layer.Version()
+	}
+
+	return ""
+}
+
+// Versions lists versions of the writable layer if it supports managing versions.
+func (o *Overlay) Versions() ([]plugins.VersionInfo, error) {
+	writable, err := o.versionManager()
+	if err != nil {
+		return nil, err
+	}
+
+	return writable.Versions()
+}
+
+// DeleteVersions deletes versions of the writable layer, shared layers are never changed.
+func (o *Overlay) DeleteVersions(versions ...string) (int64, error) {
+	writable, err := o.versionManager()
+	if err != nil {
+		return 0, err
+	}
+
+	return writable.DeleteVersions(versions...)
+}
+
+func (o *Overlay) versionManager() (plugins.IVersionManager, error) {
+	if o.writable == nil {
+		return nil, errors.Wrap(cerrors.ReadOnlyKeeper, "overlay plugin")
+	}
+
+	writable, ok := o.writable.(plugins.IVersionManager)
+	if !ok {
+		return nil, errors.Wrap(cerrors.NotSupported, "overlay plugin")
+	}
+
+	return writable, nil
+}
+
+// BodyKey returns the key of the part of the response body made by the writable layer,
+// it's empty if the layer doesn't make keys.
+func (o *Overlay) BodyKey(data []byte) string {
+	if writable, ok := o.writable.(plugins.IBodyKey); ok {
+		return writable.BodyKey(data)
+	}
+
+	return ""
+}
+
+// SetVersion sets the version of all layers. Layers without versions are skipped.
+func (o *Overlay) SetVersion(version string) error {
+	for _, layer := range o.layers() {
+		if err := layer.SetVersion(version); err != nil && !errors.Is(err, cerrors.PluginHasNoVersion) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SetFallbackVersions passes fallback versions to all layers which support them.
+func (o *Overlay) SetFallbackVersions(versions ...string) {
+	for _, layer := range o.layers() {
+		if l, ok := layer.(plugins.IFallbackVersions); ok {
+			l.SetFallbackVersions(versions...)
+		}
+	}
+}
+
+// Close closes all layers which keep data in memory, the first error is returned.
+func (o *Overlay) Close() error {
+	var out error
+	for _, layer := range o.layers() {
+		if l, ok := layer.(plugins.ICloser); ok {
+			if err := l.Close(); err != nil && out == nil {
+				out = err
+			}
+		}
+	}
+
+	return out
+}
+
+func (o *Overlay) PreloadByVersion() error {
+	for _, layer := range o.layers() {
+		if err := layer.PreloadByVersion(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// VerboseMode sets up "verbose" mode
+func (o *Overlay) VerboseMode(mode bool) {
+	for _, layer := range o.layers() {
+		layer.VerboseMode(mode)
+	}
+}
+
+// SetSlog passes the structured logger to all layers which support it.
+func (o *Overlay) SetSlog(logger *slog.Logger) {
+	for _, layer := range o.layers() {
+		if l, ok := layer.(plugins.ISlog); ok {
+			l.SetSlog(logger)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package overlay
+
+import (
+	"errors"
+	"testing"
+
+	. "github.com/iostrovok/check"
+
+	"github.com/iostrovok/cacheproxy/cerrors"
+	"github.com/iostrovok/cacheproxy/plugins"
+	"github.com/iostrovok/cacheproxy/plugins/internal/memkeeper"
+)
+
+type testSuite struct{}
+
+var _ = Suite(&testSuite{})
+
+func TestService(t *testing.T) { TestingT(t) }
+
+func (s *testSuite) TestReadSave(c *C) {
+	local, shared := memkeeper.New(), memkeeper.New()
+	shared.Data["file/a"] = []byte("shared-a")
+	shared.Data["file/b"] = []byte("shared-b")
+	local.Data["file/b"] = []byte("local-b")
+
+	keeper := New(local, shared).(*Overlay)
+
+	data, err := keeper.Read("file", "a")
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "shared-a")
+
+	data, err = keeper.Read("file", "b")
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "local-b")
+
+	data, err = keeper.Read("file", "c")
+	c.Assert(err, IsNil)
+	c.Assert(data, IsNil)
+
+	c.Assert(keeper.Save("file", "c", []byte("local-c")), IsNil)
+	c.Assert(string(local.Data["file/c"]), Equals, "local-c")
+	c.Assert(shared.Data["file/c"], IsNil)
+
+	c.Assert(keeper.SetVersion("feature"), IsNil)
+	c.Assert(local.Version, Equals, "feature")
+	c.Assert(shared.Version, Equals, "feature")
+
+	count, err := keeper.Publish(nil)
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, 1)
+	c.Assert(string(shared.Data["file/c"]), Equals, "local-c")
+
+	// published entries are not pushed twice
+	count, err = keeper.Publish(nil)
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, 0)
+}
+
+func (s *testSuite) TestPublishExporter(c *C) {
+	local, shared := memkeeper.NewManaged(), memkeeper.New()
+	local.Data["file/a"] = []byte("local-a")
+	local.Data["file/b"] = []byte("local-b")
+
+	// all data of the exporting layer is pushed, not only data saved during the session
+	count, err := New(local, shared).(*Overlay).Publish(nil)
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, 2)
+	c.Assert(string(shared.Data["file/a"]), Equals, "local-a")
+	c.Assert(string(shared.Data["file/b"]), Equals, "local-b")
+}
+
+func (s *testSuite) TestReadOnly(c *C) {
+	shared := memkeeper.New()
+	shared.Data["file/a"] = []byte("shared-a")
+
+	keeper := New(nil, shared).(*Overlay)
+
+	data, err := keeper.Read("file", "a")
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "shared-a")
+
+	err = keeper.Save("file", "b", []byte("b"))
+	c.Assert(errors.Is(err, cerrors.ReadOnlyKeeper), Equals, true)
+	c.Assert(shared.Data["file/b"], IsNil)
+
+	_, err = keeper.Publish(nil)
+	c.Assert(errors.Is(err, cerrors.ReadOnlyKeeper), Equals, true)
+}
+
+func (s *testSuite) TestForward(c *C) {
+	local, shared := memkeeper.NewManaged(), memkeeper.NewManaged()
+	local.Data["file/a"] = []byte("local-a")
+	shared.Data["file/a"] = []byte("shared-a")
+	shared.Data["file/b"] = []byte("shared-b")
+
+	keeper := New(local, shared).(*Overlay)
+	c.Assert(keeper.SetVersion("main"), IsNil)
+	c.Assert(keeper.Version(), Equals, "main")
+
+	// the record of the writable layer hides the shared one
+	exported := map[string]string{}
+	c.Assert(keeper.Export(func(file, key string, data []byte) error {
+		exported[file+"/"+key] = string(data)
+		return nil
+	}), IsNil)
+	c.Assert(exported, DeepEquals, map[string]string{"file/a": "local-a", "file/b": "shared-b"})
+
+	// versions of the writable layer are deleted only
+	deleted, err := keeper.DeleteVersions("main")
+	c.Assert(err, IsNil)
+	c.Assert(deleted, Equals, int64(1))
+	c.Assert(shared.Data, HasLen, 2)
+
+	list, err := keeper.Versions()
+	c.Assert(err, IsNil)
+	c.Assert(list, DeepEquals, []plugins.VersionInfo{{Version: "main"}})
+
+	_, err = New(nil, shared).(*Overlay).DeleteVersions("main")
+	c.Assert(errors.Is(err, cerrors.ReadOnlyKeeper), Equals, true)
+
+	// all layers should export
+	err = New(local, memkeeper.New()).(*Overlay).Export(func(string, string, []byte) error { return nil })
+	c.Assert(errors.Is(err, cerrors.NotSupported), Equals, true)
+}
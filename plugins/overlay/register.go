@@ -0,0 +1,32 @@
+package overlay
+
+import (
+	"context"
+
+	"github.com/iostrovok/cacheproxy/config"
+	"github.com/iostrovok/cacheproxy/plugins"
+)
+
+func init() {
+	// the overlay without the backend is read-only
+	config.RegisterKeeper("overlay", func(ctx context.Context, cfg *config.Config, kc *config.KeeperConfig) (plugins.IPlugin, error) {
+		var writable plugins.IPlugin
+		if kc.Backend != nil {
+			var err error
+			if writable, err = config.NewKeeper(ctx, cfg, kc.Backend); err != nil {
+				return nil, err
+			}
+		}
+
+		shared := make([]plugins.IPlugin, 0, len(kc.Shared))
+		for i := range kc.Shared {
+			layer, err := config.NewKeeper(ctx, cfg, &kc.Shared[i])
+			if err != nil {
+				return nil, err
+			}
+			shared = append(shared, layer)
+		}
+
+		return New(writable, shared...), nil
+	})
+}
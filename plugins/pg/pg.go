@@ -5,43 +5,50 @@ import (
 	"crypto/md5"
 	"database/sql"
 	"fmt"
+	"io"
+	"log/slog"
+	"os"
 	"sync"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/pkg/errors"
 
 	"github.com/iostrovok/cacheproxy/cerrors"
 	"github.com/iostrovok/cacheproxy/plugins"
+	"github.com/iostrovok/cacheproxy/version"
 )
 
-/*
-
-
-
-CREATE TABLE IF NOT EXISTS public.dbfiles
-(
-    id SERIAL,
-    file_name character varying(40) COLLATE pg_catalog."default" NOT NULL,
-    key character varying(40) COLLATE pg_catalog."default" NOT NULL,
-    version character varying(40) COLLATE pg_catalog."default" NOT NULL,
-    data bytea,
-    CONSTRAINT pkey PRIMARY KEY (id),
-    CONSTRAINT uxk UNIQUE (file_name, key, version) WITH (FILLFACTOR=100)
-);
-
-*/
+// Default names of the table and its columns. See EnsureSchema for the structure of the table.
+const (
+	DefaultTable      = "public.dbfiles"
+	DefaultFileCol    = "file_name"
+	DefaultKeyCol     = "key"
+	DefaultValCol     = "data"
+	DefaultVersionCol = "version"
+	DefaultUpdatedCol = "updated_at"
+	DefaultOriginCol  = "origin_file_name"
+)
 
 type Config struct {
-	// Table options
+	// Table options, default names are used for empty values.
+	// Names are written as in SQL: unquoted names are case-insensitive (Fixtures is fixtures),
+	// quoted names like `"MySchema"."Fixtures"` keep the case and may contain any symbols.
 	Table      string // schema name + table.name
 	FileCol    string //  character varying field for file name
 	KeyCol     string //  character varying field for key
 	ValCol     string //  BYTEA (binary) field for value
 	VersionCol string //  character varying field for version
+	UpdatedCol string //  timestamp field for the time of the last write, it's updated by the trigger
+	OriginCol  string //  character varying field for the original file name if FileCol keeps MD5 of it
 
 	//
 	Version string // value for version for current request series. Keep it empty if you don't use versions.
 
+	// FallbackVersions are parent versions, like []string{"develop", "main"} for a feature branch.
+	// Data is read from Version first and from FallbackVersions in order if it's not found.
+	// Data is written to Version only.
+	FallbackVersions []string
+
 	// cache options
 	UseCache   bool // use or not use cache
 	UsePreload bool // loads all data for the version from DB and saves them to cache. Useful for tests
@@ -50,6 +57,35 @@ type Config struct {
 	// The length of the file name depends on the length of the URL and can be very long.
 	// Use HumanReadableFileName=true to prevent FileCol size error.
 	HumanReadableFileName bool
+
+	// If AutoMigrate is true New calls EnsureSchema, so the table is created or migrated.
+	// New doesn't query the database otherwise.
+	// Tables with character varying(40) columns need the migration to store large bodies by parts.
+	AutoMigrate bool
+}
+
+func (cfg *Config) setDefaults() {
+	if cfg.Table == "" {
+		cfg.Table = DefaultTable
+	}
+	if cfg.FileCol == "" {
+		cfg.FileCol = DefaultFileCol
+	}
+	if cfg.KeyCol == "" {
+		cfg.KeyCol = DefaultKeyCol
+	}
+	if cfg.ValCol == "" {
+		cfg.ValCol = DefaultValCol
+	}
+	if cfg.VersionCol == "" {
+		cfg.VersionCol = DefaultVersionCol
+	}
+	if cfg.UpdatedCol == "" {
+		cfg.UpdatedCol = DefaultUpdatedCol
+	}
+	if cfg.OriginCol == "" {
+		cfg.OriginCol = DefaultOriginCol
+	}
 }
 
 type cacheItem struct {
@@ -64,61 +100,371 @@ type PG struct {
 	ctx context.Context
 	db  *sql.DB
 
-	upsert string
-	find   string
-	cache  map[[16]byte]*cacheItem
+	names names
 
-	verbose bool
+	// withOrigin is true if the table keeps original file names (the migration 5 of EnsureSchema),
+	// originKnown is true when it's checked, see detectOrigin
+	withOrigin  bool
+	originKnown bool
+
+	upsert  string
+	find    string
+	promote string
+	preload string
+
+	versionsInfo   string
+	versionsNoTime string
+	deleteVersions string
+	deleteKeys     string
+	export         string
+	cache          map[[16]byte]*cacheItem
+
+	log *slog.Logger
 }
 
+// New creates the plugin. The version is found by version.Resolve if cfg.Version is empty.
 func New(ctx context.Context, db *sql.DB, cfg *Config) (plugins.IPlugin, error) {
+	cfg.setDefaults()
+	if cfg.Version == "" {
+		cfg.Version = version.Resolve("")
+	}
+
 	out := &PG{
 		ctx:   ctx,
 		cfg:   cfg,
 		db:    db,
+		names: quoteNames(cfg),
 		cache: map[[16]byte]*cacheItem{},
+		log:   slog.New(slog.NewTextHandler(io.Discard, nil)),
 	}
+
+	out.buildQueries()
+
+	// the table isn't touched by New without AutoMigrate, columns are checked on the first use
+	if cfg.AutoMigrate {
+		if err := out.EnsureSchema(); err != nil {
+			return out, err
+		}
+		if err := out.detectOrigin(); err != nil {
+			return out, err
+		}
+	}
+
 	err := out.SetVersion(cfg.Version)
 
 	return out, err
 }
 
-// VerboseMode sets up "verbose" mode
+// detectOrigin checks once whether the table keeps original file names, so Save writes them and Export returns them.
+// Queries which depend on it are rebuilt. The check is repeated on the next call if it fails.
+func (p *PG) detectOrigin() error {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.originKnown {
+		return nil
+	}
+
+	withOrigin, err := p.hasColumn(identName(p.cfg.OriginCol))
+	if err != nil {
+		return err
+	}
+
+	p.withOrigin, p.originKnown = withOrigin, true
+	p.buildOriginQueries()
+
+	return nil
+}
+
+// VerboseMode sets up "verbose" mode: debug lines are written to stdout.
+// Deprecated: use SetSlog.
 func (s *PG) VerboseMode(mode bool) {
-	s.verbose = mode
+	if mode {
+		s.log = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	} else {
+		s.log = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+}
+
+// SetSlog sets the structured logger, reads and saves are logged with slog.LevelDebug.
+func (p *PG) SetSlog(logger *slog.Logger) {
+	p.log = logger
 }
 
 func (p *PG) SetVersion(version string) error {
 	p.Lock()
 	defer p.Unlock()
 
-	if p.cfg.Version == "" {
+	if version == "" {
 		return errors.Wrap(cerrors.EmptyVersion, "pg plugin")
 	}
 
 	p.cfg.Version = version
+	return nil
+}
+
+// Version returns the version of saved data.
+func (p *PG) Version() string {
+	p.RLock()
+	defer p.RUnlock()
+
+	return p.cfg.Version
+}
+
+// buildQueries prepares all queries, versions are always passed as parameters.
+func (p *PG) buildQueries() {
+	n := p.names
 
+	// the version which is the first in the chain wins
 	p.find = fmt.Sprintf(`
 			SELECT %s FROM %s
-			WHERE %s= $1 AND %s = $2 AND %s = '%s'
+			WHERE %s= $1 AND %s = $2 AND %s = ANY($3)
+			ORDER BY array_position($3, %s)
+			LIMIT 1
 		`,
-		p.cfg.ValCol, p.cfg.Table,
-		p.cfg.FileCol, p.cfg.KeyCol, p.cfg.VersionCol, p.cfg.Version)
+		n.val, n.table,
+		n.file, n.key, n.version,
+		n.version)
+
+	versionsInfo := `
+			SELECT %s, COUNT(*), COALESCE(SUM(octet_length(%s)), 0), %s
+			FROM %s
+			GROUP BY %s
+			ORDER BY %s
+		`
+	p.versionsInfo = fmt.Sprintf(versionsInfo, n.version, n.val, "MAX("+n.updated+")",
+		n.table,
+		n.version,
+		n.version)
+
+	// the table which is not migrated yet has no time of the last write
+	p.versionsNoTime = fmt.Sprintf(versionsInfo, n.version, n.val, "NULL::timestamp with time zone",
+		n.table,
+		n.version,
+		n.version)
+
+	p.deleteVersions = fmt.Sprintf(`DELETE FROM %s WHERE %s = ANY($1)`, n.table, n.version)
+
+	p.deleteKeys = fmt.Sprintf(`DELETE FROM %s WHERE %s = $1 AND %s = ANY($2) AND %s = $3`,
+		n.table, n.file, n.key, n.version)
+
+	p.preload = fmt.Sprintf(`
+			SELECT %s, %s, %s, %s FROM %s 
+			WHERE %s = ANY($1)
+		`, n.file, n.key, n.version, n.val, n.table,
+		n.version)
+
+	p.buildOriginQueries()
+}
+
+// buildOriginQueries prepares queries which write or return original file names if the table keeps them.
+func (p *PG) buildOriginQueries() {
+	n := p.names
+
+	// the original file name is the 5th parameter of upsert
+	cols := fmt.Sprintf("%s, %s, %s, %s", n.file, n.key, n.version, n.val)
+	values := "$1, $2, $3, $4"
+	copied := fmt.Sprintf("%s, %s, $2, %s", n.file, n.key, n.val)
+	update := fmt.Sprintf("%s = EXCLUDED.%s", n.val, n.val)
+	exported := n.file
+	if p.withOrigin {
+		cols += ", " + n.origin
+		values += ", $5"
+		copied += ", " + n.origin
+		update += fmt.Sprintf(", %s = EXCLUDED.%s", n.origin, n.origin)
+		exported = fmt.Sprintf("COALESCE(%s, %s)", n.origin, n.file)
+	}
 
 	p.upsert = fmt.Sprintf(`
 			INSERT INTO  %s 
-			(%s, %s, %s, %s) 
-			VALUES($1, $2, $3, $4)
+			(%s) 
+			VALUES(%s)
 			ON CONFLICT (%s, %s, %s) DO 
 			UPDATE SET
-			%s = EXCLUDED.%s
+			%s
 		`,
-		p.cfg.Table,
-		p.cfg.FileCol, p.cfg.KeyCol, p.cfg.VersionCol, p.cfg.ValCol,
-		p.cfg.FileCol, p.cfg.KeyCol, p.cfg.VersionCol,
-		p.cfg.ValCol, p.cfg.ValCol)
+		n.table,
+		cols,
+		values,
+		n.file, n.key, n.version,
+		update)
 
-	return nil
+	p.promote = fmt.Sprintf(`
+			INSERT INTO  %s 
+			(%s) 
+			SELECT %s FROM %s
+			WHERE %s = $1
+			ON CONFLICT (%s, %s, %s) DO 
+			UPDATE SET
+			%s
+		`,
+		n.table,
+		cols,
+		copied, n.table,
+		n.version,
+		n.file, n.key, n.version,
+		update)
+
+	p.export = fmt.Sprintf(`SELECT %s, %s, %s FROM %s WHERE %s = $1`,
+		exported, n.key, n.val, n.table, n.version)
+}
+
+// SetFallbackVersions sets parent versions which are read if data is not found for the current version.
+func (p *PG) SetFallbackVersions(versions ...string) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.cfg.FallbackVersions = versions
+}
+
+// versions returns the current version and its fallback versions without duplicates.
+func (p *PG) versions() []string {
+	out := []string{p.cfg.Version}
+	for _, v := range p.cfg.FallbackVersions {
+		if v == "" || inList(out, v) {
+			continue
+		}
+		out = append(out, v)
+	}
+
+	return out
+}
+
+func inList(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Promote copies all data of the version "from" to the version "to", existing data of "to" is replaced.
+// It's used to move the data of the merged branch into its parent. Returns the number of copied records.
+func (p *PG) Promote(from, to string) (int64, error) {
+	if from == "" || to == "" {
+		return 0, errors.Wrap(cerrors.EmptyVersion, "pg plugin")
+	}
+
+	if err := p.detectOrigin(); err != nil {
+		return 0, err
+	}
+
+	res, err := p.db.ExecContext(p.ctx, p.promote, from, to)
+	if err != nil {
+		return 0, err
+	}
+
+	// the cache may keep old data of "to"
+	p.Lock()
+	p.cache = map[[16]byte]*cacheItem{}
+	p.Unlock()
+
+	return res.RowsAffected()
+}
+
+// Versions returns all stored versions with the number of records, size of data and the time of the last write.
+// The time of the last write is kept since the migration 3 of EnsureSchema, it's zero for tables without it.
+func (p *PG) Versions() ([]plugins.VersionInfo, error) {
+	hasTime, err := p.hasColumn(identName(p.cfg.UpdatedCol))
+	if err != nil {
+		return nil, err
+	}
+
+	query := p.versionsInfo
+	if !hasTime {
+		query = p.versionsNoTime
+	}
+
+	rows, err := p.db.QueryContext(p.ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make([]plugins.VersionInfo, 0)
+	for rows.Next() {
+		info := plugins.VersionInfo{}
+		lastWrite := sql.NullTime{}
+		if err := rows.Scan(&info.Version, &info.Entries, &info.Bytes, &lastWrite); err != nil {
+			return nil, err
+		}
+		info.LastWrite = lastWrite.Time
+		out = append(out, info)
+	}
+
+	return out, rows.Err()
+}
+
+// DeleteVersions deletes all data of the versions.
+func (p *PG) DeleteVersions(versions ...string) (int64, error) {
+	if len(versions) == 0 {
+		return 0, nil
+	}
+
+	res, err := p.db.ExecContext(p.ctx, p.deleteVersions, pq.Array(versions))
+	if err != nil {
+		return 0, err
+	}
+
+	p.Lock()
+	p.cache = map[[16]byte]*cacheItem{}
+	p.Unlock()
+
+	return res.RowsAffected()
+}
+
+// Delete deletes records of the current version from the file by keys.
+func (p *PG) Delete(fileName string, keys ...string) (int64, error) {
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	fileName = p.shortFileName(fileName)
+
+	p.Lock()
+	defer p.Unlock()
+
+	res, err := p.db.ExecContext(p.ctx, p.deleteKeys, fileName, pq.Array(keys), p.cfg.Version)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, key := range keys {
+		delete(p.cache, cacheKey(fileName, key, p.cfg.Version))
+	}
+
+	return res.RowsAffected()
+}
+
+// Export calls fn for every record of the current version. File names are original names
+// if the table keeps them (the migration 5 of EnsureSchema), they're MD5 of names written before otherwise.
+func (p *PG) Export(fn func(file, key string, data []byte) error) error {
+	if err := p.detectOrigin(); err != nil {
+		return err
+	}
+
+	p.RLock()
+	version := p.cfg.Version
+	p.RUnlock()
+
+	rows, err := p.db.QueryContext(p.ctx, p.export, version)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var fileName, key string
+		var data []byte
+		if err := rows.Scan(&fileName, &key, &data); err != nil {
+			return err
+		}
+		if err := fn(fileName, key, data); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
 }
 
 // PreloadByVersion loads all data for the version from DB and saves them to cache.
@@ -134,32 +480,26 @@ func (p *PG) PreloadByVersion() error {
 		return errors.Wrap(cerrors.EmptyVersion, "pg plugin")
 	}
 
-	sql := fmt.Sprintf(`
-			SELECT %s, %s, %s FROM %s 
-			WHERE %s = '%s'
-		`, p.cfg.FileCol, p.cfg.KeyCol, p.cfg.ValCol, p.cfg.Table,
-		p.cfg.VersionCol, p.cfg.Version)
-
-	rows, err := p.db.QueryContext(p.ctx, sql)
+	rows, err := p.db.QueryContext(p.ctx, p.preload, pq.Array(p.versions()))
 	if err != nil {
 		return err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var fileName, key string
+		var fileName, key, version string
 		var data []byte
 
-		if err := rows.Scan(&fileName, &key, &data); err != nil {
+		if err := rows.Scan(&fileName, &key, &version, &data); err != nil {
 			return err
 		}
 
-		p.cache[cacheKey(fileName, key, p.cfg.Version)] = &cacheItem{
+		p.cache[cacheKey(fileName, key, version)] = &cacheItem{
 			md5.Sum(data), data,
 		}
 	}
 
-	return nil
+	return rows.Err()
 }
 
 func (p *PG) findInCache(fileName, key string, sum [16]byte) bool {
@@ -185,14 +525,18 @@ func (p *PG) readCache(fileName, key string) ([]byte, bool) {
 	p.RLock()
 	defer p.RUnlock()
 
-	cOut, find := p.cache[cacheKey(fileName, key, p.cfg.Version)]
-	if !find {
-		return nil, false
+	for _, version := range p.versions() {
+		cOut, find := p.cache[cacheKey(fileName, key, version)]
+		if !find {
+			continue
+		}
+
+		out := make([]byte, len(cOut.value))
+		copy(out, cOut.value)
+		return out, true
 	}
 
-	out := make([]byte, len(cOut.value))
-	copy(out, cOut.value)
-	return out, true
+	return nil, false
 }
 
 func (p *PG) shortFileName(fileName string) string {
@@ -207,21 +551,19 @@ func (p *PG) Read(fileName, key string) (out []byte, err error) {
 	find := false
 
 	defer func() {
-		if p.verbose {
-			if err == nil && len(out) > 0 {
-				fmt.Printf("Found at cache key: %s, %s\n", fileName, key)
-			} else {
-				fmt.Printf("Not found at cache key: %s, %s\n", fileName, key)
-			}
-		}
+		p.log.Debug("pg plugin: read", "file", fileName, "key", key, "found", err == nil && len(out) > 0, "error", err)
 	}()
 
 	if out, find = p.readCache(fileName, key); find {
 		return out, nil
 	}
 
+	p.RLock()
+	versions := p.versions()
+	p.RUnlock()
+
 	out = make([]byte, 0)
-	err = p.db.QueryRowContext(p.ctx, p.find, fileName, key).Scan(&out)
+	err = p.db.QueryRowContext(p.ctx, p.find, fileName, key, pq.Array(versions)).Scan(&out)
 	if err != nil && errors.Is(err, sql.ErrNoRows) {
 		return nil, nil
 	}
@@ -230,17 +572,25 @@ func (p *PG) Read(fileName, key string) (out []byte, err error) {
 }
 
 func (p *PG) Save(fileName, key string, data []byte) error {
+	origin := fileName
 	fileName = p.shortFileName(fileName)
 
-	if p.verbose {
-		fmt.Printf("Save to cache: %s, %s\n", fileName, key)
-	}
+	p.log.Debug("pg plugin: save", "file", fileName, "key", key)
 
 	if p.cfg.UseCache && p.findInCache(fileName, key, md5.Sum(data)) {
 		return nil
 	}
 
-	_, err := p.db.ExecContext(p.ctx, p.upsert, fileName, key, p.cfg.Version, data)
+	if err := p.detectOrigin(); err != nil {
+		return err
+	}
+
+	args := []any{fileName, key, p.cfg.Version, data}
+	if p.withOrigin {
+		args = append(args, origin)
+	}
+
+	_, err := p.db.ExecContext(p.ctx, p.upsert, args...)
 	if err == nil && p.cfg.UseCache {
 		p.Lock()
 		p.cache[cacheKey(fileName, key, p.cfg.Version)] = &cacheItem{
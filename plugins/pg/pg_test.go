@@ -1,9 +1,14 @@
 package pg
 
 import (
+	"context"
+	"database/sql"
+	"strings"
 	"testing"
 
 	. "github.com/iostrovok/check"
+
+	"github.com/iostrovok/cacheproxy/store"
 )
 
 type testSuite struct{}
@@ -16,3 +21,144 @@ func TestService(t *testing.T) { TestingT(t) }
 func (s *testSuite) Test(c *C) {
 	c.Assert(true, Equals, true)
 }
+
+func (s *testSuite) Test_versions(c *C) {
+	p := &PG{cfg: &Config{Version: "feature-x"}}
+	c.Assert(p.versions(), DeepEquals, []string{"feature-x"})
+
+	p.SetFallbackVersions("develop", "", "feature-x", "main", "develop")
+	c.Assert(p.versions(), DeepEquals, []string{"feature-x", "develop", "main"})
+}
+
+func (s *testSuite) Test_readCache(c *C) {
+	p := &PG{
+		cfg:   &Config{Version: "feature-x", FallbackVersions: []string{"develop", "main"}, UseCache: true},
+		cache: map[[16]byte]*cacheItem{},
+	}
+
+	p.cache[cacheKey("file", "key", "main")] = &cacheItem{value: []byte("main")}
+	out, find := p.readCache("file", "key")
+	c.Assert(find, Equals, true)
+	c.Assert(string(out), Equals, "main")
+
+	p.cache[cacheKey("file", "key", "develop")] = &cacheItem{value: []byte("develop")}
+	out, find = p.readCache("file", "key")
+	c.Assert(find, Equals, true)
+	c.Assert(string(out), Equals, "develop")
+
+	_, find = p.readCache("file", "other-key")
+	c.Assert(find, Equals, false)
+}
+
+func (s *testSuite) Test_Promote_EmptyVersion(c *C) {
+	p := &PG{cfg: &Config{Version: "feature-x"}}
+	_, err := p.Promote("", "main")
+	c.Assert(err, NotNil)
+}
+
+func (s *testSuite) Test_quoteNames(c *C) {
+	cfg := &Config{Table: `my."dat""a"`}
+	cfg.setDefaults()
+
+	n := quoteNames(cfg)
+	c.Assert(n.table, Equals, `"my"."dat""a"`)
+	c.Assert(n.file, Equals, `"file_name"`)
+	c.Assert(n.history(), Equals, `"my"."dat""a_migrations"`)
+
+	cfg = &Config{Table: "dbfiles"}
+	cfg.setDefaults()
+	c.Assert(quoteNames(cfg).table, Equals, `"dbfiles"`)
+
+	// unquoted names are case-insensitive as in SQL
+	cfg = &Config{Table: "Public.Fixtures", KeyCol: "Key"}
+	cfg.setDefaults()
+	n = quoteNames(cfg)
+	c.Assert(n.table, Equals, `"public"."fixtures"`)
+	c.Assert(n.key, Equals, `"key"`)
+
+	// quoted names keep the case and dots
+	cfg = &Config{Table: `"My.Schema"."Fixtures"`}
+	cfg.setDefaults()
+	n = quoteNames(cfg)
+	c.Assert(n.table, Equals, `"My.Schema"."Fixtures"`)
+	c.Assert(n.schema, Equals, "My.Schema")
+	c.Assert(n.bare, Equals, "Fixtures")
+}
+
+func (s *testSuite) Test_buildQueries(c *C) {
+	cfg := &Config{Version: "it's-branch"}
+	cfg.setDefaults()
+
+	p := &PG{cfg: cfg, names: quoteNames(cfg)}
+	p.buildQueries()
+	c.Assert(p.SetVersion(cfg.Version), IsNil)
+
+	for _, query := range []string{p.find, p.upsert, p.promote, p.preload, p.versionsInfo, p.versionsNoTime, p.deleteVersions,
+		p.deleteKeys, p.export} {
+		c.Assert(strings.Contains(query, cfg.Version), Equals, false)
+		c.Assert(strings.Contains(query, `"public"."dbfiles"`), Equals, true)
+	}
+
+	c.Assert(p.SetVersion(""), NotNil)
+}
+
+func (s *testSuite) Test_buildQueriesWithOrigin(c *C) {
+	cfg := &Config{}
+	cfg.setDefaults()
+
+	p := &PG{cfg: cfg, names: quoteNames(cfg)}
+	p.buildQueries()
+	c.Assert(strings.Contains(p.upsert, "$5"), Equals, false)
+	c.Assert(strings.Contains(p.export, "origin_file_name"), Equals, false)
+
+	// original file names are written, copied by Promote and exported
+	p.withOrigin = true
+	p.buildQueries()
+	c.Assert(strings.Contains(p.upsert, `VALUES($1, $2, $3, $4, $5)`), Equals, true)
+	c.Assert(strings.Contains(p.upsert, `"origin_file_name" = EXCLUDED."origin_file_name"`), Equals, true)
+	c.Assert(strings.Contains(p.promote, `"file_name", "key", $2, "data", "origin_file_name"`), Equals, true)
+	c.Assert(strings.Contains(p.export, `COALESCE("origin_file_name", "file_name")`), Equals, true)
+}
+
+// New doesn't connect to the database without AutoMigrate, the table is checked by the first Save
+func (s *testSuite) Test_NewLazy(c *C) {
+	db, err := sql.Open("postgres", "postgres://127.0.0.1:1/none?sslmode=disable&connect_timeout=1")
+	c.Assert(err, IsNil)
+	defer db.Close()
+
+	p, err := New(context.Background(), db, &Config{Version: "main"})
+	c.Assert(err, IsNil)
+	c.Assert(p.(*PG).originKnown, Equals, false)
+
+	c.Assert(p.Save("file", "key", []byte("data")), NotNil)
+	c.Assert(p.(*PG).originKnown, Equals, false)
+
+	_, err = New(context.Background(), db, &Config{Version: "main", AutoMigrate: true})
+	c.Assert(err, NotNil)
+}
+
+func (s *testSuite) Test_migrations(c *C) {
+	for i, m := range migrations {
+		c.Assert(m.id, Equals, i+1)
+		c.Assert(m.statements(names{}), HasLenMoreThan, 0)
+	}
+}
+
+func (s *testSuite) Test_migrationsExistingTable(c *C) {
+	cfg := &Config{}
+	cfg.setDefaults()
+	n := quoteNames(cfg)
+
+	// the table of the old schema has no history, so every migration is applied to it
+	// and columns of character varying(40) are widened for keys of body parts
+	key := store.BodyKey([]byte("body"))
+	c.Assert(len(key) > 40, Equals, true)
+
+	widen := migrations[3]
+	c.Assert(widen.id, Equals, 4)
+	statements := strings.Join(widen.statements(n), " ")
+	for _, col := range []string{n.file, n.key, n.version} {
+		c.Assert(strings.Contains(statements, "ALTER COLUMN "+col+" TYPE character varying"), Equals, true)
+	}
+	c.Assert(strings.Contains(statements, `ALTER TABLE "public"."dbfiles"`), Equals, true)
+}
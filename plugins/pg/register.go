@@ -0,0 +1,33 @@
+package pg
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/pkg/errors"
+
+	"github.com/iostrovok/cacheproxy/config"
+	"github.com/iostrovok/cacheproxy/plugins"
+)
+
+func init() {
+	config.RegisterKeeper("pg", func(ctx context.Context, cfg *config.Config, kc *config.KeeperConfig) (plugins.IPlugin, error) {
+		if kc.DSN == "" {
+			return nil, errors.New("pg keeper: dsn is empty")
+		}
+
+		db, err := sql.Open("postgres", kc.DSN)
+		if err != nil {
+			return nil, errors.Wrap(err, "pg keeper")
+		}
+
+		return New(ctx, db, &Config{
+			Table:            kc.Table,
+			Version:          cfg.Version,
+			FallbackVersions: cfg.FallbackVersions,
+			UseCache:         kc.UseCache,
+			UsePreload:       kc.UsePreload,
+			AutoMigrate:      kc.AutoMigrate,
+		})
+	})
+}
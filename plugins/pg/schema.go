@@ -0,0 +1,238 @@
+package pg
+
+import (
+	"fmt"
+	"strings"
+)
+
+// names keeps quoted names of the table and its columns.
+type names struct {
+	table, file, key, val, version, updated, origin string
+
+	// schema and table name without schema as they're stored by Postgres,
+	// they are used to make names of indexes and the history table
+	schema, bare string
+}
+
+// quoteIdent quotes the name of the table, column and so on.
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// identParts parses the name like Postgres does: parts are separated by dots, unquoted parts are folded
+// to lower case, quoted parts ("MyTable") keep the case and may contain dots and doubled quotes.
+func identParts(name string) []string {
+	parts := make([]string, 0, 2)
+	part := strings.Builder{}
+	quoted := false
+	for i := 0; i < len(name); i++ {
+		ch := name[i]
+		switch {
+		case ch == '"' && quoted && i+1 < len(name) && name[i+1] == '"':
+			part.WriteByte('"')
+			i++
+		case ch == '"':
+			quoted = !quoted
+		case ch == '.' && !quoted:
+			parts = append(parts, part.String())
+			part.Reset()
+		case !quoted && 'A' <= ch && ch <= 'Z':
+			part.WriteByte(ch + 'a' - 'A')
+		default:
+			part.WriteByte(ch)
+		}
+	}
+
+	return append(parts, part.String())
+}
+
+// identName returns the name of the column as it's stored by Postgres.
+func identName(name string) string {
+	return strings.Join(identParts(name), ".")
+}
+
+// splitTable splits the "schema.table" name, schema is empty for the name without schema.
+func splitTable(table string) (string, string) {
+	parts := identParts(table)
+	if len(parts) == 1 {
+		return "", parts[0]
+	}
+	return parts[len(parts)-2], parts[len(parts)-1]
+}
+
+func qualified(schema, name string) string {
+	if schema == "" {
+		return quoteIdent(name)
+	}
+	return quoteIdent(schema) + "." + quoteIdent(name)
+}
+
+func quoteNames(cfg *Config) names {
+	schema, bare := splitTable(cfg.Table)
+	return names{
+		table:   qualified(schema, bare),
+		file:    quoteIdent(identName(cfg.FileCol)),
+		key:     quoteIdent(identName(cfg.KeyCol)),
+		val:     quoteIdent(identName(cfg.ValCol)),
+		version: quoteIdent(identName(cfg.VersionCol)),
+		updated: quoteIdent(identName(cfg.UpdatedCol)),
+		origin:  quoteIdent(identName(cfg.OriginCol)),
+		schema:  schema,
+		bare:    bare,
+	}
+}
+
+// history returns the name of the table with applied migrations.
+func (n names) history() string {
+	return qualified(n.schema, n.bare+"_migrations")
+}
+
+// hasColumn returns true if the table has the column, tables made before some migrations have no new columns.
+func (p *PG) hasColumn(column string) (bool, error) {
+	find := false
+	err := p.db.QueryRowContext(p.ctx, `
+			SELECT EXISTS (
+				SELECT 1 FROM information_schema.columns
+				WHERE table_schema = COALESCE(NULLIF($1, ''), current_schema()) AND table_name = $2 AND column_name = $3
+			)`, p.names.schema, p.names.bare, column).Scan(&find)
+
+	return find, err
+}
+
+// migration is one step of the table changes. Applied migrations are saved in the history table,
+// so new columns and indexes are added by new migrations at the end of the list.
+type migration struct {
+	id         int
+	name       string
+	statements func(n names) []string
+}
+
+var migrations = []migration{
+	{
+		id:   1,
+		name: "create table",
+		statements: func(n names) []string {
+			return []string{fmt.Sprintf(`
+				CREATE TABLE IF NOT EXISTS %s
+				(
+					id SERIAL PRIMARY KEY,
+					%s character varying NOT NULL,
+					%s character varying NOT NULL,
+					%s character varying NOT NULL,
+					%s bytea,
+					CONSTRAINT %s UNIQUE (%s, %s, %s)
+				)`,
+				n.table, n.file, n.key, n.version, n.val,
+				quoteIdent(n.bare+"_uxk"), n.file, n.key, n.version)}
+		},
+	},
+	{
+		id:   2,
+		name: "index by version",
+		statements: func(n names) []string {
+			return []string{fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s ON %s (%s)`,
+				quoteIdent(n.bare+"_version_idx"), n.table, n.version)}
+		},
+	},
+	{
+		id:   3,
+		name: "time of the last write",
+		statements: func(n names) []string {
+			touch := qualified(n.schema, n.bare+"_touch")
+			return []string{
+				fmt.Sprintf(`ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s timestamp with time zone NOT NULL DEFAULT now()`,
+					n.table, n.updated),
+				fmt.Sprintf(`
+					CREATE OR REPLACE FUNCTION %s() RETURNS trigger AS $$
+					BEGIN
+						NEW.%s := now();
+						RETURN NEW;
+					END
+					$$ LANGUAGE plpgsql`, touch, n.updated),
+				fmt.Sprintf(`DROP TRIGGER IF EXISTS %s ON %s`, quoteIdent(n.bare+"_touch"), n.table),
+				fmt.Sprintf(`CREATE TRIGGER %s BEFORE UPDATE ON %s FOR EACH ROW EXECUTE PROCEDURE %s()`,
+					quoteIdent(n.bare+"_touch"), n.table, touch),
+			}
+		},
+	},
+	{
+		// tables made by the old documented schema have character varying(40) columns,
+		// keys of body parts (store.BodyKey) and long branch names don't fit there
+		id:   4,
+		name: "unlimited names, keys and versions",
+		statements: func(n names) []string {
+			return []string{fmt.Sprintf(`
+				ALTER TABLE %s
+				ALTER COLUMN %s TYPE character varying,
+				ALTER COLUMN %s TYPE character varying,
+				ALTER COLUMN %s TYPE character varying`,
+				n.table, n.file, n.key, n.version)}
+		},
+	},
+	{
+		// the file name is MD5 of the original name by default, Export needs the original one
+		id:   5,
+		name: "original file names",
+		statements: func(n names) []string {
+			return []string{fmt.Sprintf(`ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s character varying`,
+				n.table, n.origin)}
+		},
+	},
+}
+
+// EnsureSchema creates the table and indexes from Config or migrates the existing table.
+// Concurrent calls wait for each other, every migration is applied once.
+func (p *PG) EnsureSchema() error {
+	n := p.names
+
+	tx, err := p.db.BeginTx(p.ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(p.ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, n.table); err != nil {
+		return err
+	}
+
+	if n.schema != "" {
+		if _, err := tx.ExecContext(p.ctx, "CREATE SCHEMA IF NOT EXISTS "+quoteIdent(n.schema)); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(p.ctx, fmt.Sprintf(`
+			CREATE TABLE IF NOT EXISTS %s
+			(
+				id INTEGER PRIMARY KEY,
+				name character varying NOT NULL,
+				applied_at timestamp with time zone NOT NULL DEFAULT now()
+			)`, n.history()))
+	if err != nil {
+		return err
+	}
+
+	last := 0
+	if err := tx.QueryRowContext(p.ctx, fmt.Sprintf(`SELECT COALESCE(MAX(id), 0) FROM %s`, n.history())).Scan(&last); err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.id <= last {
+			continue
+		}
+
+		for _, statement := range m.statements(n) {
+			if _, err := tx.ExecContext(p.ctx, statement); err != nil {
+				return fmt.Errorf("migration %d (%s): %w", m.id, m.name, err)
+			}
+		}
+
+		insert := fmt.Sprintf(`INSERT INTO %s (id, name) VALUES ($1, $2)`, n.history())
+		if _, err := tx.ExecContext(p.ctx, insert, m.id, m.name); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
@@ -1,5 +1,10 @@
 package plugins
 
+import (
+	"log/slog"
+	"time"
+)
+
 type IPlugin interface {
 	// Read reads date from storage
 	Read(file, key string) ([]byte, error)
@@ -17,6 +22,68 @@ type IPlugin interface {
 	VerboseMode(bool)
 }
 
+// IFallbackVersions is implemented by plugins which read data of parent versions
+// if data is not found for the current version.
+type IFallbackVersions interface {
+	// SetFallbackVersions sets parent versions in order of priority.
+	SetFallbackVersions(versions ...string)
+}
+
+// IVersion is implemented by plugins which report the version of saved data,
+// it differs from the version of the proxy for plugins which don't scope data by versions.
+type IVersion interface {
+	// Version returns the version of saved data, wrappers return "" if their backends don't report it.
+	Version() string
+}
+
+// VersionInfo describes the stored data of one version.
+type VersionInfo struct {
+	Version   string    `json:"version"`
+	Entries   int64     `json:"entries"`
+	Bytes     int64     `json:"bytes"`
+	LastWrite time.Time `json:"last_write"`
+}
+
+// IVersionManager is implemented by plugins which may list and delete versions of the stored data.
+type IVersionManager interface {
+	// Versions returns all stored versions sorted by name.
+	Versions() ([]VersionInfo, error)
+
+	// DeleteVersions deletes all data of the versions and returns the number of deleted records.
+	DeleteVersions(versions ...string) (int64, error)
+}
+
+// IExporter is implemented by plugins which may enumerate the stored data.
+type IExporter interface {
+	// Export calls fn for every record of the current version.
+	Export(fn func(file, key string, data []byte) error) error
+}
+
+// IDeleter is implemented by plugins which may delete records of the current version.
+type IDeleter interface {
+	// Delete deletes records of the file by keys and returns the number of deleted records.
+	Delete(file string, keys ...string) (int64, error)
+}
+
+// IBodyKey is implemented by plugins which hide stored data, like encrypting ones.
+// Parts of response bodies are stored by BodyKey instead of store.BodyKey then.
+type IBodyKey interface {
+	// BodyKey returns the key of the part of the response body by its content,
+	// wrappers return "" if their backends don't make keys.
+	BodyKey(data []byte) string
+}
+
+// ICloser is implemented by plugins which keep data in memory, handler closes keepers when the proxy stops.
+type ICloser interface {
+	// Close writes data which is not written yet.
+	Close() error
+}
+
+// ISlog is implemented by plugins which write structured logs, config.Setup passes the logger of the proxy.
+type ISlog interface {
+	SetSlog(logger *slog.Logger)
+}
+
 // ILogger is simple interface to output filename and key.
 type ILogger interface {
 	// Printf prints the filename and key
@@ -0,0 +1,19 @@
+package sqlite
+
+import (
+	"context"
+
+	"github.com/iostrovok/cacheproxy/config"
+	"github.com/iostrovok/cacheproxy/plugins"
+)
+
+func init() {
+	config.RegisterKeeper("sqlite", func(ctx context.Context, cfg *config.Config, kc *config.KeeperConfig) (plugins.IPlugin, error) {
+		layer := *cfg
+		if kc.StorePath != "" {
+			layer.StorePath = kc.StorePath
+		}
+
+		return NewWithConfig(ctx, &layer, &Config{Versioned: kc.Versioned}), nil
+	})
+}
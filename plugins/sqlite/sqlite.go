@@ -3,8 +3,13 @@ package sqlite
 import (
 	"context"
 	"database/sql"
+	"io"
+	"log/slog"
+	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/pkg/errors"
 
@@ -15,41 +20,342 @@ import (
 )
 
 type Sqlite struct {
+	mx        sync.RWMutex
 	storePath string
-	verbose   bool
+	log       *slog.Logger
+
+	// versioned is false if data is not scoped by versions, all records have sqlite.DefaultVersion then
+	versioned        bool
+	version          string
+	fallbackVersions []string
+
+	// preloaded records by file name and key, see PreloadByVersion
+	preload bool
+	cache   map[string]map[string][]byte
+}
+
+// Config is settings of the keeper which are not in config.Config.
+type Config struct {
+	// Versioned scopes data by Version and FallbackVersions of config.Config. The keeper is not versioned
+	// by default, like files written before versions are supported, SetVersion returns cerrors.PluginHasNoVersion then.
+	Versioned bool
 }
 
+// New makes the keeper of files in cfg.StorePath which is not versioned, see NewWithConfig.
 func New(ctx context.Context, cfg *config.Config) plugins.IPlugin {
+	return NewWithConfig(ctx, cfg, nil)
+}
+
+// NewWithConfig makes the keeper of files in cfg.StorePath with settings of the keeper.
+func NewWithConfig(ctx context.Context, cfg *config.Config, sc *Config) plugins.IPlugin {
+	if sc == nil {
+		sc = &Config{}
+	}
+
 	sqlite.Init(cfg.SessionMode, ctx)
-	return &Sqlite{
+
+	out := &Sqlite{
 		storePath: cfg.StorePath,
+		log:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+		versioned: sc.Versioned,
+		version:   sqlite.DefaultVersion,
+		cache:     map[string]map[string][]byte{},
 	}
+
+	if out.versioned && cfg.Version != "" {
+		out.version, out.fallbackVersions = cfg.Version, cfg.FallbackVersions
+	}
+
+	return out
 }
 
-// VerboseMode sets up "verbose" mode
+// VerboseMode sets up "verbose" mode: debug lines are written to stdout.
+// Deprecated: use SetSlog.
 func (s *Sqlite) VerboseMode(mode bool) {
-	s.verbose = mode
+	if mode {
+		s.SetSlog(slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	} else {
+		s.SetSlog(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	}
+}
+
+// SetSlog sets the structured logger, reads and saves are logged with slog.LevelDebug.
+func (s *Sqlite) SetSlog(logger *slog.Logger) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.log = logger
 }
 
-func (s *Sqlite) SetVersion(_ string) error {
-	return errors.Wrap(cerrors.PluginHasNoVersion, "sqlite plugin")
+// SetVersion sets the version of saved and read data.
+func (s *Sqlite) SetVersion(version string) error {
+	if !s.versioned {
+		return errors.Wrap(cerrors.PluginHasNoVersion, "sqlite plugin")
+	}
+
+	if version == "" {
+		return errors.Wrap(cerrors.EmptyVersion, "sqlite plugin")
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.version = version
+	s.cache = map[string]map[string][]byte{}
+	return nil
 }
 
+// SetFallbackVersions sets parent versions which are read if data is not found for the current version.
+// They're skipped by the keeper which is not versioned.
+func (s *Sqlite) SetFallbackVersions(versions ...string) {
+	if !s.versioned {
+		return
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.fallbackVersions = versions
+	s.cache = map[string]map[string][]byte{}
+}
+
+// Version returns the version of saved data, it's sqlite.DefaultVersion for the keeper which is not versioned.
+func (s *Sqlite) Version() string {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	return s.version
+}
+
+// PreloadByVersion switches on the preloading: all data of the versions is loaded
+// from the file by 1 request when the file is read first time.
 func (s *Sqlite) PreloadByVersion() error {
-	return errors.Wrap(cerrors.PluginHasNoVersion, "sqlite plugin")
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.preload = true
+	return nil
+}
+
+// versions returns the current version and its fallback versions without duplicates.
+// Records of files which were made before versions are supported have sqlite.DefaultVersion,
+// so it's the last one.
+func (s *Sqlite) versions() []string {
+	out := []string{s.version}
+	candidates := make([]string, 0, len(s.fallbackVersions)+1)
+	candidates = append(candidates, s.fallbackVersions...)
+	for _, v := range append(candidates, sqlite.DefaultVersion) {
+		if v == "" || inList(out, v) {
+			continue
+		}
+		out = append(out, v)
+	}
+
+	return out
+}
+
+func inList(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
 }
 
 func (s *Sqlite) Read(fileName, key string) ([]byte, error) {
-	store, err := sqlite.Select(s.fullFileName(fileName), key)
+	fullFileName := s.fullFileName(fileName)
+
+	s.mx.RLock()
+	preload, versions, log := s.preload, s.versions(), s.log
+	s.mx.RUnlock()
+
+	if preload {
+		out, err := s.readCache(fullFileName, key, versions)
+		log.Debug("sqlite plugin: read", "file", fullFileName, "key", key, "found", len(out) > 0, "preload", true, "error", err)
+		return out, err
+	}
+
+	store, err := sqlite.SelectVersion(fullFileName, key, versions...)
 	if err != nil && err == sql.ErrNoRows {
-		return nil, nil
+		store, err = nil, nil
 	}
 
+	log.Debug("sqlite plugin: read", "file", fullFileName, "key", key, "found", len(store) > 0, "error", err)
 	return store, err
 }
 
+func (s *Sqlite) readCache(fullFileName, key string, versions []string) ([]byte, error) {
+	s.mx.RLock()
+	records, find := s.cache[fullFileName]
+	s.mx.RUnlock()
+
+	if !find {
+		var err error
+		if records, err = sqlite.SelectByVersions(fullFileName, versions...); err != nil {
+			return nil, err
+		}
+
+		s.mx.Lock()
+		s.cache[fullFileName] = records
+		s.mx.Unlock()
+	}
+
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	return records[key], nil
+}
+
 func (s *Sqlite) Save(fileName, key string, data []byte) error {
-	return sqlite.Upsert(s.fullFileName(fileName), key, data)
+	fullFileName := s.fullFileName(fileName)
+
+	s.mx.RLock()
+	version, log := s.version, s.log
+	s.mx.RUnlock()
+
+	log.Debug("sqlite plugin: save", "file", fullFileName, "key", key, "version", version)
+	if err := sqlite.UpsertVersion(fullFileName, key, version, data); err != nil {
+		return err
+	}
+
+	s.mx.Lock()
+	if records, find := s.cache[fullFileName]; find {
+		records[key] = data
+	}
+	s.mx.Unlock()
+
+	return nil
+}
+
+// files returns all files of the store path.
+func (s *Sqlite) files() ([]string, error) {
+	return filepath.Glob(filepath.Join(s.storePath, "*.db"))
+}
+
+// Versions returns stored versions of all files in the store path.
+func (s *Sqlite) Versions() ([]plugins.VersionInfo, error) {
+	files, err := s.files()
+	if err != nil {
+		return nil, err
+	}
+
+	return sumVersions(files, sqlite.Versions)
+}
+
+// ReadVersions returns stored versions of all files in the store path like Sqlite.Versions,
+// but files are opened in the read-only mode and old files are not migrated (see sqlite.ReadVersions).
+func ReadVersions(storePath string) ([]plugins.VersionInfo, error) {
+	files, err := filepath.Glob(filepath.Join(storePath, "*.db"))
+	if err != nil {
+		return nil, err
+	}
+
+	return sumVersions(files, sqlite.ReadVersions)
+}
+
+// sumVersions sums versions of files by their names.
+func sumVersions(files []string, versions func(fileName string) ([]plugins.VersionInfo, error)) ([]plugins.VersionInfo, error) {
+	byVersion := map[string]*plugins.VersionInfo{}
+	for _, file := range files {
+		list, err := versions(file)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, info := range list {
+			total, find := byVersion[info.Version]
+			if !find {
+				total = &plugins.VersionInfo{Version: info.Version}
+				byVersion[info.Version] = total
+			}
+
+			total.Entries += info.Entries
+			total.Bytes += info.Bytes
+			if info.LastWrite.After(total.LastWrite) {
+				total.LastWrite = info.LastWrite
+			}
+		}
+	}
+
+	out := make([]plugins.VersionInfo, 0, len(byVersion))
+	for _, info := range byVersion {
+		out = append(out, *info)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+
+	return out, nil
+}
+
+// DeleteVersions deletes all data of the versions from all files in the store path.
+func (s *Sqlite) DeleteVersions(versions ...string) (int64, error) {
+	files, err := s.files()
+	if err != nil {
+		return 0, err
+	}
+
+	total := int64(0)
+	for _, file := range files {
+		deleted, err := sqlite.DeleteVersions(file, versions...)
+		if err != nil {
+			return total, err
+		}
+		total += deleted
+	}
+
+	s.mx.Lock()
+	s.cache = map[string]map[string][]byte{}
+	s.mx.Unlock()
+
+	return total, nil
+}
+
+// Delete deletes records of the current version from the file by keys.
+func (s *Sqlite) Delete(fileName string, keys ...string) (int64, error) {
+	fullFileName := s.fullFileName(fileName)
+
+	s.mx.RLock()
+	version := s.version
+	s.mx.RUnlock()
+
+	deleted, err := sqlite.DeleteIDs(fullFileName, version, keys...)
+	if err != nil {
+		return deleted, err
+	}
+
+	s.mx.Lock()
+	delete(s.cache, fullFileName)
+	s.mx.Unlock()
+
+	return deleted, nil
+}
+
+// Export calls fn for every record of the current version from all files in the store path.
+func (s *Sqlite) Export(fn func(file, key string, data []byte) error) error {
+	files, err := s.files()
+	if err != nil {
+		return err
+	}
+
+	s.mx.RLock()
+	version := s.version
+	s.mx.RUnlock()
+
+	for _, file := range files {
+		records, err := sqlite.SelectByVersions(file, version)
+		if err != nil {
+			return err
+		}
+
+		name := strings.TrimSuffix(filepath.Base(file), ".db")
+		for key, data := range records {
+			if err := fn(name, key, data); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
 }
 
 func (s *Sqlite) fullFileName(file string) string {
@@ -1,9 +1,16 @@
 package sqlite
 
 import (
+	"context"
+	"errors"
 	"testing"
 
 	. "github.com/iostrovok/check"
+
+	"github.com/iostrovok/cacheproxy/cerrors"
+	"github.com/iostrovok/cacheproxy/config"
+	"github.com/iostrovok/cacheproxy/plugins"
+	"github.com/iostrovok/cacheproxy/sqlite"
 )
 
 type testSuite struct{}
@@ -29,3 +36,132 @@ func (s *testSuite) Test_fullFileName(c *C) {
 	c.Assert(sq.fullFileName("123"), EqualsMore, "/tmp/my-test/123.db")
 	c.Assert(sq.fullFileName("my-super-file"), EqualsMore, "/tmp/my-test/my-super-file.db")
 }
+
+func (s *testSuite) Test_versions(c *C) {
+	sq := &Sqlite{versioned: true, version: "feature-x"}
+	c.Assert(sq.versions(), DeepEquals, []string{"feature-x", "default"})
+
+	sq.SetFallbackVersions("develop", "feature-x", "", "main")
+	c.Assert(sq.versions(), DeepEquals, []string{"feature-x", "develop", "main", "default"})
+
+	c.Assert(sq.SetVersion(""), NotNil)
+	c.Assert(sq.SetVersion("default"), IsNil)
+	c.Assert(sq.versions(), DeepEquals, []string{"default", "develop", "feature-x", "main"})
+}
+
+func (s *testSuite) Test_ReadSave(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &config.Config{StorePath: c.MkDir(), Version: "main"}
+	main := NewWithConfig(ctx, cfg, &Config{Versioned: true})
+	c.Assert(main.Save("file", "key-1", []byte("main-1")), IsNil)
+	c.Assert(main.Save("file", "key-2", []byte("main-2")), IsNil)
+
+	cfg.Version = "feature"
+	cfg.FallbackVersions = []string{"main"}
+	feature := NewWithConfig(ctx, cfg, &Config{Versioned: true})
+	c.Assert(feature.Save("file", "key-1", []byte("feature-1")), IsNil)
+
+	for _, preload := range []bool{false, true} {
+		if preload {
+			c.Assert(feature.PreloadByVersion(), IsNil)
+		}
+
+		body, err := feature.Read("file", "key-1")
+		c.Assert(err, IsNil)
+		c.Assert(body, DeepEquals, []byte("feature-1"))
+
+		body, err = feature.Read("file", "key-2")
+		c.Assert(err, IsNil)
+		c.Assert(body, DeepEquals, []byte("main-2"))
+
+		body, err = feature.Read("file", "key-3")
+		c.Assert(err, IsNil)
+		c.Assert(body, IsNil)
+	}
+
+	// the main version doesn't see data of the feature
+	body, err := main.Read("file", "key-1")
+	c.Assert(err, IsNil)
+	c.Assert(body, DeepEquals, []byte("main-1"))
+}
+
+func (s *testSuite) Test_Export(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &config.Config{StorePath: c.MkDir(), Version: "main"}
+	main := NewWithConfig(ctx, cfg, &Config{Versioned: true})
+	c.Assert(main.Save("file-1", "key-1", []byte("main-1")), IsNil)
+	c.Assert(main.Save("file-2", "key-2", []byte("main-2")), IsNil)
+
+	cfg.Version = "feature"
+	feature := NewWithConfig(ctx, cfg, &Config{Versioned: true})
+	c.Assert(feature.Save("file-1", "key-3", []byte("feature-3")), IsNil)
+
+	exported := map[string]string{}
+	err := main.(plugins.IExporter).Export(func(file, key string, data []byte) error {
+		exported[file+"/"+key] = string(data)
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(exported, DeepEquals, map[string]string{"file-1/key-1": "main-1", "file-2/key-2": "main-2"})
+}
+
+func (s *testSuite) Test_NotVersioned(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// files of the keeper without versions are read and written as before versions are supported,
+	// the version of the config is not used
+	cfg := &config.Config{StorePath: c.MkDir(), Version: "main"}
+	keeper := New(ctx, cfg)
+	c.Assert(errors.Is(keeper.SetVersion("feature"), cerrors.PluginHasNoVersion), Equals, true)
+	keeper.(plugins.IFallbackVersions).SetFallbackVersions("main")
+	c.Assert(keeper.(plugins.IVersion).Version(), Equals, sqlite.DefaultVersion)
+
+	c.Assert(keeper.Save("file", "key", []byte("data")), IsNil)
+	body, err := keeper.Read("file", "key")
+	c.Assert(err, IsNil)
+	c.Assert(body, DeepEquals, []byte("data"))
+
+	// the registered keeper is versioned if it's asked only
+	cfg.Version = "feature"
+	keeper, err = config.NewKeeper(ctx, cfg, &config.KeeperConfig{Type: "sqlite"})
+	c.Assert(err, IsNil)
+	c.Assert(keeper.(plugins.IVersion).Version(), Equals, sqlite.DefaultVersion)
+
+	body, err = keeper.Read("file", "key")
+	c.Assert(err, IsNil)
+	c.Assert(body, DeepEquals, []byte("data"))
+
+	keeper, err = config.NewKeeper(ctx, cfg, &config.KeeperConfig{Type: "sqlite", Versioned: true})
+	c.Assert(err, IsNil)
+	c.Assert(keeper.(plugins.IVersion).Version(), Equals, "feature")
+
+	// data written before versions is read by the versioned keeper as the last fallback
+	body, err = keeper.Read("file", "key")
+	c.Assert(err, IsNil)
+	c.Assert(body, DeepEquals, []byte("data"))
+}
+
+func (s *testSuite) Test_ReadVersions(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &config.Config{StorePath: c.MkDir(), Version: "main"}
+	keeper := NewWithConfig(ctx, cfg, &Config{Versioned: true})
+	c.Assert(keeper.Save("file-1", "key-1", []byte("main-1")), IsNil)
+	c.Assert(keeper.Save("file-2", "key-2", []byte("main-2")), IsNil)
+
+	list, err := ReadVersions(cfg.StorePath)
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 1)
+	c.Assert(list[0].Version, Equals, "main")
+	c.Assert(list[0].Entries, Equals, int64(2))
+
+	all, err := keeper.(plugins.IVersionManager).Versions()
+	c.Assert(err, IsNil)
+	c.Assert(all, DeepEquals, list)
+}
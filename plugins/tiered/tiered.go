@@ -0,0 +1,411 @@
+package tiered
+
+import (
+	"container/list"
+	"io"
+	"log/slog"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/iostrovok/cacheproxy/cerrors"
+	"github.com/iostrovok/cacheproxy/plugins"
+)
+
+// DefaultMaxBytes is the default size of the cached data.
+const DefaultMaxBytes int64 = 256 << 20
+
+type Config struct {
+	// MaxBytes is the maximum size of the cached data, DefaultMaxBytes is used if it's 0.
+	// The least recently used data is evicted first.
+	MaxBytes int64
+
+	// If WriteBack is true Save puts data to the cache only. Data is written to the backend
+	// when it's evicted, by Flush or by Close.
+	// Data is written to the backend and to the cache at the same time by default (write-through).
+	WriteBack bool
+}
+
+// Stats are counters of the cache.
+type Stats struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+	Entries   int   `json:"entries"`
+	Bytes     int64 `json:"bytes"`
+	Dirty     int   `json:"dirty"` // entries which are not written to the backend yet
+}
+
+type entry struct {
+	file, key string
+	data      []byte
+	dirty     bool
+}
+
+// Tiered is the in-memory LRU cache in front of any plugin.
+type Tiered struct {
+	mx sync.Mutex
+
+	backend plugins.IPlugin
+	cfg     *Config
+
+	ll    *list.List
+	items map[string]*list.Element
+	size  int64
+	stats Stats
+
+	// evicted entries which are being written to the backend, they're read from here until they're written
+	pending map[string]*entry
+
+	// data is written to the backend at once after Close
+	closed bool
+
+	log *slog.Logger
+}
+
+// New wraps the backend by the cache. Use (*Tiered).Stats and (*Tiered).Flush by type assertion.
+// Close writes data which is not written yet in the write-back mode, handler calls it when the proxy stops.
+func New(backend plugins.IPlugin, cfg *Config) plugins.IPlugin {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = DefaultMaxBytes
+	}
+
+	return &Tiered{
+		backend: backend,
+		cfg:     cfg,
+		ll:      list.New(),
+		items:   map[string]*list.Element{},
+		pending: map[string]*entry{},
+		log:     slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+}
+
+func itemKey(file, key string) string {
+	return file + "#--#" + key
+}
+
+// cached returns data of the cache or data which is being written to the backend.
+// It's called under the lock.
+func (t *Tiered) cached(k string) ([]byte, bool) {
+	if el, find := t.items[k]; find {
+		t.ll.MoveToFront(el)
+		return el.Value.(*entry).data, true
+	}
+	if e, find := t.pending[k]; find {
+		return e.data, true
+	}
+	return nil, false
+}
+
+func (t *Tiered) Read(file, key string) ([]byte, error) {
+	k := itemKey(file, key)
+
+	t.mx.Lock()
+	if data, find := t.cached(k); find {
+		t.stats.Hits++
+		t.mx.Unlock()
+
+		out := make([]byte, len(data))
+		copy(out, data)
+		return out, nil
+	}
+	t.stats.Misses++
+	t.mx.Unlock()
+
+	data, err := t.backend.Read(file, key)
+	if err != nil || len(data) == 0 {
+		return data, err
+	}
+
+	// the concurrent Save may put newer data
+	var evicted []*entry
+	t.mx.Lock()
+	if _, find := t.cached(k); !find {
+		evicted = t.put(file, key, data, false)
+	}
+	t.mx.Unlock()
+
+	t.save(evicted)
+	return data, nil
+}
+
+func (t *Tiered) Save(file, key string, data []byte) error {
+	stored := make([]byte, len(data))
+	copy(stored, data)
+
+	// too large data is not cached
+	t.mx.Lock()
+	dirty := t.cfg.WriteBack && !t.closed && int64(len(stored)) <= t.cfg.MaxBytes
+	if dirty {
+		evicted := t.put(file, key, stored, true)
+		t.mx.Unlock()
+
+		t.save(evicted)
+		return nil
+	}
+	t.mx.Unlock()
+
+	if err := t.backend.Save(file, key, stored); err != nil {
+		return err
+	}
+
+	t.mx.Lock()
+	evicted := t.put(file, key, stored, false)
+	t.mx.Unlock()
+
+	t.save(evicted)
+	return nil
+}
+
+// put adds data to the cache and evicts old entries. It's called under the lock.
+// Evicted entries which are not written yet are returned and kept in pending until save writes them.
+func (t *Tiered) put(file, key string, data []byte, dirty bool) []*entry {
+	k := itemKey(file, key)
+	if el, find := t.items[k]; find {
+		e := el.Value.(*entry)
+		t.size -= int64(len(e.data))
+		e.data = data
+		e.dirty = dirty
+		t.size += int64(len(data))
+		t.ll.MoveToFront(el)
+	} else if int64(len(data)) <= t.cfg.MaxBytes {
+		t.items[k] = t.ll.PushFront(&entry{file: file, key: key, data: data, dirty: dirty})
+		t.size += int64(len(data))
+	}
+
+	var evicted []*entry
+	for t.size > t.cfg.MaxBytes {
+		el := t.ll.Back()
+		e := el.Value.(*entry)
+		if e.dirty {
+			t.pending[itemKey(e.file, e.key)] = e
+			evicted = append(evicted, e)
+		}
+
+		t.ll.Remove(el)
+		delete(t.items, itemKey(e.file, e.key))
+		t.size -= int64(len(e.data))
+		t.stats.Evictions++
+	}
+
+	return evicted
+}
+
+// save writes evicted entries to the backend. The entry which is not written is put back to the cache
+// as dirty one, so it's written by the next eviction or Flush. Errors are logged only:
+// they belong to other keys, not to the key of the caller.
+func (t *Tiered) save(evicted []*entry) {
+	for _, e := range evicted {
+		err := t.backend.Save(e.file, e.key, e.data)
+
+		k := itemKey(e.file, e.key)
+		t.mx.Lock()
+		// Flush or Delete may handle the entry before
+		if t.pending[k] == e {
+			delete(t.pending, k)
+			if _, find := t.items[k]; err != nil && !find {
+				t.items[k] = t.ll.PushBack(e)
+				t.size += int64(len(e.data))
+			}
+		}
+		t.mx.Unlock()
+
+		if err != nil {
+			t.log.Error("tiered plugin: evicted data is not written", "file", e.file, "key", e.key, "error", err)
+		}
+	}
+}
+
+// Flush writes all data which is not written yet to the backend.
+func (t *Tiered) Flush() error {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	return t.flush()
+}
+
+// Close writes all data which is not written yet, data saved later is written to the backend at once.
+func (t *Tiered) Close() error {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	t.closed = true
+	return t.flush()
+}
+
+func (t *Tiered) flush() error {
+	for k, e := range t.pending {
+		if err := t.backend.Save(e.file, e.key, e.data); err != nil {
+			return err
+		}
+		delete(t.pending, k)
+	}
+
+	for el := t.ll.Back(); el != nil; el = el.Prev() {
+		e := el.Value.(*entry)
+		if !e.dirty {
+			continue
+		}
+
+		if err := t.backend.Save(e.file, e.key, e.data); err != nil {
+			return err
+		}
+		e.dirty = false
+	}
+
+	return nil
+}
+
+// reset writes data which is not written yet and cleans the cache.
+func (t *Tiered) reset() error {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	if err := t.flush(); err != nil {
+		return err
+	}
+
+	t.ll.Init()
+	t.items = map[string]*list.Element{}
+	t.size = 0
+	return nil
+}
+
+// Stats returns counters of the cache.
+func (t *Tiered) Stats() Stats {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	out := t.stats
+	out.Entries = t.ll.Len()
+	out.Bytes = t.size
+	out.Dirty = len(t.pending)
+	for el := t.ll.Front(); el != nil; el = el.Next() {
+		if el.Value.(*entry).dirty {
+			out.Dirty++
+		}
+	}
+
+	return out
+}
+
+// SetVersion sets the version of the backend, the cache is cleaned.
+func (t *Tiered) SetVersion(version string) error {
+	if err := t.reset(); err != nil {
+		return err
+	}
+
+	return t.backend.SetVersion(version)
+}
+
+// SetFallbackVersions passes fallback versions to the backend if it supports them, the cache is cleaned.
+func (t *Tiered) SetFallbackVersions(versions ...string) {
+	backend, ok := t.backend.(plugins.IFallbackVersions)
+	if !ok {
+		return
+	}
+
+	// data which is not written yet belongs to the current versions
+	if err := t.reset(); err != nil {
+		t.log.Error("tiered plugin: data is not written before fallback versions are changed", "error", err)
+	}
+
+	backend.SetFallbackVersions(versions...)
+}
+
+// Version returns the version of the backend, it's empty if the backend doesn't report it.
+func (t *Tiered) Version() string {
+	if backend, ok := t.backend.(plugins.IVersion); ok {
+		return backend.Version()
+	}
+
+	return ""
+}
+
+// Versions lists versions of the backend if it supports managing versions.
+func (t *Tiered) Versions() ([]plugins.VersionInfo, error) {
+	backend, ok := t.backend.(plugins.IVersionManager)
+	if !ok {
+		return nil, errors.Wrap(cerrors.NotSupported, "tiered plugin")
+	}
+
+	return backend.Versions()
+}
+
+// DeleteVersions writes and cleans the cache and deletes versions of the backend if it supports managing versions.
+func (t *Tiered) DeleteVersions(versions ...string) (int64, error) {
+	backend, ok := t.backend.(plugins.IVersionManager)
+	if !ok {
+		return 0, errors.Wrap(cerrors.NotSupported, "tiered plugin")
+	}
+
+	if err := t.reset(); err != nil {
+		return 0, err
+	}
+
+	return backend.DeleteVersions(versions...)
+}
+
+// BodyKey returns the key of the part of the response body made by the backend, it's empty if the backend doesn't make keys.
+func (t *Tiered) BodyKey(data []byte) string {
+	if backend, ok := t.backend.(plugins.IBodyKey); ok {
+		return backend.BodyKey(data)
+	}
+
+	return ""
+}
+
+// Delete deletes records from the cache and the backend if it supports deleting.
+func (t *Tiered) Delete(file string, keys ...string) (int64, error) {
+	backend, ok := t.backend.(plugins.IDeleter)
+	if !ok {
+		return 0, errors.Wrap(cerrors.NotSupported, "tiered plugin")
+	}
+
+	t.mx.Lock()
+	for _, key := range keys {
+		delete(t.pending, itemKey(file, key))
+		if el, find := t.items[itemKey(file, key)]; find {
+			t.ll.Remove(el)
+			delete(t.items, itemKey(file, key))
+			t.size -= int64(len(el.Value.(*entry).data))
+		}
+	}
+	t.mx.Unlock()
+
+	return backend.Delete(file, keys...)
+}
+
+// Export writes data which is not written yet and exports records of the backend if it supports exporting.
+func (t *Tiered) Export(fn func(file, key string, data []byte) error) error {
+	backend, ok := t.backend.(plugins.IExporter)
+	if !ok {
+		return errors.Wrap(cerrors.NotSupported, "tiered plugin")
+	}
+
+	if err := t.Flush(); err != nil {
+		return err
+	}
+
+	return backend.Export(fn)
+}
+
+func (t *Tiered) PreloadByVersion() error {
+	return t.backend.PreloadByVersion()
+}
+
+// VerboseMode sets up "verbose" mode
+func (t *Tiered) VerboseMode(mode bool) {
+	t.backend.VerboseMode(mode)
+}
+
+// SetSlog sets the structured logger and passes it to the backend if it supports it.
+func (t *Tiered) SetSlog(logger *slog.Logger) {
+	t.log = logger
+	if backend, ok := t.backend.(plugins.ISlog); ok {
+		backend.SetSlog(logger)
+	}
+}
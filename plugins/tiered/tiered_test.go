@@ -0,0 +1,236 @@
+package tiered
+
+import (
+	"errors"
+	"testing"
+
+	. "github.com/iostrovok/check"
+
+	"github.com/iostrovok/cacheproxy/cerrors"
+	"github.com/iostrovok/cacheproxy/plugins/internal/memkeeper"
+)
+
+type testSuite struct{}
+
+var _ = Suite(&testSuite{})
+
+func TestService(t *testing.T) { TestingT(t) }
+
+func (s *testSuite) TestWriteThrough(c *C) {
+	backend := memkeeper.New()
+	keeper := New(backend, &Config{MaxBytes: 10}).(*Tiered)
+
+	c.Assert(keeper.Save("file", "a", []byte("12345")), IsNil)
+	c.Assert(backend.Saves, Equals, 1)
+
+	data, err := keeper.Read("file", "a")
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "12345")
+	c.Assert(backend.Reads, Equals, 0)
+
+	// "a" is evicted
+	c.Assert(keeper.Save("file", "b", []byte("123456")), IsNil)
+	data, err = keeper.Read("file", "a")
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "12345")
+	c.Assert(backend.Reads, Equals, 1)
+
+	// missed data is not cached
+	data, err = keeper.Read("file", "c")
+	c.Assert(err, IsNil)
+	c.Assert(data, IsNil)
+
+	stats := keeper.Stats()
+	c.Assert(stats.Hits, Equals, int64(1))
+	c.Assert(stats.Misses, Equals, int64(2))
+	c.Assert(stats.Evictions, Equals, int64(2))
+	c.Assert(stats.Entries, Equals, 1)
+	c.Assert(stats.Bytes, Equals, int64(5))
+	c.Assert(stats.Dirty, Equals, 0)
+}
+
+func (s *testSuite) TestWriteBack(c *C) {
+	backend := memkeeper.New()
+	keeper := New(backend, &Config{MaxBytes: 10, WriteBack: true}).(*Tiered)
+
+	c.Assert(keeper.Save("file", "a", []byte("12345")), IsNil)
+	c.Assert(keeper.Save("file", "b", []byte("123")), IsNil)
+	c.Assert(backend.Saves, Equals, 0)
+	c.Assert(keeper.Stats().Dirty, Equals, 2)
+
+	// "a" is evicted and written
+	c.Assert(keeper.Save("file", "c", []byte("1234")), IsNil)
+	c.Assert(backend.Saves, Equals, 1)
+	c.Assert(string(backend.Data[memkeeper.Key("file", "a")]), Equals, "12345")
+
+	// too large data is written at once
+	c.Assert(keeper.Save("file", "d", []byte("12345678901")), IsNil)
+	c.Assert(backend.Saves, Equals, 2)
+
+	c.Assert(keeper.Flush(), IsNil)
+	c.Assert(backend.Saves, Equals, 4)
+	c.Assert(string(backend.Data[memkeeper.Key("file", "b")]), Equals, "123")
+	c.Assert(string(backend.Data[memkeeper.Key("file", "c")]), Equals, "1234")
+	c.Assert(keeper.Stats().Dirty, Equals, 0)
+
+	// the cache is written and cleaned before the version is changed
+	c.Assert(keeper.Save("file", "e", []byte("1")), IsNil)
+	c.Assert(keeper.SetVersion("next"), IsNil)
+	c.Assert(backend.Version, Equals, "next")
+	c.Assert(backend.Saves, Equals, 5)
+	c.Assert(keeper.Stats().Entries, Equals, 0)
+}
+
+// fallbackMemory supports fallback versions, it checks that evicted data is not written under the lock of the cache.
+type fallbackMemory struct {
+	*memkeeper.Keeper
+	keeper    *Tiered
+	fallbacks []string
+}
+
+func (m *fallbackMemory) Save(file, key string, data []byte) error {
+	if m.keeper != nil {
+		if !m.keeper.mx.TryLock() {
+			return errors.New("data is written under the lock")
+		}
+		m.keeper.mx.Unlock()
+	}
+
+	return m.Keeper.Save(file, key, data)
+}
+
+func (m *fallbackMemory) SetFallbackVersions(versions ...string) {
+	m.fallbacks = versions
+}
+
+func (s *testSuite) TestFallbackVersions(c *C) {
+	backend := &fallbackMemory{Keeper: memkeeper.New()}
+	keeper := New(backend, &Config{MaxBytes: 10, WriteBack: true}).(*Tiered)
+	backend.keeper = keeper
+
+	// "a" is evicted and written after unlocking
+	c.Assert(keeper.Save("file", "a", []byte("12345")), IsNil)
+	c.Assert(keeper.Save("file", "b", []byte("123456")), IsNil)
+	c.Assert(backend.Saves, Equals, 1)
+
+	// the cache is written and cleaned before fallback versions are changed
+	backend.keeper = nil
+	keeper.SetFallbackVersions("main")
+	c.Assert(backend.fallbacks, DeepEquals, []string{"main"})
+	c.Assert(backend.Saves, Equals, 2)
+	c.Assert(string(backend.Data[memkeeper.Key("file", "b")]), Equals, "123456")
+	c.Assert(keeper.Stats().Entries, Equals, 0)
+}
+
+// slowMemory blocks writing of evicted data until it's released, the write fails if fail is set.
+type slowMemory struct {
+	*memkeeper.Keeper
+	started, release chan struct{}
+	fail             bool
+}
+
+func (m *slowMemory) Save(file, key string, data []byte) error {
+	if m.started != nil {
+		m.started <- struct{}{}
+		<-m.release
+	}
+	if m.fail {
+		return errors.New("backend is broken")
+	}
+
+	return m.Keeper.Save(file, key, data)
+}
+
+func (s *testSuite) TestPending(c *C) {
+	backend := &slowMemory{Keeper: memkeeper.New(), started: make(chan struct{}), release: make(chan struct{})}
+	keeper := New(backend, &Config{MaxBytes: 10, WriteBack: true}).(*Tiered)
+
+	c.Assert(keeper.Save("file", "a", []byte("12345")), IsNil)
+
+	// "a" is evicted, it's read from the cache until it's written
+	saved := make(chan error)
+	go func() { saved <- keeper.Save("file", "b", []byte("123456")) }()
+	<-backend.started
+
+	data, err := keeper.Read("file", "a")
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "12345")
+	c.Assert(backend.Reads, Equals, 0)
+	c.Assert(keeper.Stats().Dirty, Equals, 2)
+
+	close(backend.release)
+	c.Assert(<-saved, IsNil)
+	c.Assert(string(backend.Data[memkeeper.Key("file", "a")]), Equals, "12345")
+	c.Assert(keeper.Stats().Dirty, Equals, 1)
+}
+
+func (s *testSuite) TestEvictionError(c *C) {
+	backend := &slowMemory{Keeper: memkeeper.New(), fail: true}
+	keeper := New(backend, &Config{MaxBytes: 10, WriteBack: true}).(*Tiered)
+
+	c.Assert(keeper.Save("file", "a", []byte("12345")), IsNil)
+
+	// "a" is evicted, it's put back to the cache after the error
+	c.Assert(keeper.Save("file", "b", []byte("123456")), IsNil)
+	data, err := keeper.Read("file", "a")
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "12345")
+	c.Assert(backend.Reads, Equals, 0)
+
+	// the error of "a" is not the error of the reader of "c"
+	backend.Data[memkeeper.Key("file", "c")] = []byte("1234")
+	data, err = keeper.Read("file", "c")
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "1234")
+	c.Assert(keeper.Stats().Dirty, Equals, 2)
+
+	backend.fail = false
+	c.Assert(keeper.Flush(), IsNil)
+	c.Assert(string(backend.Data[memkeeper.Key("file", "a")]), Equals, "12345")
+	c.Assert(string(backend.Data[memkeeper.Key("file", "b")]), Equals, "123456")
+}
+
+func (s *testSuite) TestClose(c *C) {
+	backend := memkeeper.New()
+	keeper := New(backend, &Config{MaxBytes: 10, WriteBack: true}).(*Tiered)
+
+	c.Assert(keeper.Save("file", "a", []byte("12345")), IsNil)
+	c.Assert(backend.Saves, Equals, 0)
+
+	c.Assert(keeper.Close(), IsNil)
+	c.Assert(backend.Saves, Equals, 1)
+
+	// data is written at once after Close
+	c.Assert(keeper.Save("file", "b", []byte("1")), IsNil)
+	c.Assert(backend.Saves, Equals, 2)
+	c.Assert(keeper.Stats().Dirty, Equals, 0)
+}
+
+func (s *testSuite) TestForward(c *C) {
+	backend := memkeeper.NewManaged()
+	keeper := New(backend, &Config{MaxBytes: 10, WriteBack: true}).(*Tiered)
+	c.Assert(keeper.SetVersion("main"), IsNil)
+	c.Assert(keeper.Version(), Equals, "main")
+
+	// data which is not written yet is deleted with its version
+	c.Assert(keeper.Save("file", "a", []byte("12345")), IsNil)
+	deleted, err := keeper.DeleteVersions("main")
+	c.Assert(err, IsNil)
+	c.Assert(deleted, Equals, int64(1))
+	c.Assert(keeper.Stats().Entries, Equals, 0)
+
+	data, err := keeper.Read("file", "a")
+	c.Assert(err, IsNil)
+	c.Assert(data, IsNil)
+
+	list, err := keeper.Versions()
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 1)
+	c.Assert(keeper.BodyKey([]byte("1")), Equals, "")
+
+	// the backend without versions
+	keeper = New(memkeeper.New(), nil).(*Tiered)
+	c.Assert(keeper.Version(), Equals, "")
+	_, err = keeper.Versions()
+	c.Assert(errors.Is(err, cerrors.NotSupported), Equals, true)
+}
@@ -0,0 +1,250 @@
+package signer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Signer signs requests to upstream. The client signs requests for the proxy host,
+// so the proxy removes its signature and signs the request again for upstream.
+type Signer interface {
+	// Headers returns names of headers which are set by Sign. They're removed from requests of clients,
+	// so they're not a part of the cache key and of the stored request.
+	Headers() []string
+
+	// Sign signs the request with the body, the host of the request is the upstream one.
+	Sign(req *http.Request, body []byte) error
+}
+
+// Strip removes signature headers of the signer from the request.
+func Strip(s Signer, req *http.Request) {
+	for _, name := range s.Headers() {
+		req.Header.Del(name)
+	}
+}
+
+func host(req *http.Request) string {
+	if req.Host != "" {
+		return req.Host
+	}
+	return req.URL.Host
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSum(h func() hash.Hash, key []byte, data string) []byte {
+	mac := hmac.New(h, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// SigV4 signs requests by AWS Signature Version 4:
+// https://docs.aws.amazon.com/IAM/latest/UserGuide/reference_sigv-create-signed-request.html
+// The host, Content-Type and all X-Amz-* headers are signed.
+type SigV4 struct {
+	AccessKey, SecretKey string
+
+	// SessionToken is set to X-Amz-Security-Token if it's not empty.
+	SessionToken string
+
+	Region, Service string
+
+	// If ContentSHA256 is true the hash of the body is set to X-Amz-Content-Sha256, S3 requires it.
+	ContentSHA256 bool
+
+	// If S3 is true segments of the path are URI-encoded once, as S3 requires.
+	// Other services get them encoded twice.
+	S3 bool
+
+	// Now returns the time of signing, time.Now is used if it's nil.
+	Now func() time.Time
+}
+
+func (s *SigV4) Headers() []string {
+	return []string{"Authorization", "X-Amz-Date", "X-Amz-Content-Sha256", "X-Amz-Security-Token"}
+}
+
+func (s *SigV4) Sign(req *http.Request, body []byte) error {
+	now := time.Now
+	if s.Now != nil {
+		now = s.Now
+	}
+	t := now().UTC()
+	amzDate, date := t.Format("20060102T150405Z"), t.Format("20060102")
+
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	if s.ContentSHA256 {
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+	if s.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+
+	headers := map[string]string{"host": strings.TrimSpace(host(req))}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "content-type" || strings.HasPrefix(name, "x-amz-") {
+			trimmed := make([]string, 0, len(values))
+			for _, v := range values {
+				trimmed = append(trimmed, strings.Join(strings.Fields(v), " "))
+			}
+			headers[name] = strings.Join(trimmed, ",")
+		}
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	canonicalHeaders := &strings.Builder{}
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI(req.URL, s.S3),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.Region + "/" + s.Service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSum(sha256.New, []byte("AWS4"+s.SecretKey), date)
+	key = hmacSum(sha256.New, key, s.Region)
+	key = hmacSum(sha256.New, key, s.Service)
+	key = hmacSum(sha256.New, key, "aws4_request")
+	signature := hex.EncodeToString(hmacSum(sha256.New, key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+
+	return nil
+}
+
+// canonicalURI returns the path with URI-encoded segments. The escaped path is encoded again for all services
+// except S3, S3 gets decoded segments encoded once.
+func canonicalURI(u *url.URL, s3 bool) string {
+	path := u.EscapedPath()
+	if path == "" {
+		return "/"
+	}
+
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if s3 {
+			if decoded, err := url.PathUnescape(segment); err == nil {
+				segment = decoded
+			}
+		}
+		segments[i] = uriEncode(segment)
+	}
+
+	return strings.Join(segments, "/")
+}
+
+// canonicalQuery returns the query sorted by encoded names and by encoded values of the same name,
+// they're encoded by RFC 3986.
+func canonicalQuery(query url.Values) string {
+	type pair struct{ name, value string }
+	pairs := make([]pair, 0, len(query))
+	for name, values := range query {
+		for _, v := range values {
+			pairs = append(pairs, pair{uriEncode(name), uriEncode(v)})
+		}
+	}
+
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].name != pairs[j].name {
+			return pairs[i].name < pairs[j].name
+		}
+		return pairs[i].value < pairs[j].value
+	})
+
+	parts := make([]string, 0, len(pairs))
+	for _, p := range pairs {
+		parts = append(parts, p.name+"="+p.value)
+	}
+	return strings.Join(parts, "&")
+}
+
+func uriEncode(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+// HMAC signs requests by the shared secret. The signature is the hex HMAC of the string
+//
+//	method + "\n" + path?query + "\n" + timestamp + "\n" + hex(sha256(body))
+//
+// and it's set to Header as Prefix + signature. The timestamp (20060102T150405Z in UTC) is set to TimestampHeader.
+type HMAC struct {
+	Secret []byte
+
+	// Header is the header of the signature, "Authorization" by default.
+	Header string
+
+	// Prefix is added before the signature, for example "HMAC key-id:".
+	Prefix string
+
+	// TimestampHeader is the header of the time of signing, "X-Timestamp" by default.
+	TimestampHeader string
+
+	// Hash is the hash function, sha256.New by default.
+	Hash func() hash.Hash
+
+	// Now returns the time of signing, time.Now is used if it's nil.
+	Now func() time.Time
+}
+
+func (s *HMAC) header() string {
+	if s.Header == "" {
+		return "Authorization"
+	}
+	return s.Header
+}
+
+func (s *HMAC) timestampHeader() string {
+	if s.TimestampHeader == "" {
+		return "X-Timestamp"
+	}
+	return s.TimestampHeader
+}
+
+func (s *HMAC) Headers() []string {
+	return []string{s.header(), s.timestampHeader()}
+}
+
+func (s *HMAC) Sign(req *http.Request, body []byte) error {
+	now, h := time.Now, s.Hash
+	if s.Now != nil {
+		now = s.Now
+	}
+	if h == nil {
+		h = sha256.New
+	}
+
+	timestamp := now().UTC().Format("20060102T150405Z")
+	data := req.Method + "\n" + req.URL.RequestURI() + "\n" + timestamp + "\n" + sha256Hex(body)
+
+	req.Header.Set(s.timestampHeader(), timestamp)
+	req.Header.Set(s.header(), s.Prefix+hex.EncodeToString(hmacSum(h, s.Secret, data)))
+
+	return nil
+}
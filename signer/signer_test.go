@@ -0,0 +1,123 @@
+package signer
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	. "github.com/iostrovok/check"
+)
+
+type testSuite struct{}
+
+var _ = Suite(&testSuite{})
+
+func TestService(t *testing.T) { TestingT(t) }
+
+var signTime = func() time.Time { return time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC) }
+
+// "get-vanilla" and "get-vanilla-query-order-key-case" of the AWS test suite
+func (s *testSuite) TestSigV4(c *C) {
+	sig := &SigV4{
+		AccessKey: "AKIDEXAMPLE",
+		SecretKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		Region:    "us-east-1",
+		Service:   "service",
+		Now:       signTime,
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	c.Assert(err, IsNil)
+	c.Assert(sig.Sign(req, nil), IsNil)
+	c.Assert(req.Header.Get("X-Amz-Date"), Equals, "20150830T123600Z")
+	c.Assert(req.Header.Get("Authorization"), Equals, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, "+
+		"SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31")
+
+	req, err = http.NewRequest(http.MethodGet, "https://example.amazonaws.com/?Param2=value2&Param1=value1", nil)
+	c.Assert(err, IsNil)
+	c.Assert(sig.Sign(req, nil), IsNil)
+	c.Assert(req.Header.Get("Authorization"), Equals, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, "+
+		"SignedHeaders=host;x-amz-date, Signature=b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500")
+
+	Strip(sig, req)
+	c.Assert(req.Header, DeepEquals, http.Header{})
+}
+
+// values of the same name are sorted by value, names with the shared prefix are sorted by the whole name:
+// "a" < "a-b" < "a1" though "a1=x" < "a=y" by bytes. Signatures are checked by aws-sdk-go-v2 signer.
+func (s *testSuite) TestSigV4QueryOrder(c *C) {
+	sig := &SigV4{
+		AccessKey: "AKIDEXAMPLE",
+		SecretKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		Region:    "us-east-1",
+		Service:   "service",
+		Now:       signTime,
+	}
+
+	c.Assert(canonicalQuery(url.Values{"a1": {"x"}, "a": {"y", "b"}, "a-b": {"z"}}), Equals, "a=b&a=y&a-b=z&a1=x")
+
+	for query, signature := range map[string]string{
+		"Param1=value2&Param1=Value1": "eedbc4e291e521cf13422ffca22be7d2eb8146eecf653089df300a15b2382bd1",
+		"a1=x&a=y&a-b=z&a=b":          "9823ff4661a857591ea1c0482c7adb2d7337274901c07ef63bc5cea141f82822",
+	} {
+		req, err := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/?"+query, nil)
+		c.Assert(err, IsNil)
+		c.Assert(sig.Sign(req, nil), IsNil)
+		c.Assert(req.Header.Get("Authorization"), Equals, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, "+
+			"SignedHeaders=host;x-amz-date, Signature="+signature, Commentf("%s", query))
+	}
+}
+
+// "get-space" and "get-utf8" of the AWS test suite encode the path once, as S3 does.
+// Signatures of the path encoded twice are checked by aws-sdk-go-v2 signer.
+func (s *testSuite) TestSigV4Path(c *C) {
+	c.Assert(canonicalURI(&url.URL{Path: "/documents and settings/"}, false), Equals, "/documents%2520and%2520settings/")
+	c.Assert(canonicalURI(&url.URL{Path: "/documents and settings/"}, true), Equals, "/documents%20and%20settings/")
+	c.Assert(canonicalURI(&url.URL{Path: "/a(1)/b", RawPath: "/a(1)/b"}, true), Equals, "/a%281%29/b")
+	c.Assert(canonicalURI(&url.URL{Path: "/a/b", RawPath: "/a%2Fb"}, true), Equals, "/a%2Fb")
+	c.Assert(canonicalURI(&url.URL{}, false), Equals, "/")
+
+	for _, tc := range []struct {
+		path      string
+		s3        bool
+		signature string
+	}{
+		{"/example%20space/", true, "652487583200325589f1fba4c7e578f72c47cb61beeca81406b39ddec1366741"},
+		{"/%E1%88%B4", true, "8318018e0b0f223aa2bbf98705b62bb787dc9c0e678f255a891fd03141be5d85"},
+		{"/example%20space/", false, "446b817944c553435b35e813c261ff4e161fff982d1bacdef1c87f6785dd1662"},
+		{"/%E1%88%B4", false, "697b34846207a3f72246f99d74ae1ee4fe54f44bb06730c58a0d339eb079596d"},
+	} {
+		sig := &SigV4{
+			AccessKey: "AKIDEXAMPLE",
+			SecretKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+			Region:    "us-east-1",
+			Service:   "service",
+			S3:        tc.s3,
+			Now:       signTime,
+		}
+
+		req, err := http.NewRequest(http.MethodGet, "https://example.amazonaws.com"+tc.path, nil)
+		c.Assert(err, IsNil)
+		c.Assert(sig.Sign(req, nil), IsNil)
+		c.Assert(req.Header.Get("Authorization"), Equals, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, "+
+			"SignedHeaders=host;x-amz-date, Signature="+tc.signature, Commentf("%s, s3: %v", tc.path, tc.s3))
+	}
+}
+
+func (s *testSuite) TestHMAC(c *C) {
+	sig := &HMAC{Secret: []byte("secret"), Prefix: "HMAC key:", Now: signTime}
+	c.Assert(sig.Headers(), DeepEquals, []string{"Authorization", "X-Timestamp"})
+
+	req, err := http.NewRequest(http.MethodPost, "http://upstream/path?a=1", nil)
+	c.Assert(err, IsNil)
+	c.Assert(sig.Sign(req, []byte("body")), IsNil)
+	c.Assert(req.Header.Get("X-Timestamp"), Equals, "20150830T123600Z")
+
+	first := req.Header.Get("Authorization")
+	c.Assert(first[:9], Equals, "HMAC key:")
+
+	// the signature depends on the body
+	c.Assert(sig.Sign(req, []byte("other")), IsNil)
+	c.Assert(req.Header.Get("Authorization"), Not(Equals), first)
+}
@@ -3,6 +3,8 @@ package sqlite
 import (
 	"context"
 	"sync"
+
+	"github.com/iostrovok/cacheproxy/plugins"
 )
 
 var globalPullMutex sync.Mutex
@@ -16,7 +18,8 @@ type Pull struct {
 	conns       map[string]*SQL
 	sessionMode bool
 
-	requested map[string]bool
+	// requested ids by version
+	requested map[string]map[string]bool
 }
 
 // global variable
@@ -27,7 +30,7 @@ func New(sessionMode bool, ctx ...context.Context) *Pull {
 	out := &Pull{
 		mx:          sync.RWMutex{},
 		conns:       map[string]*SQL{},
-		requested:   map[string]bool{},
+		requested:   map[string]map[string]bool{},
 		sessionMode: sessionMode,
 	}
 
@@ -60,10 +63,34 @@ func Upsert(fileName, id string, body []byte) error {
 	return pull.Upsert(fileName, id, body)
 }
 
+func UpsertVersion(fileName, id, version string, body []byte) error {
+	return pull.UpsertVersion(fileName, id, version, body)
+}
+
 func Select(fileName, id string) ([]byte, error) {
 	return pull.Select(fileName, id)
 }
 
+func SelectVersion(fileName, id string, versions ...string) ([]byte, error) {
+	return pull.SelectVersion(fileName, id, versions...)
+}
+
+func SelectByVersions(fileName string, versions ...string) (map[string][]byte, error) {
+	return pull.SelectByVersions(fileName, versions...)
+}
+
+func Versions(fileName string) ([]plugins.VersionInfo, error) {
+	return pull.Versions(fileName)
+}
+
+func DeleteVersions(fileName string, versions ...string) (int64, error) {
+	return pull.DeleteVersions(fileName, versions...)
+}
+
+func DeleteIDs(fileName, version string, ids ...string) (int64, error) {
+	return pull.DeleteIDs(fileName, version, ids...)
+}
+
 func (p *Pull) Close() error {
 	p.mx.Lock()
 	defer p.mx.Unlock()
@@ -96,11 +123,14 @@ func (p *Pull) DeleteOld() (int64, error) {
 			continue
 		}
 
-		deleted, err := c.DeleteOld(p.requested)
-		if err != nil {
-			return 0, err
+		// only versions which are saved in the session are cleaned
+		for version, requested := range p.requested {
+			deleted, err := c.DeleteOld(version, requested)
+			if err != nil {
+				return 0, err
+			}
+			total += deleted
 		}
-		total += deleted
 	}
 
 	return total, nil
@@ -138,6 +168,11 @@ func (p *Pull) Get(fileName string) (*SQL, error) {
 
 // Upsert just inserts or update one record
 func (p *Pull) Upsert(fileName, id string, body []byte) error {
+	return p.UpsertVersion(fileName, id, DefaultVersion, body)
+}
+
+// UpsertVersion inserts or update one record of the version
+func (p *Pull) UpsertVersion(fileName, id, version string, body []byte) error {
 	c, err := p.Get(fileName)
 	if err != nil {
 		return err
@@ -145,18 +180,66 @@ func (p *Pull) Upsert(fileName, id string, body []byte) error {
 
 	if p.sessionMode {
 		p.mx.Lock()
-		p.requested[id] = true
+		if p.requested[version] == nil {
+			p.requested[version] = map[string]bool{}
+		}
+		p.requested[version][id] = true
 		p.mx.Unlock()
 	}
 
-	return c.Upsert(id, body)
+	return c.UpsertVersion(id, version, body)
 }
 
 func (p *Pull) Select(fileName, id string) ([]byte, error) {
+	return p.SelectVersion(fileName, id, DefaultVersion)
+}
+
+// SelectVersion returns the record of the first version which has it.
+func (p *Pull) SelectVersion(fileName, id string, versions ...string) ([]byte, error) {
 	c, err := p.Get(fileName)
 	if err != nil {
 		return nil, err
 	}
 
-	return c.Select(id)
+	return c.SelectVersion(id, versions...)
+}
+
+// SelectByVersions returns all records of the versions, see SQL.SelectByVersions.
+func (p *Pull) SelectByVersions(fileName string, versions ...string) (map[string][]byte, error) {
+	c, err := p.Get(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.SelectByVersions(versions...)
+}
+
+// Versions returns stored versions of the file, see SQL.Versions.
+func (p *Pull) Versions(fileName string) ([]plugins.VersionInfo, error) {
+	c, err := p.Get(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Versions()
+}
+
+// DeleteVersions deletes all records of the versions from the file.
+func (p *Pull) DeleteVersions(fileName string, versions ...string) (int64, error) {
+	c, err := p.Get(fileName)
+	if err != nil {
+		return 0, err
+	}
+
+	return c.DeleteVersions(versions...)
+}
+
+// DeleteIDs deletes records of the version from the file by id.
+func (p *Pull) DeleteIDs(fileName, version string, ids ...string) (int64, error) {
+	c, err := p.Get(fileName)
+	if err != nil {
+		return 0, err
+	}
+
+	return c.DeleteIDs(version, ids...)
 }
@@ -2,14 +2,22 @@ package sqlite
 
 import (
 	"database/sql"
+	"net/url"
 	"os"
+	"strings"
 	"sync"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 
+	"github.com/iostrovok/cacheproxy/plugins"
 	"github.com/iostrovok/cacheproxy/store"
+	"github.com/iostrovok/cacheproxy/version"
 )
 
+// DefaultVersion is the version of records which are saved without version.
+const DefaultVersion = version.Default
+
 var globalConnMutex sync.RWMutex
 
 var testCounter = 0
@@ -23,6 +31,9 @@ type Record struct {
 	// Args is unique key: MD5 hash from url + request
 	ID string `json:"id"`
 
+	// Version of the data, the git branch name as usual
+	Version string `json:"version"`
+
 	// See github.com/iostrovok/cacheproxy/store
 	Body *store.Item `json:"body"`
 }
@@ -70,6 +81,9 @@ func conn(fileName string) (*SQL, error) {
 	}
 
 	err := c.Open()
+	if err == nil {
+		err = c.Migrate()
+	}
 	return c, err
 }
 
@@ -107,40 +121,286 @@ func (s *SQL) execTx(command string, args ...interface{}) error {
 	return err
 }
 
+// updated_at keeps unix time of the last write
+const createTableSQL = `CREATE TABLE main (id TEXT, version TEXT NOT NULL DEFAULT '` + DefaultVersion +
+	`', body BLOB, updated_at INTEGER NOT NULL DEFAULT 0, PRIMARY KEY(id, version))`
+
 // CreateTable just makes new table
 func (s *SQL) CreateTable() error {
-	return s.execTx("CREATE TABLE main (id TEXT, body BLOB, PRIMARY KEY(id))")
+	return s.execTx(createTableSQL)
+}
+
+// columns returns names of columns of the table.
+func (s *SQL) columns() (map[string]bool, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	rows, err := s.db.Query("SELECT name FROM pragma_table_info('main')")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := map[string]bool{}
+	for rows.Next() {
+		name := ""
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		out[name] = true
+	}
+
+	return out, rows.Err()
+}
+
+// Migrate updates the table of the old file: it adds the version column (all records get DefaultVersion)
+// and the time of the last write.
+func (s *SQL) Migrate() error {
+	columns, err := s.columns()
+	if err != nil {
+		return err
+	}
+
+	if !columns["version"] {
+		return s.migrateVersion()
+	}
+
+	if !columns["updated_at"] {
+		return s.execTx("ALTER TABLE main ADD COLUMN updated_at INTEGER NOT NULL DEFAULT 0")
+	}
+
+	return nil
+}
+
+func (s *SQL) migrateVersion() error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// primary key can't be changed, so the table is copied
+	commands := []struct {
+		query string
+		args  []interface{}
+	}{
+		{query: "ALTER TABLE main RENAME TO main_old"},
+		{query: createTableSQL},
+		{query: "INSERT INTO main(id, version, body) SELECT id, ?, body FROM main_old", args: []interface{}{DefaultVersion}},
+		{query: "DROP TABLE main_old"},
+	}
+
+	for _, command := range commands {
+		if _, err := tx.Exec(command.query, command.args...); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
 }
 
 // Upsert
 func (s *SQL) Upsert(id string, body []byte) error {
+	return s.UpsertVersion(id, DefaultVersion, body)
+}
 
-	// don't update time if it's not necessary
-	insertSQL := `INSERT INTO main(id, body) VALUES(?, ?)
-		ON CONFLICT(id) DO UPDATE SET body=excluded.body WHERE excluded.id = main.id`
+// UpsertVersion inserts or updates the record of the version.
+func (s *SQL) UpsertVersion(id, version string, body []byte) error {
 
-	return s.execTx(insertSQL, id, body)
+	insertSQL := `INSERT INTO main(id, version, body, updated_at) VALUES(?, ?, ?, ?)
+		ON CONFLICT(id, version) DO UPDATE SET body=excluded.body, updated_at=excluded.updated_at`
+
+	return s.execTx(insertSQL, id, version, body, time.Now().Unix())
+}
 
+// Versions returns stored versions with the number of records, size of data and the time of the last write.
+func (s *SQL) Versions() ([]plugins.VersionInfo, error) {
+	return s.versions(true, true)
+}
+
+// ReadVersions returns stored versions of the file like SQL.Versions without changing the file:
+// it's opened in the read-only mode and it's not migrated. Records of the old file without versions
+// have DefaultVersion, the time of the last write is unknown for files without it.
+func ReadVersions(fileName string) ([]plugins.VersionInfo, error) {
+	uri := &url.URL{Scheme: "file", Path: fileName, RawQuery: "mode=ro"}
+	db, err := sql.Open("sqlite3", uri.String())
+	if err != nil {
+		return nil, err
+	}
+
+	s := &SQL{fileName: fileName, db: db}
+	defer s.Close()
+
+	columns, err := s.columns()
+	if err != nil {
+		return nil, err
+	}
+
+	return s.versions(columns["version"], columns["updated_at"])
+}
+
+func (s *SQL) versions(hasVersion, hasUpdated bool) ([]plugins.VersionInfo, error) {
+	version, updated := "version", "MAX(updated_at)"
+	if !hasVersion {
+		version = "'" + DefaultVersion + "'"
+	}
+	if !hasUpdated {
+		updated = "0"
+	}
+
+	s.mx.RLock()
+	rows, err := s.db.Query(`SELECT ` + version + `, COUNT(*), COALESCE(SUM(LENGTH(body)), 0), ` + updated + `
+		FROM main GROUP BY 1 ORDER BY 1`)
+	s.mx.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make([]plugins.VersionInfo, 0)
+	for rows.Next() {
+		info := plugins.VersionInfo{}
+		lastWrite := int64(0)
+		if err := rows.Scan(&info.Version, &info.Entries, &info.Bytes, &lastWrite); err != nil {
+			return nil, err
+		}
+		if lastWrite > 0 {
+			info.LastWrite = time.Unix(lastWrite, 0)
+		}
+		out = append(out, info)
+	}
+
+	return out, rows.Err()
+}
+
+// DeleteVersions deletes all records of the versions.
+func (s *SQL) DeleteVersions(versions ...string) (int64, error) {
+	if len(versions) == 0 {
+		return 0, nil
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	res, err := s.db.Exec(`DELETE FROM main WHERE version IN (`+placeholders(len(versions))+`)`, toArgs(versions)...)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// DeleteIDs deletes records of the version by id.
+func (s *SQL) DeleteIDs(version string, ids ...string) (int64, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	res, err := s.db.Exec(`DELETE FROM main WHERE version = ? AND id IN (`+placeholders(len(ids))+`)`,
+		append([]interface{}{version}, toArgs(ids)...)...)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
 }
 
 func (s *SQL) Select(id string) ([]byte, error) {
+	return s.SelectVersion(id, DefaultVersion)
+}
+
+// SelectVersion returns the body of the first version which has the record.
+// sql.ErrNoRows is returned if no one version has it.
+func (s *SQL) SelectVersion(id string, versions ...string) ([]byte, error) {
 	s.mx.RLock()
-	row := s.db.QueryRow(`SELECT body FROM main WHERE id = ?`, id)
+	rows, err := s.db.Query(`SELECT version, body FROM main WHERE id = ? AND version IN (`+
+		placeholders(len(versions))+`)`, append([]interface{}{id}, toArgs(versions)...)...)
 	s.mx.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	found := map[string][]byte{}
+	for rows.Next() {
+		version, body := "", make([]byte, 0)
+		if err := rows.Scan(&version, &body); err != nil {
+			return nil, err
+		}
+		found[version] = body
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 
-	body := make([]byte, 0)
+	for _, version := range versions {
+		if body, find := found[version]; find {
+			return body, nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
 
-	if err := row.Scan(&body); err != nil {
+// SelectByVersions returns bodies of all records of the versions by id.
+// The record of the version which is the first in the list wins.
+func (s *SQL) SelectByVersions(versions ...string) (map[string][]byte, error) {
+	s.mx.RLock()
+	rows, err := s.db.Query(`SELECT id, version, body FROM main WHERE version IN (`+
+		placeholders(len(versions))+`)`, toArgs(versions)...)
+	s.mx.RUnlock()
+	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	return body, nil
+	priority := map[string]int{}
+	for i := len(versions) - 1; i >= 0; i-- {
+		priority[versions[i]] = i
+	}
+
+	out := map[string][]byte{}
+	best := map[string]int{}
+	for rows.Next() {
+		id, version, body := "", "", make([]byte, 0)
+		if err := rows.Scan(&id, &version, &body); err != nil {
+			return nil, err
+		}
+
+		if p, find := best[id]; !find || priority[version] < p {
+			best[id] = priority[version]
+			out[id] = body
+		}
+	}
+
+	return out, rows.Err()
 }
 
-// SelectAll returns all rows sorted by id
+func placeholders(n int) string {
+	if n == 0 {
+		return "NULL"
+	}
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
+
+func toArgs(list []string) []interface{} {
+	out := make([]interface{}, len(list))
+	for i := range list {
+		out[i] = list[i]
+	}
+	return out
+}
+
+// SelectAll returns all rows sorted by id, parts of response bodies are skipped.
 func (s *SQL) SelectAll() ([]*Record, error) {
 	s.mx.RLock()
-	row, err := s.db.Query("SELECT id, body FROM main ORDER BY id")
+	row, err := s.db.Query("SELECT id, version, body FROM main ORDER BY id, version")
 	if err != nil {
 		return nil, err
 	}
@@ -151,9 +411,12 @@ func (s *SQL) SelectAll() ([]*Record, error) {
 	for row.Next() {
 		rec := Record{}
 		body := make([]byte, 0)
-		if err := row.Scan(&rec.ID, &body); err != nil {
+		if err := row.Scan(&rec.ID, &rec.Version, &body); err != nil {
 			return nil, err
 		}
+		if store.IsBodyKey(rec.ID) {
+			continue
+		}
 		if rec.Body, err = store.FromZip(body, true); err != nil {
 			return nil, err
 		}
@@ -162,10 +425,10 @@ func (s *SQL) SelectAll() ([]*Record, error) {
 	return out, nil
 }
 
-// SelectAllID returns all row id sorted by id
-func (s *SQL) SelectAllID() ([]string, error) {
+// SelectAllID returns all row id of the version sorted by id
+func (s *SQL) SelectAllID(version string) ([]string, error) {
 	s.mx.RLock()
-	row, err := s.db.Query("SELECT id FROM main ORDER BY id")
+	row, err := s.db.Query("SELECT id FROM main WHERE version = ? ORDER BY id", version)
 	if err != nil {
 		return nil, err
 	}
@@ -183,15 +446,16 @@ func (s *SQL) SelectAllID() ([]string, error) {
 	return out, nil
 }
 
-func (s *SQL) DeleteOld(requested map[string]bool) (int64, error) {
+// DeleteOld deletes records of the version which are not requested.
+func (s *SQL) DeleteOld(version string, requested map[string]bool) (int64, error) {
 
 	total := int64(0)
-	ids, err := s.SelectAllID()
+	ids, err := s.SelectAllID(version)
 	if err != nil {
 		return total, err
 	}
 
-	delStmt, err := s.db.Prepare("DELETE from main WHERE id = ?")
+	delStmt, err := s.db.Prepare("DELETE from main WHERE id = ? AND version = ?")
 	if err != nil {
 		return total, err
 	}
@@ -205,7 +469,7 @@ func (s *SQL) DeleteOld(requested map[string]bool) (int64, error) {
 		if err != nil {
 			return total, err
 		}
-		res, err := tx.Stmt(delStmt).Exec(id)
+		res, err := tx.Stmt(delStmt).Exec(id, version)
 		if err != nil {
 			return total, err
 		}
@@ -1,6 +1,7 @@
 package sqlite
 
 import (
+	"database/sql"
 	"io/ioutil"
 	"net/http"
 	"os"
@@ -88,3 +89,134 @@ func (s *testSuite) TestSQL_1(c *C) {
 
 	c.Assert(q.Close(), IsNil)
 }
+
+func (s *testSuite) TestSQL_Migrate(c *C) {
+	fileName := tmpFile(c)
+	defer os.Remove(fileName)
+
+	// the file of the old format without versions
+	db, err := sql.Open("sqlite3", fileName)
+	c.Assert(err, IsNil)
+	_, err = db.Exec("CREATE TABLE main (id TEXT, body BLOB, PRIMARY KEY(id))")
+	c.Assert(err, IsNil)
+	_, err = db.Exec("INSERT INTO main(id, body) VALUES(?, ?)", "old-id", []byte("old-body"))
+	c.Assert(err, IsNil)
+	c.Assert(db.Close(), IsNil)
+
+	q, err := Conn(fileName)
+	c.Assert(err, IsNil)
+	defer q.Close()
+
+	body, err := q.Select("old-id")
+	c.Assert(err, IsNil)
+	c.Assert(body, DeepEquals, []byte("old-body"))
+
+	body, err = q.SelectVersion("old-id", "feature", DefaultVersion)
+	c.Assert(err, IsNil)
+	c.Assert(body, DeepEquals, []byte("old-body"))
+
+	// the second opening doesn't migrate again
+	q2, err := Conn(fileName)
+	c.Assert(err, IsNil)
+	c.Assert(q2.Close(), IsNil)
+}
+
+func (s *testSuite) TestSQL_ReadVersions(c *C) {
+	fileName := tmpFile(c)
+	defer os.Remove(fileName)
+
+	// the file of the old format without versions
+	db, err := sql.Open("sqlite3", fileName)
+	c.Assert(err, IsNil)
+	_, err = db.Exec("CREATE TABLE main (id TEXT, body BLOB, PRIMARY KEY(id))")
+	c.Assert(err, IsNil)
+	_, err = db.Exec("INSERT INTO main(id, body) VALUES(?, ?)", "old-id", []byte("old-body"))
+	c.Assert(err, IsNil)
+	c.Assert(db.Close(), IsNil)
+
+	before, err := os.ReadFile(fileName)
+	c.Assert(err, IsNil)
+
+	list, err := ReadVersions(fileName)
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 1)
+	c.Assert(list[0].Version, Equals, DefaultVersion)
+	c.Assert(list[0].Entries, Equals, int64(1))
+	c.Assert(list[0].Bytes, Equals, int64(8))
+	c.Assert(list[0].LastWrite.IsZero(), Equals, true)
+
+	// the file is not migrated
+	after, err := os.ReadFile(fileName)
+	c.Assert(err, IsNil)
+	c.Assert(after, DeepEquals, before)
+
+	_, err = ReadVersions(fileName + "-none")
+	c.Assert(err, NotNil)
+}
+
+func (s *testSuite) TestSQL_Versions(c *C) {
+	fileName := tmpFile(c)
+	defer os.Remove(fileName)
+
+	q, err := Conn(fileName)
+	c.Assert(err, IsNil)
+	defer q.Close()
+
+	c.Assert(q.UpsertVersion("id-1", "main", []byte("main-1")), IsNil)
+	c.Assert(q.UpsertVersion("id-2", "main", []byte("main-2")), IsNil)
+	c.Assert(q.UpsertVersion("id-1", "feature", []byte("feature-1")), IsNil)
+
+	body, err := q.SelectVersion("id-1", "feature", "main")
+	c.Assert(err, IsNil)
+	c.Assert(body, DeepEquals, []byte("feature-1"))
+
+	body, err = q.SelectVersion("id-2", "feature", "main")
+	c.Assert(err, IsNil)
+	c.Assert(body, DeepEquals, []byte("main-2"))
+
+	_, err = q.SelectVersion("id-2", "feature")
+	c.Assert(err, Equals, sql.ErrNoRows)
+
+	all, err := q.SelectByVersions("feature", "main")
+	c.Assert(err, IsNil)
+	c.Assert(all, DeepEquals, map[string][]byte{"id-1": []byte("feature-1"), "id-2": []byte("main-2")})
+
+	deleted, err := q.DeleteOld("main", map[string]bool{"id-1": true})
+	c.Assert(err, IsNil)
+	c.Assert(deleted, Equals, int64(1))
+
+	body, err = q.SelectVersion("id-1", "feature")
+	c.Assert(err, IsNil)
+	c.Assert(body, DeepEquals, []byte("feature-1"))
+}
+
+func (s *testSuite) TestSQL_VersionsInfo(c *C) {
+	fileName := tmpFile(c)
+	defer os.Remove(fileName)
+
+	q, err := Conn(fileName)
+	c.Assert(err, IsNil)
+	defer q.Close()
+
+	c.Assert(q.UpsertVersion("id-1", "main", []byte("12345")), IsNil)
+	c.Assert(q.UpsertVersion("id-2", "main", []byte("123")), IsNil)
+	c.Assert(q.UpsertVersion("id-1", "feature", []byte("1")), IsNil)
+
+	list, err := q.Versions()
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 2)
+	c.Assert(list[0].Version, Equals, "feature")
+	c.Assert(list[0].Entries, Equals, int64(1))
+	c.Assert(list[1].Version, Equals, "main")
+	c.Assert(list[1].Entries, Equals, int64(2))
+	c.Assert(list[1].Bytes, Equals, int64(8))
+	c.Assert(list[1].LastWrite.IsZero(), Equals, false)
+
+	deleted, err := q.DeleteVersions("main")
+	c.Assert(err, IsNil)
+	c.Assert(deleted, Equals, int64(2))
+
+	list, err = q.Versions()
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 1)
+}
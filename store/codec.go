@@ -0,0 +1,174 @@
+package store
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec is the compression of the stored record.
+type Codec byte
+
+const (
+	CodecNone Codec = iota
+	CodecZlib
+	CodecZstd
+)
+
+var codecNames = map[Codec]string{
+	CodecNone: "none",
+	CodecZlib: "zlib",
+	CodecZstd: "zstd",
+}
+
+func (c Codec) String() string {
+	if name, find := codecNames[c]; find {
+		return name
+	}
+	return fmt.Sprintf("codec(%d)", byte(c))
+}
+
+// ParseCodec returns the codec by its name: "none", "zlib" or "zstd".
+func ParseCodec(name string) (Codec, error) {
+	for c, n := range codecNames {
+		if n == name {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown codec %q", name)
+}
+
+// magic starts every encoded record, records without it are written by old versions:
+// zlib compressed items and raw parts of bodies.
+var magic = []byte("\x00CPX")
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+func initZstd() error {
+	zstdOnce.Do(func() {
+		if zstdEncoder, zstdErr = zstd.NewWriter(nil); zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil)
+	})
+	return zstdErr
+}
+
+// Encode compresses data by the codec and adds the header.
+func Encode(codec Codec, data []byte) ([]byte, error) {
+	out := make([]byte, 0, len(magic)+1+len(data))
+	out = append(out, magic...)
+	out = append(out, byte(codec))
+
+	switch codec {
+	case CodecNone:
+		return append(out, data...), nil
+	case CodecZlib:
+		body, err := deflate(data)
+		if err != nil {
+			return nil, err
+		}
+		return append(out, body...), nil
+	case CodecZstd:
+		if err := initZstd(); err != nil {
+			return nil, err
+		}
+		return zstdEncoder.EncodeAll(data, out), nil
+	}
+
+	return nil, fmt.Errorf("unknown codec %d", byte(codec))
+}
+
+// decode decompresses the encoded record, legacy is called for records without the header.
+func decode(data []byte, legacy func([]byte) ([]byte, error)) ([]byte, error) {
+	if !bytes.HasPrefix(data, magic) || len(data) == len(magic) {
+		return legacy(data)
+	}
+
+	codec, body := Codec(data[len(magic)]), data[len(magic)+1:]
+	switch codec {
+	case CodecNone:
+		return body, nil
+	case CodecZlib:
+		return inflate(body)
+	case CodecZstd:
+		if err := initZstd(); err != nil {
+			return nil, err
+		}
+		return zstdDecoder.DecodeAll(body, nil)
+	}
+
+	return nil, fmt.Errorf("unknown codec %d", byte(codec))
+}
+
+func deflate(data []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w := zlib.NewWriter(&b)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+func inflate(data []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+// DecodeBody returns the part of the response body stored by the keeper.
+// Parts written by old versions are raw data.
+func DecodeBody(data []byte) ([]byte, error) {
+	return decode(data, func(b []byte) ([]byte, error) { return b, nil })
+}
+
+// bodyKeyPrefix starts keys of the response bodies which are stored by content hash.
+const bodyKeyPrefix = "body-sha256-"
+
+// keyedBodyKeyPrefix starts keys of the response bodies which are stored by the keyed hash, see KeyedBodyKey.
+const keyedBodyKeyPrefix = "body-hmac-sha256-"
+
+var legacyChunkKey = regexp.MustCompile(`-body-\d+$`)
+
+// BodyKey returns the key of the part of the response body by its content,
+// the same data is stored once for all items of the file.
+func BodyKey(data []byte) string {
+	sum := sha256.Sum256(data)
+	return bodyKeyPrefix + hex.EncodeToString(sum[:])
+}
+
+// KeyedBodyKey returns the key of the part of the response body by HMAC-SHA256 of its content,
+// it's used instead of BodyKey by encrypted keepers, so stored keys don't reveal hashes of bodies.
+func KeyedBodyKey(secret, data []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(data)
+	return keyedBodyKeyPrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// IsBodyKey returns true for keys of the parts of response bodies, they are not items.
+func IsBodyKey(key string) bool {
+	return strings.HasPrefix(key, bodyKeyPrefix) || strings.HasPrefix(key, keyedBodyKeyPrefix) ||
+		legacyChunkKey.MatchString(key)
+}
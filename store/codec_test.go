@@ -0,0 +1,78 @@
+package store
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+
+	. "github.com/iostrovok/check"
+)
+
+func (s *testSuite) TestCodec(c *C) {
+	data := bytes.Repeat([]byte(`{"name":"value"}`), 100)
+
+	for _, codec := range []Codec{CodecNone, CodecZlib, CodecZstd} {
+		encoded, err := Encode(codec, data)
+		c.Assert(err, IsNil)
+		if codec != CodecNone {
+			c.Assert(len(encoded) < len(data), Equals, true)
+		}
+
+		decoded, err := DecodeBody(encoded)
+		c.Assert(err, IsNil)
+		c.Assert(decoded, DeepEquals, data)
+
+		parsed, err := ParseCodec(codec.String())
+		c.Assert(err, IsNil)
+		c.Assert(parsed, Equals, codec)
+	}
+
+	_, err := ParseCodec("lz4")
+	c.Assert(err, NotNil)
+
+	// old parts of bodies are raw data
+	decoded, err := DecodeBody([]byte("raw"))
+	c.Assert(err, IsNil)
+	c.Assert(decoded, DeepEquals, []byte("raw"))
+}
+
+func (s *testSuite) TestEncode(c *C) {
+	in := &Item{
+		Request:        []byte{100},
+		ResponseBody:   []byte{101},
+		ResponseHeader: http.Header{"HEADER-1": []string{"VALUE-1"}},
+		StatusCode:     200,
+	}
+
+	// old records are zlib compressed without the header
+	old, err := in.ToZip()
+	c.Assert(err, IsNil)
+
+	for _, codec := range []Codec{CodecNone, CodecZlib, CodecZstd} {
+		body, err := in.Encode(codec)
+		c.Assert(err, IsNil)
+
+		for _, b := range [][]byte{body, old} {
+			out, err := FromZip(b)
+			c.Assert(err, IsNil)
+			c.Assert(out.StatusCode, Equals, 200)
+			c.Assert(out.ResponseBody, DeepEquals, []byte{101})
+			c.Assert(out.ResponseHeader, DeepEquals, in.ResponseHeader)
+		}
+	}
+}
+
+func (s *testSuite) TestBodyKey(c *C) {
+	c.Assert(BodyKey([]byte("1")), Equals, BodyKey([]byte("1")))
+	c.Assert(BodyKey([]byte("1")), Not(Equals), BodyKey([]byte("2")))
+
+	c.Assert(IsBodyKey(BodyKey([]byte("1"))), Equals, true)
+	c.Assert(IsBodyKey("d41d8cd98f00b204e9800998ecf8427e-body-12"), Equals, true)
+	c.Assert(IsBodyKey("d41d8cd98f00b204e9800998ecf8427e"), Equals, false)
+
+	secret := []byte("secret")
+	c.Assert(KeyedBodyKey(secret, []byte("1")), Equals, KeyedBodyKey(secret, []byte("1")))
+	c.Assert(KeyedBodyKey(secret, []byte("1")), Not(Equals), KeyedBodyKey([]byte("other"), []byte("1")))
+	c.Assert(strings.Contains(KeyedBodyKey(secret, []byte("1")), strings.TrimPrefix(BodyKey([]byte("1")), "body-sha256-")), Equals, false)
+	c.Assert(IsBodyKey(KeyedBodyKey(secret, []byte("1"))), Equals, true)
+}
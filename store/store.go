@@ -1,16 +1,117 @@
 package store
 
 import (
-	"bytes"
-	"compress/zlib"
 	"crypto/md5"
 	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
+	"time"
 )
 
+// ItemType is the kind of the recorded conversation.
+type ItemType string
+
+const (
+	// TypeHTTP is an ordinary HTTP request and response.
+	TypeHTTP ItemType = ""
+
+	// TypeWebSocket is the websocket handshake and the transcript of messages.
+	TypeWebSocket ItemType = "websocket"
+
+	// TypeVary keeps the Vary header of the response only. The response itself is stored
+	// by the key with values of the request headers from the Vary header.
+	TypeVary ItemType = "vary"
+)
+
+// Direction is the sender of the websocket message.
+type Direction string
+
+const (
+	FromClient Direction = "client"
+	FromServer Direction = "server"
+)
+
+// Message is one websocket frame of the transcript.
+type Message struct {
+	Direction Direction `json:"direction"`
+
+	// Opcode of the frame: text, binary, close, ping or pong
+	Opcode byte `json:"opcode"`
+
+	// Fin is false for every frame of the fragmented message except the last one
+	Fin bool `json:"fin"`
+
+	// Payload as is (unmasked)
+	Payload []byte `json:"payload"`
+
+	// Time from the start of the conversation
+	Offset time.Duration `json:"offset"`
+}
+
+// Chunk is one part of the streamed response.
+type Chunk struct {
+	// Time from the start of the response
+	Offset time.Duration `json:"offset"`
+
+	// Data as is
+	Data []byte `json:"data"`
+}
+
+// FormatVersion is the version of the item format which is written now.
+// Items written before the format is versioned have no version (0).
+const FormatVersion = 1
+
+// KeyInputs describes the data which the key of the item is made from.
+type KeyInputs struct {
+	// URL or path (gRPC) of the request as it's used for the key
+	URL string `json:"url"`
+
+	// MD5 of the request body as it's used for the key, gRPC messages without framing for gRPC
+	BodyMD5 string `json:"body_md5,omitempty"`
+
+	// GRPC is true if the key is made by the gRPC method and messages
+	GRPC bool `json:"grpc,omitempty"`
+
+	// Values of the request headers from the Vary header of the response
+	Vary map[string]string `json:"vary,omitempty"`
+}
+
+// Meta is the information about the recording, it's not replayed.
+type Meta struct {
+	// Time when the request is sent to upstream
+	RecordedAt time.Time `json:"recorded_at"`
+
+	// Time from sending the request to the end of the response
+	Duration time.Duration `json:"duration"`
+
+	// Upstream URL and method
+	URL    string `json:"url"`
+	Method string `json:"method"`
+
+	// Protocol of the upstream response, like "HTTP/1.1" or "HTTP/2.0"
+	Proto string `json:"proto,omitempty"`
+
+	// Address of the client
+	RemoteAddr string `json:"remote_addr,omitempty"`
+
+	// Content-Length of the upstream response, -1 is unknown length
+	ContentLength int64 `json:"content_length"`
+
+	// Key of the item and its inputs
+	Key       string    `json:"key"`
+	KeyInputs KeyInputs `json:"key_inputs"`
+}
+
 type Item struct {
+	// Format is the version of the format, see FormatVersion
+	Format int `json:"format,omitempty"`
+
+	// Information about the recording, it's nil for items of old formats
+	Meta *Meta `json:"meta,omitempty"`
+
+	// Type of the item, TypeHTTP by default
+	Type ItemType `json:"type,omitempty"`
+
 	// Request as is
 	Request []byte `json:"request"`
 
@@ -20,48 +121,130 @@ type Item struct {
 	// Response headers Body as is
 	ResponseHeader http.Header `json:"response_header"`
 
+	// Response trailers as is, gRPC keeps the status of the call here
+	ResponseTrailer http.Header `json:"response_trailer,omitempty"`
+
 	// status code
 	StatusCode int `json:"status_code"`
 
-	// for compare and debug goals
+	// Keys of the parts of a large response body, they are stored separately in the same file
+	// by content hash, see BodyKey.
+	// ResponseBody is empty if BodyChunks is not.
+	BodyChunks []string `json:"body_chunks,omitempty"`
+
+	// Full length of the response body
+	BodySize int64 `json:"body_size,omitempty"`
+
+	// Chunks of the streamed response (SSE, NDJSON and so on).
+	// ResponseBody is empty if Chunks is not.
+	Chunks []Chunk `json:"chunks,omitempty"`
+
+	// Transcript of the websocket conversation for TypeWebSocket
+	Messages []Message `json:"messages,omitempty"`
+
+	// for compare and debug goals, see ComputeHash
 	// it's not stored in files
 	Hash string `json:"-"`
 }
 
+// ComputeHash returns the hash of the recorded conversation, the meta information is not used.
+// Items of different formats with the same requests and responses have the same hash.
+func (s *Item) ComputeHash() string {
+	c := *s
+	c.Format, c.Meta, c.Hash = 0, nil, ""
+
+	body, err := json.Marshal(&c)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%x", md5.Sum(body))
+}
+
+// RecordedAt returns the time of the recording, it's zero for items of old formats.
+func (s *Item) RecordedAt() time.Time {
+	if s.Meta == nil {
+		return time.Time{}
+	}
+	return s.Meta.RecordedAt
+}
+
+func (s *Item) marshal() ([]byte, error) {
+	c := *s
+	c.Format = FormatVersion
+	return json.Marshal(&c)
+}
+
+// ToZip returns the item in the old format: zlib compressed JSON without the header and the format version,
+// like records written before formats are versioned. Use Encode to write new records.
 func (s *Item) ToZip() ([]byte, error) {
 	body, err := json.Marshal(s)
 	if err != nil {
 		return nil, err
 	}
 
-	var b bytes.Buffer
-	w := zlib.NewWriter(&b)
-	if _, err := w.Write(body); err != nil {
+	return deflate(body)
+}
+
+// Encode returns the item compressed by the codec.
+func (s *Item) Encode(codec Codec) ([]byte, error) {
+	body, err := s.marshal()
+	if err != nil {
 		return nil, err
 	}
-	w.Close()
 
-	return b.Bytes(), nil
+	return Encode(codec, body)
 }
 
+// FromZip decodes the item of any compression and format.
 func FromZip(body []byte, needHash ...bool) (*Item, error) {
-	b := bytes.Buffer{}
-	r, err := zlib.NewReader(bytes.NewBuffer(body))
+	data, err := decode(body, inflate)
 	if err != nil {
 		return nil, err
 	}
 
-	if _, err := io.Copy(&b, r); err != nil {
+	envelope := struct {
+		Format int `json:"format"`
+	}{}
+	if err := json.Unmarshal(data, &envelope); err != nil {
 		return nil, err
 	}
-	r.Close()
 
-	s := &Item{}
-	err = json.Unmarshal(b.Bytes(), &s)
+	parse, find := formats[envelope.Format]
+	if !find {
+		return nil, fmt.Errorf("unsupported format of the item: %d, the latest known format is %d",
+			envelope.Format, FormatVersion)
+	}
+
+	s, err := parse(data)
+	if err != nil {
+		return nil, err
+	}
 
 	if len(needHash) > 0 && needHash[0] {
-		s.Hash = fmt.Sprintf("%x", md5.Sum(body))
+		s.Hash = s.ComputeHash()
 	}
 
-	return s, err
+	return s, nil
+}
+
+// formats are parsers of the item by its format version, they return the item of the current format.
+var formats = map[int]func(data []byte) (*Item, error){
+	0: func(data []byte) (*Item, error) {
+		s := &Item{}
+		if err := json.Unmarshal(data, s); err != nil {
+			return nil, err
+		}
+
+		// the size of inline bodies is not stored by old versions
+		if s.BodySize == 0 {
+			s.BodySize = int64(len(s.ResponseBody))
+		}
+
+		s.Format = FormatVersion
+		return s, nil
+	},
+	1: func(data []byte) (*Item, error) {
+		s := &Item{}
+		return s, json.Unmarshal(data, s)
+	},
 }
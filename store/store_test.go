@@ -1,8 +1,11 @@
 package store
 
 import (
+	"encoding/json"
 	"net/http"
+	"strings"
 	"testing"
+	"time"
 
 	. "github.com/iostrovok/check"
 )
@@ -27,7 +30,12 @@ func (s *testSuite) TestToZip(c *C) {
 	zip, err := unit.ToZip()
 
 	c.Assert(err, IsNil)
-	c.Assert(len(zip), Equals, 105)
+	c.Assert(len(zip), Equals, 125)
+
+	// the old format has no version
+	body, err := inflate(zip)
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(string(body), `"format"`), Equals, false)
 }
 
 func (s *testSuite) TestFromZip_Error(c *C) {
@@ -61,3 +69,46 @@ func (s *testSuite) TestFromZip(c *C) {
 	c.Assert(out.ResponseBody, DeepEquals, []byte{101})
 	c.Assert(out.ResponseHeader["HEADER-1"], DeepEquals, []string{"VALUE-1", "VALUE-2"})
 }
+
+func (s *testSuite) TestFromZip_Format(c *C) {
+	// the item of the old format has no version and meta
+	legacy, err := json.Marshal(map[string]interface{}{
+		"request":       []byte{100},
+		"response_body": []byte{101, 102},
+		"status_code":   200,
+	})
+	c.Assert(err, IsNil)
+	body, err := deflate(legacy)
+	c.Assert(err, IsNil)
+
+	out, err := FromZip(body, true)
+	c.Assert(err, IsNil)
+	c.Assert(out.Format, Equals, FormatVersion)
+	c.Assert(out.Meta, IsNil)
+	c.Assert(out.BodySize, Equals, int64(2))
+	c.Assert(out.ResponseBody, DeepEquals, []byte{101, 102})
+
+	// the same conversation has the same hash for any meta
+	in := &Item{
+		Meta:         &Meta{RecordedAt: time.Now(), Duration: time.Second, Key: "key"},
+		Request:      []byte{100},
+		ResponseBody: []byte{101, 102},
+		StatusCode:   200,
+		BodySize:     2,
+	}
+	body, err = in.Encode(CodecZstd)
+	c.Assert(err, IsNil)
+
+	current, err := FromZip(body, true)
+	c.Assert(err, IsNil)
+	c.Assert(current.Format, Equals, FormatVersion)
+	c.Assert(current.Meta.Key, Equals, "key")
+	c.Assert(current.Meta.Duration, Equals, time.Second)
+	c.Assert(current.Hash, Equals, out.Hash)
+
+	// the item of the unknown format
+	future, err := Encode(CodecNone, []byte(`{"format": 1000}`))
+	c.Assert(err, IsNil)
+	_, err = FromZip(future)
+	c.Assert(err, NotNil)
+}
@@ -45,13 +45,13 @@ func Compare(pathA, pathB string) ([]*Diff, error) {
 	keysBFound := map[string]bool{}
 	keysB := map[string]*sqlite.Record{}
 	for i := range allB {
-		keysB[allB[i].ID] = allB[i]
+		keysB[recordKey(allB[i])] = allB[i]
 	}
 
 	for i := range allA {
 		a := allA[i]
 
-		b, find := keysB[allA[i].ID]
+		b, find := keysB[recordKey(allA[i])]
 		if !find {
 			diff := &Diff{
 				Diff:    ANoB,
@@ -66,16 +66,16 @@ func Compare(pathA, pathB string) ([]*Diff, error) {
 			Records: []*sqlite.Record{a, b},
 		}
 
-		keysBFound[b.ID] = true
+		keysBFound[recordKey(b)] = true
 
-		if a.Body.Hash != a.Body.Hash {
+		if a.Body.Hash != b.Body.Hash {
 			diff.Diff = Body
 		}
 		out = append(out, diff)
 	}
 
 	for i := range allB {
-		if !keysBFound[allB[i].ID] {
+		if !keysBFound[recordKey(allB[i])] {
 			diff := &Diff{
 				Diff:    BNoA,
 				Records: []*sqlite.Record{allB[i]},
@@ -89,3 +89,8 @@ func Compare(pathA, pathB string) ([]*Diff, error) {
 
 	return out, err
 }
+
+// recordKey returns the unique key of the record: the same id may be saved for different versions.
+func recordKey(r *sqlite.Record) string {
+	return r.Version + "#--#" + r.ID
+}
@@ -0,0 +1,89 @@
+package utils
+
+import (
+	"time"
+
+	"github.com/iostrovok/cacheproxy/plugins"
+)
+
+// VersionGCOptions defines which versions are garbage.
+type VersionGCOptions struct {
+	// Versions which were not written for OlderThan are deleted. Zero value switches the rule off.
+	// The time of the last write is unknown (zero) for data written before it's tracked,
+	// such versions are not deleted by this rule.
+	OlderThan time.Duration
+
+	// If Live is not empty versions which are not in the list (live branches) are deleted.
+	Live []string
+
+	// Keep is the list of versions which are never deleted, like "main" or "develop".
+	Keep []string
+
+	// DryRun only finds versions for deleting.
+	DryRun bool
+
+	// Now is the current time, time.Now() is used if it's zero.
+	Now time.Time
+}
+
+// VersionGCResult is the report of the garbage collection.
+type VersionGCResult struct {
+	// All stored versions before deleting
+	Versions []plugins.VersionInfo `json:"versions"`
+
+	// Versions which are deleted (or should be deleted for the dry run)
+	Garbage []plugins.VersionInfo `json:"garbage"`
+
+	// Number of deleted records, it's 0 for the dry run
+	Deleted int64 `json:"deleted"`
+}
+
+// VersionGC deletes versions which are not written for a long time or are not in the list of live versions.
+func VersionGC(keeper plugins.IVersionManager, opts VersionGCOptions) (*VersionGCResult, error) {
+	versions, err := keeper.Versions()
+	if err != nil {
+		return nil, err
+	}
+
+	now := opts.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	live := toSet(opts.Live)
+	keep := toSet(opts.Keep)
+
+	out := &VersionGCResult{
+		Versions: versions,
+		Garbage:  make([]plugins.VersionInfo, 0),
+	}
+
+	names := make([]string, 0)
+	for _, info := range versions {
+		if keep[info.Version] {
+			continue
+		}
+
+		old := opts.OlderThan > 0 && !info.LastWrite.IsZero() && now.Sub(info.LastWrite) > opts.OlderThan
+		dead := len(live) > 0 && !live[info.Version]
+		if old || dead {
+			out.Garbage = append(out.Garbage, info)
+			names = append(names, info.Version)
+		}
+	}
+
+	if opts.DryRun || len(names) == 0 {
+		return out, nil
+	}
+
+	out.Deleted, err = keeper.DeleteVersions(names...)
+	return out, err
+}
+
+func toSet(list []string) map[string]bool {
+	out := map[string]bool{}
+	for _, s := range list {
+		out[s] = true
+	}
+	return out
+}
@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/iostrovok/check"
+
+	"github.com/iostrovok/cacheproxy/plugins"
+)
+
+type testSuite struct{}
+
+var _ = Suite(&testSuite{})
+
+func TestService(t *testing.T) { TestingT(t) }
+
+type fakeVersions struct {
+	versions []plugins.VersionInfo
+	deleted  []string
+}
+
+func (f *fakeVersions) Versions() ([]plugins.VersionInfo, error) {
+	return f.versions, nil
+}
+
+func (f *fakeVersions) DeleteVersions(versions ...string) (int64, error) {
+	f.deleted = append(f.deleted, versions...)
+	return int64(len(versions)), nil
+}
+
+func (s *testSuite) TestVersionGC(c *C) {
+	now := time.Date(2022, 10, 1, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+
+	keeper := &fakeVersions{versions: []plugins.VersionInfo{
+		{Version: "main", LastWrite: now.Add(-100 * day)},
+		{Version: "feature-old", LastWrite: now.Add(-40 * day)},
+		{Version: "feature-new", LastWrite: now.Add(-1 * day)},
+		{Version: "feature-merged", LastWrite: now.Add(-2 * day)},
+		{Version: "feature-untracked"},
+	}}
+
+	opts := VersionGCOptions{
+		OlderThan: 30 * day,
+		Live:      []string{"main", "feature-old", "feature-new", "feature-untracked"},
+		Keep:      []string{"main"},
+		DryRun:    true,
+		Now:       now,
+	}
+
+	res, err := VersionGC(keeper, opts)
+	c.Assert(err, IsNil)
+	c.Assert(res.Versions, HasLen, 5)
+	c.Assert(res.Garbage, HasLen, 2)
+	c.Assert(res.Garbage[0].Version, Equals, "feature-old")
+	c.Assert(res.Garbage[1].Version, Equals, "feature-merged")
+	c.Assert(res.Deleted, Equals, int64(0))
+	c.Assert(keeper.deleted, HasLen, 0)
+
+	opts.DryRun = false
+	res, err = VersionGC(keeper, opts)
+	c.Assert(err, IsNil)
+	c.Assert(res.Deleted, Equals, int64(2))
+	c.Assert(keeper.deleted, DeepEquals, []string{"feature-old", "feature-merged"})
+}
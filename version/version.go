@@ -0,0 +1,174 @@
+package version
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	// Override is the environment variable which sets up the version explicitly.
+	Override = "CACHEPROXY_VERSION"
+
+	// Default is used if the version is not found.
+	Default = "default"
+
+	// MaxLength is the maximum length of the normalized version.
+	MaxLength = 40
+
+	// ShortHashLength is the length of the commit hash which is used for detached HEAD.
+	ShortHashLength = 12
+)
+
+// CIVariables are environment variables with the branch name in common CI systems, in order of priority.
+var CIVariables = []string{
+	"GITHUB_HEAD_REF", // GitHub Actions, pull requests
+	"GITHUB_REF_NAME", // GitHub Actions
+	"CI_COMMIT_REF_NAME",
+	"BITBUCKET_BRANCH",
+	"BUILDKITE_BRANCH",
+	"CIRCLE_BRANCH",
+	"DRONE_BRANCH",
+	"TRAVIS_PULL_REQUEST_BRANCH",
+	"TRAVIS_BRANCH",
+	"BRANCH_NAME", // Jenkins
+	"GIT_BRANCH",  // Jenkins git plugin
+}
+
+var ErrNoRepository = errors.New("git repository is not found")
+
+var (
+	notAllowed = regexp.MustCompile(`[^-_./a-zA-Z0-9]+`)
+	prefixes   = []string{"refs/heads/", "refs/remotes/origin/", "refs/tags/", "origin/"}
+)
+
+// Resolve returns the normalized version from Override variable, CI variables
+// or git repository which contains dir (current directory if dir is empty).
+// Default is returned if nothing is found.
+func Resolve(dir string) string {
+	if v := Normalize(os.Getenv(Override)); v != "" {
+		return v
+	}
+
+	if v := Normalize(FromCI()); v != "" {
+		return v
+	}
+
+	if v, err := FromGit(dir); err == nil {
+		if v = Normalize(v); v != "" {
+			return v
+		}
+	}
+
+	return Default
+}
+
+// FromCI returns the first non-empty value of CIVariables.
+func FromCI() string {
+	for _, name := range CIVariables {
+		if v := strings.TrimSpace(os.Getenv(name)); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// FromGit returns the current branch of git repository which contains dir.
+// The short commit hash is returned for detached HEAD.
+func FromGit(dir string) (string, error) {
+	gitDir, err := findGitDir(dir)
+	if err != nil {
+		return "", err
+	}
+
+	head, err := os.ReadFile(filepath.Join(gitDir, "HEAD"))
+	if err != nil {
+		return "", err
+	}
+
+	ref := strings.TrimSpace(string(head))
+	if strings.HasPrefix(ref, "ref:") {
+		return strings.TrimPrefix(strings.TrimSpace(strings.TrimPrefix(ref, "ref:")), "refs/heads/"), nil
+	}
+
+	// detached HEAD keeps the commit hash
+	if len(ref) > ShortHashLength {
+		ref = ref[:ShortHashLength]
+	}
+	return ref, nil
+}
+
+// findGitDir looks for .git in dir and its parents. The worktree (and submodule)
+// has .git file with "gitdir: <path>" instead of directory.
+func findGitDir(dir string) (string, error) {
+	if dir == "" {
+		var err error
+		if dir, err = os.Getwd(); err != nil {
+			return "", err
+		}
+	}
+
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+
+	for {
+		path := filepath.Join(dir, ".git")
+		info, err := os.Stat(path)
+		if err == nil {
+			if info.IsDir() {
+				return path, nil
+			}
+			return readGitFile(path)
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", ErrNoRepository
+		}
+		dir = parent
+	}
+}
+
+func readGitFile(path string) (string, error) {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	line := strings.TrimSpace(string(body))
+	if !strings.HasPrefix(line, "gitdir:") {
+		return "", fmt.Errorf("%s: unknown format of .git file", path)
+	}
+
+	gitDir := strings.TrimSpace(strings.TrimPrefix(line, "gitdir:"))
+	if !filepath.IsAbs(gitDir) {
+		gitDir = filepath.Join(filepath.Dir(path), gitDir)
+	}
+
+	return gitDir, nil
+}
+
+// Normalize makes the version safe for storing: it cuts ref prefixes, replaces not allowed
+// symbols by "-" and shortens long names keeping them unique by the hash suffix.
+func Normalize(version string) string {
+	version = strings.TrimSpace(version)
+	for _, prefix := range prefixes {
+		version = strings.TrimPrefix(version, prefix)
+	}
+
+	version = notAllowed.ReplaceAllString(version, "-")
+	version = strings.Trim(version, "-./")
+
+	if len(version) > MaxLength {
+		suffix := fmt.Sprintf("-%x", sha1.Sum([]byte(version)))[:9]
+		version = version[:MaxLength-len(suffix)] + suffix
+	}
+
+	return version
+}
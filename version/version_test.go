@@ -0,0 +1,81 @@
+package version
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/iostrovok/check"
+)
+
+type testSuite struct{}
+
+var _ = Suite(&testSuite{})
+
+func TestService(t *testing.T) { TestingT(t) }
+
+func writeFile(c *C, path, body string) {
+	c.Assert(os.MkdirAll(filepath.Dir(path), 0o755), IsNil)
+	c.Assert(os.WriteFile(path, []byte(body), 0o644), IsNil)
+}
+
+func (s *testSuite) TestFromGit_Branch(c *C) {
+	dir := c.MkDir()
+	writeFile(c, filepath.Join(dir, ".git", "HEAD"), "ref: refs/heads/feature/x\n")
+
+	sub := filepath.Join(dir, "pkg", "sub")
+	c.Assert(os.MkdirAll(sub, 0o755), IsNil)
+
+	v, err := FromGit(sub)
+	c.Assert(err, IsNil)
+	c.Assert(v, Equals, "feature/x")
+}
+
+func (s *testSuite) TestFromGit_Detached(c *C) {
+	dir := c.MkDir()
+	writeFile(c, filepath.Join(dir, ".git", "HEAD"), "0123456789abcdef0123456789abcdef01234567\n")
+
+	v, err := FromGit(dir)
+	c.Assert(err, IsNil)
+	c.Assert(v, Equals, "0123456789ab")
+}
+
+func (s *testSuite) TestFromGit_Worktree(c *C) {
+	dir := c.MkDir()
+	writeFile(c, filepath.Join(dir, "main", ".git", "worktrees", "wt", "HEAD"), "ref: refs/heads/develop\n")
+	writeFile(c, filepath.Join(dir, "wt", ".git"), "gitdir: ../main/.git/worktrees/wt\n")
+
+	v, err := FromGit(filepath.Join(dir, "wt"))
+	c.Assert(err, IsNil)
+	c.Assert(v, Equals, "develop")
+}
+
+func (s *testSuite) TestFromGit_NoRepository(c *C) {
+	_, err := findGitDir(string(filepath.Separator))
+	c.Assert(err, Equals, ErrNoRepository)
+}
+
+func (s *testSuite) TestResolve_Override(c *C) {
+	old, find := os.LookupEnv(Override)
+	defer func() {
+		if find {
+			os.Setenv(Override, old)
+		} else {
+			os.Unsetenv(Override)
+		}
+	}()
+
+	c.Assert(os.Setenv(Override, "refs/heads/release 1.2"), IsNil)
+	c.Assert(Resolve(c.MkDir()), Equals, "release-1.2")
+}
+
+func (s *testSuite) TestNormalize(c *C) {
+	c.Assert(Normalize(" origin/feature/x "), Equals, "feature/x")
+	c.Assert(Normalize("it's \"quoted\""), Equals, "it-s-quoted")
+	c.Assert(Normalize("---"), Equals, "")
+
+	long := Normalize(strings.Repeat("very-long-branch-", 10))
+	c.Assert(len(long), Equals, MaxLength)
+	c.Assert(long, Not(Equals), Normalize(strings.Repeat("very-long-branch-", 11)))
+}